@@ -9,23 +9,34 @@ export declare interface VerifyController {
 }
 
 export class VerifyController extends EventEmitter {
-  child: ChildProcessWithoutNullStreams | null;
+  child: ChildProcessWithoutNullStreams | null = null;
 
   start() {
-    this.kill();
+    if (this.child !== null) {
+      return;
+    }
 
     console.log("Verify, start");
 
     const cwd = path.resolve(__dirname, "crypto");
     const bin = path.join(cwd, "bridge.bin");
     const args =
-      "-pkey EIDAS.G16.pk -system EIDAS.G16.ccs -vkey EIDAS.G16.vk".split(" ");
+      "-daemon -pkey EIDAS.G16.pk -system EIDAS.G16.ccs -vkey EIDAS.G16.vk".split(
+        " "
+      );
     console.log("Verify, starting", bin, args);
 
     this.child = spawn(bin, args, {
       windowsHide: true,
       cwd,
     });
+    const child = this.child;
+    child.on("exit", (code) => {
+      console.log("Verify, exited", code);
+      if (this.child === child) {
+        this.child = null;
+      }
+    });
     readline
       .createInterface({ input: this.child.stdout, terminal: false })
       .on("line", (line) => {
@@ -34,6 +45,26 @@ export class VerifyController extends EventEmitter {
       });
   }
 
+  get running(): boolean {
+    return this.child !== null;
+  }
+
+  link(session: string) {
+    this.send(JSON.stringify({ id: "LINK", session }));
+  }
+
+  select(session: string, slot: number) {
+    this.send(JSON.stringify({ id: "SELECT", session, slot }));
+  }
+
+  sign(session: string, pin: string, challenge: string) {
+    this.send(JSON.stringify({ id: "SIGN", session, pin, challenge }));
+  }
+
+  cancel(session: string) {
+    this.send(JSON.stringify({ id: "CANCEL", session }));
+  }
+
   send(data: string) {
     console.log("Verify, in:", data);
     assert(this.child !== null);
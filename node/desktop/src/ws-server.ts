@@ -7,12 +7,48 @@ import { VerifyController } from "./verify-controller";
 
 type InputMessage =
   | { id: "LINK" }
+  | { id: "SELECT"; slot: number }
   | { id: "SIGN"; pin: string; challenge: string };
 
+// mirrors snark/protocol, version 1
+type ErrorCode =
+  | "WRONG_PIN"
+  | "PIN_LOCKED"
+  | "CARD_REMOVED"
+  | "KEY_MISMATCH"
+  | "ARTIFACTS"
+  | "BAD_REQUEST"
+  | "UNKNOWN_SESSION"
+  | "UNSUPPORTED_VERSION"
+  | "INTERNAL";
+
+type PINStatus = { attempts: number; countLow?: boolean };
+
+type Token = {
+  slot: number;
+  label: string;
+  serial: string;
+  manufacturer?: string;
+};
+
 type OutputMessage =
-  | { id: "INSERTED" }
-  | { id: "SIGNED" }
-  | { id: "GENERATED"; proof: string };
+  | { id: "HELLO"; version: number; backend: string; module?: string }
+  | { id: "LOADING"; read: number; total: number }
+  | { id: "LOADED" }
+  | { id: "CHOOSE"; session?: string; tokens: Token[] }
+  | { id: "INSERTED"; session?: string; pinPad?: boolean }
+  | { id: "PIN_REQUIRED"; session?: string; pin: PINStatus }
+  | { id: "PIN_PAD"; session?: string; pin: PINStatus }
+  | { id: "SIGNED"; session?: string }
+  | { id: "PROVING"; session?: string; stage: string }
+  | { id: "GENERATED"; session?: string; proof: string }
+  | {
+      id: "ERROR";
+      session?: string;
+      code: ErrorCode;
+      error: string;
+      pin?: PINStatus;
+    };
 
 const send = (ws: WebSocket, data: OutputMessage | string): Promise<void> => {
   let resolve: () => void;
@@ -36,6 +72,9 @@ const send = (ws: WebSocket, data: OutputMessage | string): Promise<void> => {
 export class WsServer {
   server: https.Server | null = null;
   wss: WebSocketServer | null = null;
+  // one bridge daemon serves the sessions of all connections
+  verify = new VerifyController();
+  sessions = 0;
 
   async start(opts: {
     port: number;
@@ -53,13 +92,31 @@ export class WsServer {
 
     this.wss.on("connection", (ws) => {
       console.log("WS, connection");
-      const verify = new VerifyController();
-      verify.on("out", async (data) => {
+      const session = `${++this.sessions}`;
+      // set once LINK started the daemon for this session
+      let linked = false;
+      const onOut = async (data: string) => {
+        let target: string | undefined;
+        try {
+          target = JSON.parse(data).session;
+        } catch {
+          // not a protocol message, sent to every session
+        }
+        if (target !== undefined && target !== session) {
+          return;
+        }
         console.log("WS, verify out:", data);
         await send(ws, data);
-      });
+      };
+      this.verify.on("out", onOut);
 
       ws.on("error", console.error);
+      ws.on("close", () => {
+        this.verify.off("out", onOut);
+        if (linked && this.verify.running) {
+          this.verify.cancel(session);
+        }
+      });
 
       ws.on("message", async (data) => {
         const message: InputMessage = JSON.parse(data.toString());
@@ -67,14 +124,19 @@ export class WsServer {
         switch (message.id) {
           case "LINK":
             console.log("WS, LINK");
-            verify.start();
+            this.verify.start();
+            this.verify.link(session);
+            linked = true;
+            break;
+          case "SELECT":
+            console.log(`WS, SELECT, slot: ${message.slot}`);
+            this.verify.select(session, message.slot);
             break;
           case "SIGN":
             console.log(
               `WS, SIGN, pin: ${message.pin}, challenge: ${message.challenge}`
             );
-            verify.send(message.pin);
-            verify.send(message.challenge);
+            this.verify.sign(session, message.pin, message.challenge);
             break;
         }
       });
@@ -85,5 +147,6 @@ export class WsServer {
     assert(this.wss !== null);
     await promisify(this.wss.close.bind(this.wss));
     this.wss = null;
+    this.verify.kill();
   }
 }
@@ -0,0 +1,157 @@
+package cards
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoCard is returned by Reader.Connect when the reader is empty.
+var ErrNoCard = errors.New("no card in reader")
+
+// Reader is a PC/SC card reader.
+type Reader interface {
+	Name() string
+	// Connect connects to the card in the reader, it returns ErrNoCard when
+	// there is none.
+	Connect() (Card, error)
+}
+
+// Card is a connection to a card, exchanging ISO 7816 APDUs.
+type Card interface {
+	// Transmit sends a command APDU and returns the response APDU, the data
+	// followed by SW1 SW2.
+	Transmit(apdu []byte) ([]byte, error)
+	Close() error
+}
+
+const (
+	swOK          = 0x9000
+	swMoreData    = 0x6100 // SW2 bytes left, read with GET RESPONSE
+	swVerifyFail  = 0x63c0 // low nibble of SW2 tries left
+	swAuthBlocked = 0x6983
+
+	insGetResponse = 0xc0
+)
+
+// StatusError is a status word other than 9000 returned by the card.
+type StatusError uint16
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("card status %04x", uint16(e))
+}
+
+// transmit sends a command with chaining of data longer than 255 bytes and
+// collects the response data over GET RESPONSE.
+func transmit(card Card, cla, ins, p1, p2 byte, data []byte) ([]byte, error) {
+	for len(data) > 255 {
+		if _, err := exchange(card, cla|0x10, ins, p1, p2, data[:255], false); err != nil {
+			return nil, err
+		}
+		data = data[255:]
+	}
+	ret, err := exchange(card, cla, ins, p1, p2, data, true)
+	var sw StatusError
+	for errors.As(err, &sw) && sw&0xff00 == swMoreData {
+		var more []byte
+		more, err = exchange(card, 0x00, insGetResponse, 0, 0, nil, true)
+		ret = append(ret, more...)
+	}
+	return ret, err
+}
+
+// exchange sends a single short APDU, with Le 00 if le is set. The response
+// data is returned along with a StatusError unless the status is 9000.
+func exchange(card Card, cla, ins, p1, p2 byte, data []byte, le bool) ([]byte, error) {
+	apdu := []byte{cla, ins, p1, p2}
+	if len(data) > 0 {
+		apdu = append(apdu, byte(len(data)))
+		apdu = append(apdu, data...)
+	}
+	if le {
+		apdu = append(apdu, 0)
+	}
+	resp, err := card.Transmit(apdu)
+	if err != nil {
+		return nil, fmt.Errorf("transmit: %w", err)
+	}
+	if len(resp) < 2 {
+		return nil, fmt.Errorf("short response %x", resp)
+	}
+	sw := uint16(resp[len(resp)-2])<<8 | uint16(resp[len(resp)-1])
+	resp = resp[:len(resp)-2]
+	if sw != swOK {
+		return resp, StatusError(sw)
+	}
+	return resp, nil
+}
+
+// tlv encodes a BER-TLV with the tag given in its encoded form.
+func tlv(tag []byte, value ...[]byte) []byte {
+	var n int
+	for _, v := range value {
+		n += len(v)
+	}
+	ret := append([]byte{}, tag...)
+	switch {
+	case n < 0x80:
+		ret = append(ret, byte(n))
+	case n < 0x100:
+		ret = append(ret, 0x81, byte(n))
+	default:
+		ret = append(ret, 0x82, byte(n>>8), byte(n))
+	}
+	for _, v := range value {
+		ret = append(ret, v...)
+	}
+	return ret
+}
+
+// parseTLV splits the first BER-TLV off data, the tag in its encoded form.
+func parseTLV(data []byte) (tag, value, rest []byte, err error) {
+	if len(data) < 2 {
+		return nil, nil, nil, errors.New("tlv: truncated")
+	}
+	i := 1
+	if data[0]&0x1f == 0x1f {
+		for i < len(data) && data[i]&0x80 != 0 {
+			i++
+		}
+		i++
+	}
+	if i >= len(data) {
+		return nil, nil, nil, errors.New("tlv: truncated tag")
+	}
+	tag = data[:i]
+	n := int(data[i])
+	i++
+	if n&0x80 != 0 {
+		size := n & 0x7f
+		if size == 0 || size > 3 || i+size > len(data) {
+			return nil, nil, nil, errors.New("tlv: invalid length")
+		}
+		n = 0
+		for _, b := range data[i : i+size] {
+			n = n<<8 | int(b)
+		}
+		i += size
+	}
+	if i+n > len(data) {
+		return nil, nil, nil, errors.New("tlv: truncated value")
+	}
+	return tag, data[i : i+n], data[i+n:], nil
+}
+
+// findTLV returns the value of the first TLV with the tag in data.
+func findTLV(data []byte, tag ...byte) ([]byte, error) {
+	for len(data) > 0 {
+		t, v, rest, err := parseTLV(data)
+		if err != nil {
+			return nil, err
+		}
+		if string(t) == string(tag) {
+			return v, nil
+		}
+		data = rest
+	}
+	return nil, fmt.Errorf("tlv: tag %x not found", tag)
+}
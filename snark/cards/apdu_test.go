@@ -0,0 +1,96 @@
+package cards
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// chunkedCard answers every command with resp, 250 bytes at a time over GET
+// RESPONSE, and records the commands.
+type chunkedCard struct {
+	resp     []byte
+	commands [][]byte
+}
+
+func (c *chunkedCard) Transmit(apdu []byte) ([]byte, error) {
+	c.commands = append(c.commands, apdu)
+	if apdu[1] != insGetResponse && apdu[0]&0x10 != 0 {
+		return []byte{0x90, 0x00}, nil
+	}
+	n := len(c.resp)
+	if n > 250 {
+		n = 250
+	}
+	ret := append([]byte{}, c.resp[:n]...)
+	c.resp = c.resp[n:]
+	if len(c.resp) > 0 {
+		return append(ret, 0x61, byte(len(c.resp))), nil
+	}
+	return append(ret, 0x90, 0x00), nil
+}
+
+func (c *chunkedCard) Close() error {
+	return nil
+}
+
+func TestTransmit(t *testing.T) {
+	resp := bytes.Repeat([]byte{1, 2, 3}, 200)
+	card := &chunkedCard{resp: resp}
+	data := bytes.Repeat([]byte{0xaa}, 300)
+	got, err := transmit(card, 0x00, 0xdb, 0x3f, 0xff, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, resp) {
+		t.Fatalf("expected %d bytes, got %d", len(resp), len(got))
+	}
+	var headers []string
+	for _, c := range card.commands {
+		headers = append(headers, fmt.Sprintf("%x", c[:5]))
+	}
+	if fmt.Sprint(headers) != "[10db3fffff 00db3fff2d 00c0000000 00c0000000]" {
+		t.Fatalf("unexpected commands %v", headers)
+	}
+
+	_, err = exchange(&fixedCard{0x6a, 0x82}, 0x00, 0xcb, 0x3f, 0xff, nil, true)
+	var sw StatusError
+	if !errors.As(err, &sw) || sw != 0x6a82 {
+		t.Fatalf("expected status 6a82, got %v", err)
+	}
+}
+
+type fixedCard []byte
+
+func (c *fixedCard) Transmit([]byte) ([]byte, error) {
+	return *c, nil
+}
+
+func (c *fixedCard) Close() error {
+	return nil
+}
+
+func TestTLV(t *testing.T) {
+	for _, n := range []int{0, 5, 0x7f, 0x80, 0xff, 0x100, 1000} {
+		value := bytes.Repeat([]byte{7}, n)
+		encoded := append(tlv([]byte{0x5f, 0xc1, 0x05}, value), 0x90)
+		tag, v, rest, err := parseTLV(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(tag, []byte{0x5f, 0xc1, 0x05}) || !bytes.Equal(v, value) || !bytes.Equal(rest, []byte{0x90}) {
+			t.Fatalf("%d: unexpected %x %d %x", n, tag, len(v), rest)
+		}
+	}
+	v, err := findTLV(tlv([]byte{0x7c}, tlv([]byte{0x82}, []byte{1, 2})), 0x7c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, err = findTLV(v, 0x82); err != nil || !bytes.Equal(v, []byte{1, 2}) {
+		t.Fatalf("unexpected %x %v", v, err)
+	}
+	if _, _, _, err := parseTLV([]byte{0x53, 0x82, 0x01}); err == nil {
+		t.Fatal("expected error for a truncated length")
+	}
+}
@@ -0,0 +1,57 @@
+package cards
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"os"
+)
+
+// Backend is a source of tokens and their signers, a PKCS#11 module, PIV
+// cards over PC/SC, a remote signature service or a software token.
+type Backend interface {
+	EnumerateTokens() ([]*Token, error)
+	Watch(ctx context.Context) (<-chan Event, error)
+	PINStatus(token *Token) (PINStatus, error)
+	Select(sel *Selector, in []*Token) ([]*Token, error)
+	FilterTokens(hint string, in []*Token) []*Token
+	SetPIN(pin string)
+	// GetSigner returns the signer of the key chosen by the backend.
+	GetSigner(token *Token) (*x509.Certificate, *ecdsa.PublicKey, crypto.Signer, error)
+	TokenSigner
+}
+
+var (
+	_ Backend = (*Config)(nil)
+	_ Backend = (*SoftToken)(nil)
+	_ Backend = (*PIV)(nil)
+	_ Backend = (*CSC)(nil)
+)
+
+// FromEnv returns the PKCS#11 module in $EIDAS_PKCS11_MODULE, the discovered
+// one when it is "auto", or a software token with DefaultSubject when it is
+// not set, with the PIN in $EIDAS_PIN or SoftTokenPIN. The tests use it to
+// run against a card when one is configured.
+func FromEnv() (Backend, error) {
+	pin := os.Getenv("EIDAS_PIN")
+	if pin == "" {
+		pin = SoftTokenPIN
+	}
+	path := os.Getenv("EIDAS_PKCS11_MODULE")
+	if path == "" {
+		s, err := NewSoftToken(DefaultSubject)
+		if err != nil {
+			return nil, err
+		}
+		s.SetPIN(pin)
+		return s, nil
+	}
+	if path == "auto" {
+		var err error
+		if path, err = Discover(); err != nil {
+			return nil, err
+		}
+	}
+	return New(path, pin), nil
+}
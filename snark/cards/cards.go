@@ -6,20 +6,29 @@ import (
 	"crypto/x509"
 	"errors"
 	"fmt"
-	"math/big"
 	"strings"
+	"sync"
 
-	"github.com/ThalesIgnite/crypto11"
 	"github.com/miekg/pkcs11"
-	"golang.org/x/crypto/cryptobyte"
-	"golang.org/x/crypto/cryptobyte/asn1"
 )
 
 type Config struct {
 	Path string
 	PIN  string
+	// Key picks the key used by GetSigner. When nil a single key is used as
+	// is and AuthenticationKey chooses among several.
+	Key *KeyPolicy
 
-	closer func() error
+	// shared library handle and PIN, see module.go
+	mu        sync.Mutex
+	module    *pkcs11.Ctx
+	refs      int
+	waits     []chan pkcs11.SlotEvent
+	unloading chan struct{} // closed once the last release finalised the library
+
+	// signing sessions by slot, see session.go
+	sessionsMu sync.Mutex
+	sessions   map[uint]*session
 }
 
 func New(path string, pin string) *Config {
@@ -30,18 +39,37 @@ func New(path string, pin string) *Config {
 }
 
 type Token struct {
-	Label  string
-	Serial string
+	Slot         uint
+	Label        string
+	Serial       string
+	Manufacturer string
+	PIN          PINStatus
+	// ProtectedAuthPath is set for tokens in pinpad readers, the PIN is
+	// entered on the reader during GetSigner and never touches the host.
+	ProtectedAuthPath bool
+}
+
+func newToken(slot uint, tinfo pkcs11.TokenInfo) *Token {
+	return &Token{
+		Slot:              slot,
+		Label:             tinfo.Label,
+		Serial:            tinfo.SerialNumber,
+		Manufacturer:      tinfo.ManufacturerID,
+		PIN:               pinStatus(tinfo.Flags),
+		ProtectedAuthPath: tinfo.Flags&pkcs11.CKF_PROTECTED_AUTHENTICATION_PATH != 0,
+	}
 }
 
 func (ctx *Config) EnumerateTokens() ([]*Token, error) {
-	p := pkcs11.New(ctx.Path)
-	err := p.Initialize()
+	p, err := ctx.acquire()
 	if err != nil {
-		return nil, fmt.Errorf("init: %w", err)
+		return nil, err
 	}
-	defer p.Destroy()
-	defer p.Finalize()
+	defer ctx.release()
+	return enumerate(p)
+}
+
+func enumerate(p *pkcs11.Ctx) ([]*Token, error) {
 	slots, err := p.GetSlotList(true)
 	if err != nil {
 		return nil, fmt.Errorf("get slots: %w", err)
@@ -52,16 +80,25 @@ func (ctx *Config) EnumerateTokens() ([]*Token, error) {
 		if err != nil {
 			return nil, fmt.Errorf("get token info: %w", err)
 		}
-		ret = append(ret, &Token{Label: tinfo.Label, Serial: tinfo.SerialNumber})
+		ret = append(ret, newToken(slot, tinfo))
 	}
 	return ret, nil
 }
 
 func (ctx *Config) SetPIN(pin string) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
 	ctx.PIN = pin
 }
 
+func (ctx *Config) pin() string {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	return ctx.PIN
+}
+
 // Filter Tokens given hint. If hint is "", then doesn't filter and return as is.
+// Select matches by other criteria.
 func (ctx *Config) FilterTokens(hint string, in []*Token) []*Token {
 	if hint == "" {
 		return in
@@ -75,54 +112,87 @@ func (ctx *Config) FilterTokens(hint string, in []*Token) []*Token {
 	return ret
 }
 
+// GetSigner logs into the token and returns the key chosen by the key
+// policy. A rejected PIN is returned as *PINError, a locked PIN is not tried.
+// Tokens with a protected authentication path are logged into without a PIN,
+// the call blocks until it is entered on the reader. The token stays logged
+// in for the following calls until Close.
 func (ctx *Config) GetSigner(token *Token) (*x509.Certificate, *ecdsa.PublicKey, crypto.Signer, error) {
-	pp, err := crypto11.Configure(&crypto11.Config{
-		Path:       ctx.Path,
-		Pin:        ctx.PIN,
-		TokenLabel: token.Label,
-	})
-	if err != nil {
-		return nil, nil, nil, fmt.Errorf("configure: %w", err)
+	if token.PIN.Locked {
+		return nil, nil, nil, &PINError{Err: ErrPINLocked, Status: token.PIN}
 	}
-	ctx.closer = pp.Close
-	certs, err := pp.FindAllPairedCertificates()
+	keys, err := ctx.Keys(token)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("get certs: %w", err)
 	}
-	if len(certs) != 1 {
-		return nil, nil, nil, fmt.Errorf("found more than one cert in slot")
+	key, err := ctx.chooseKey(keys)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	cert := certs[0]
-	priv, ok := cert.PrivateKey.(crypto11.Signer)
-	if !ok {
-		return nil, nil, nil, fmt.Errorf("cannot cast to signer")
+	return ctx.getSigner(token, key)
+}
+
+// Signer logs into the token and returns the signer of the key of cert.
+func (ctx *Config) Signer(token *Token, cert *x509.Certificate) (crypto.Signer, error) {
+	if token.PIN.Locked {
+		return nil, &PINError{Err: ErrPINLocked, Status: token.PIN}
+	}
+	keys, err := ctx.Keys(token)
+	if err != nil {
+		return nil, fmt.Errorf("get certs: %w", err)
+	}
+	for _, k := range keys {
+		if k.Certificate.Equal(cert) {
+			_, _, signer, err := ctx.getSigner(token, k)
+			return signer, err
+		}
 	}
-	pub, ok := priv.Public().(*ecdsa.PublicKey)
+	return nil, fmt.Errorf("no key for cert %q on token %q", cert.Subject.CommonName, token.Label)
+}
+
+func (ctx *Config) getSigner(token *Token, key *Key) (*x509.Certificate, *ecdsa.PublicKey, crypto.Signer, error) {
+	pub, ok := key.Certificate.PublicKey.(*ecdsa.PublicKey)
 	if !ok {
-		return nil, nil, nil, fmt.Errorf("cannot cast to verifier")
+		return nil, nil, nil, fmt.Errorf("certificate key %T is not ECDSA", key.Certificate.PublicKey)
+	}
+	s, err := ctx.openSession(token)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	return cert.Leaf, pub, priv, nil
+	priv, err := s.findKey(key.ID)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("find key %x: %w", key.ID, err)
+	}
+	return key.Certificate, pub, &p11Signer{s: s, key: priv, pub: pub}, nil
 }
 
+// Close logs out of the tokens and closes their sessions, the signers
+// returned so far stop working.
 func (ctx *Config) Close() error {
-	if ctx.closer == nil {
-		return nil
+	ctx.sessionsMu.Lock()
+	sessions := ctx.sessions
+	ctx.sessions = nil
+	ctx.sessionsMu.Unlock()
+	var errs []error
+	for _, s := range sessions {
+		if err := s.close(); err != nil {
+			errs = append(errs, err)
+		}
+		ctx.release()
 	}
-	err := ctx.closer()
-	ctx.closer = nil
-	return err
+	return errors.Join(errs...)
 }
 
-func UnmarshalSignature(sig []byte) (r, s *big.Int, err error) {
-	var inner cryptobyte.String
-	r, s = new(big.Int), new(big.Int)
-	input := cryptobyte.String(sig)
-	if !input.ReadASN1(&inner, asn1.SEQUENCE) ||
-		!input.Empty() ||
-		!inner.ReadASN1Integer(r) ||
-		!inner.ReadASN1Integer(s) ||
-		!inner.Empty() {
-		return nil, nil, errors.New("invalid ASN.1")
-	}
-	return r, s, nil
+// CloseToken logs out of the token and closes its session, the signers of
+// the other tokens keep working.
+func (ctx *Config) CloseToken(token *Token) error {
+	ctx.sessionsMu.Lock()
+	s, ok := ctx.sessions[token.Slot]
+	delete(ctx.sessions, token.Slot)
+	ctx.sessionsMu.Unlock()
+	if !ok {
+		return nil
+	}
+	defer ctx.release()
+	return s.close()
 }
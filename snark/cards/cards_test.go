@@ -3,16 +3,25 @@ package cards
 import (
 	"crypto/ecdsa"
 	"testing"
+
+	"github.com/ritave/eIDAS-bridge/snark/cards/sig"
 )
 
 func TestGetSigner(t *testing.T) {
 	msg := []byte("test msg")
-	ctx := New("/opt/homebrew/lib/opensc-pkcs11.so", "123456")
+	ctx, err := FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
 	tokens, err := ctx.EnumerateTokens()
 	if err != nil {
 		t.Fatal(err)
 	}
-	tokens = ctx.FilterTokens("PN", tokens)
+	hint := "PN"
+	if _, ok := ctx.(*SoftToken); ok {
+		hint = "SoftToken"
+	}
+	tokens = ctx.FilterTokens(hint, tokens)
 	if len(tokens) != 1 {
 		t.Fatal("not one token")
 	}
@@ -25,7 +34,7 @@ func TestGetSigner(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	r, s, err := UnmarshalSignature(signature)
+	r, s, err := sig.Unmarshal(signature, pub.Curve)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,210 @@
+package cardstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// CSCCredential is a credential of a CSC server.
+type CSCCredential struct {
+	ID   string
+	Key  *ecdsa.PrivateKey
+	Cert *x509.Certificate
+	// PIN authorises the credential explicitly, when empty it is authorised
+	// out of band.
+	PIN string
+	// AuthMode of a credential without a PIN, implicit when empty.
+	AuthMode string
+}
+
+// NewCredential generates a P-384 key and self-signed certificate for the
+// credential.
+func NewCredential(t testing.TB, id, pin string) *CSCCredential {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := selfSign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &CSCCredential{ID: id, Key: key, Cert: cert, PIN: pin}
+}
+
+// CSC is a mock Cloud Signature Consortium API v2 service with the methods
+// used by cards.CSC, its URL ends in /csc/v2.
+type CSC struct {
+	URL   string
+	Token string
+
+	mu          sync.Mutex
+	credentials []*CSCCredential
+	sads        map[string]string // SAD to the authorised hash
+	nextSAD     int
+	signed      int
+}
+
+// NewCSC starts a mock service with the credentials, closed when the test
+// ends.
+func NewCSC(t testing.TB, credentials ...*CSCCredential) *CSC {
+	c := &CSC{Token: "test-token", credentials: credentials, sads: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/csc/v2/credentials/list", c.handle(c.list))
+	mux.HandleFunc("/csc/v2/credentials/info", c.handle(c.info))
+	mux.HandleFunc("/csc/v2/credentials/authorize", c.handle(c.authorize))
+	mux.HandleFunc("/csc/v2/signatures/signHash", c.handle(c.signHash))
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	c.URL = srv.URL + "/csc/v2"
+	return c
+}
+
+// Signed returns the number of signatures created.
+func (c *CSC) Signed() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.signed
+}
+
+// cscError is an error response with its HTTP status.
+type cscError struct {
+	status      int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *cscError) Error() string {
+	return e.Code
+}
+
+func badRequest(code, description string) *cscError {
+	return &cscError{status: http.StatusBadRequest, Code: code, Description: description}
+}
+
+// handle decodes the request into a map and encodes the response of fn.
+func (c *CSC) handle(fn func(req map[string]any) (any, *cscError)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var resp any
+		var err *cscError
+		req := make(map[string]any)
+		switch {
+		case r.Method != http.MethodPost:
+			err = &cscError{status: http.StatusMethodNotAllowed, Code: "invalid_request"}
+		case r.Header.Get("Authorization") != "Bearer "+c.Token:
+			err = &cscError{status: http.StatusUnauthorized, Code: "invalid_token"}
+		case json.NewDecoder(r.Body).Decode(&req) != nil:
+			err = badRequest("invalid_request", "malformed JSON")
+		default:
+			c.mu.Lock()
+			resp, err = fn(req)
+			c.mu.Unlock()
+		}
+		if err != nil {
+			w.WriteHeader(err.status)
+			resp = err
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func (c *CSC) credential(req map[string]any) (*CSCCredential, *cscError) {
+	id, _ := req["credentialID"].(string)
+	for _, cred := range c.credentials {
+		if cred.ID == id {
+			return cred, nil
+		}
+	}
+	return nil, badRequest("invalid_request", "Invalid parameter credentialID")
+}
+
+func (c *CSC) list(map[string]any) (any, *cscError) {
+	ids := []string{}
+	for _, cred := range c.credentials {
+		ids = append(ids, cred.ID)
+	}
+	return map[string]any{"credentialIDs": ids}, nil
+}
+
+func (c *CSC) info(req map[string]any) (any, *cscError) {
+	cred, err := c.credential(req)
+	if err != nil {
+		return nil, err
+	}
+	if cred.Cert == nil {
+		// a credential broken on the service
+		return nil, &cscError{status: http.StatusInternalServerError, Code: "server_error"}
+	}
+	resp := map[string]any{
+		"key": map[string]any{
+			"status": "enabled",
+			"algo":   []string{"1.2.840.10045.2.1"},
+			"len":    cred.Key.Params().BitSize,
+		},
+		"cert": map[string]any{
+			"status":       "valid",
+			"certificates": []string{base64.StdEncoding.EncodeToString(cred.Cert.Raw)},
+		},
+		"authMode": "implicit",
+	}
+	if cred.AuthMode != "" {
+		resp["authMode"] = cred.AuthMode
+	}
+	if cred.PIN != "" {
+		resp["authMode"] = "explicit"
+		resp["PIN"] = map[string]any{"presence": "true", "format": "N"}
+	}
+	return resp, nil
+}
+
+func (c *CSC) authorize(req map[string]any) (any, *cscError) {
+	cred, err := c.credential(req)
+	if err != nil {
+		return nil, err
+	}
+	if pin, _ := req["PIN"].(string); cred.PIN != "" && pin != cred.PIN {
+		return nil, badRequest("invalid_pin", "Invalid PIN")
+	}
+	hashes, _ := req["hashes"].([]any)
+	if len(hashes) != 1 {
+		return nil, badRequest("invalid_request", "Invalid parameter hashes")
+	}
+	c.nextSAD++
+	sad := fmt.Sprintf("sad-%d", c.nextSAD)
+	c.sads[sad] = cred.ID + ":" + fmt.Sprint(hashes[0])
+	return map[string]any{"SAD": sad}, nil
+}
+
+func (c *CSC) signHash(req map[string]any) (any, *cscError) {
+	cred, err := c.credential(req)
+	if err != nil {
+		return nil, err
+	}
+	hashes, _ := req["hashes"].([]any)
+	sad, _ := req["SAD"].(string)
+	if len(hashes) != 1 || c.sads[sad] != cred.ID+":"+fmt.Sprint(hashes[0]) {
+		return nil, badRequest("invalid_request", "Invalid SAD")
+	}
+	delete(c.sads, sad)
+	hash, _ := base64.StdEncoding.DecodeString(fmt.Sprint(hashes[0]))
+	algos := map[string]int{"2.16.840.1.101.3.4.2.1": 32, "2.16.840.1.101.3.4.2.2": 48}
+	if n, ok := algos[fmt.Sprint(req["hashAlgo"])]; !ok || n != len(hash) {
+		return nil, badRequest("invalid_request", "Invalid parameter hashAlgo")
+	}
+	sig, serr := ecdsa.SignASN1(rand.Reader, cred.Key, hash)
+	if serr != nil {
+		return nil, &cscError{status: http.StatusInternalServerError, Code: "server_error"}
+	}
+	c.signed++
+	return map[string]any{"signatures": []string{base64.StdEncoding.EncodeToString(sig)}}, nil
+}
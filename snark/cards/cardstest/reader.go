@@ -0,0 +1,107 @@
+package cardstest
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/ritave/eIDAS-bridge/snark/cards"
+)
+
+// Exchange is a command APDU expected by a Reader and the response of the
+// card, the data followed by SW1 SW2.
+type Exchange struct {
+	Command  []byte
+	Response []byte
+}
+
+// Reader is a scripted card reader for cards.PIV. The card answers the
+// commands of the script in order, across connections, and fails the test
+// on any other command or if the script is not played to the end.
+type Reader struct {
+	t    testing.TB
+	name string
+
+	mu      sync.Mutex
+	script  []Exchange
+	present bool
+}
+
+var _ cards.Reader = (*Reader)(nil)
+
+// NewReader returns a reader with a card answering the script.
+func NewReader(t testing.TB, name string, script ...Exchange) *Reader {
+	r := &Reader{t: t, name: name, script: script, present: true}
+	t.Cleanup(func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if len(r.script) > 0 {
+			t.Errorf("reader %q: %d exchanges left, next %x", name, len(r.script), r.script[0].Command)
+		}
+	})
+	return r
+}
+
+// Play appends exchanges to the script.
+func (r *Reader) Play(script ...Exchange) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.script = append(r.script, script...)
+}
+
+// Insert and Remove put the card into the reader and take it out.
+func (r *Reader) Insert() {
+	r.setPresent(true)
+}
+
+func (r *Reader) Remove() {
+	r.setPresent(false)
+}
+
+func (r *Reader) setPresent(present bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.present = present
+}
+
+func (r *Reader) Name() string {
+	return r.name
+}
+
+func (r *Reader) Connect() (cards.Card, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.present {
+		return nil, cards.ErrNoCard
+	}
+	return &card{r}, nil
+}
+
+type card struct {
+	r *Reader
+}
+
+func (c *card) Transmit(apdu []byte) ([]byte, error) {
+	r := c.r
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.present {
+		return nil, errors.New("card removed")
+	}
+	if len(r.script) == 0 {
+		r.t.Errorf("reader %q: unexpected command %x", r.name, apdu)
+		return nil, errors.New("unexpected command")
+	}
+	e := r.script[0]
+	if !bytes.Equal(e.Command, apdu) {
+		r.t.Errorf("reader %q: expected command %x, got %x", r.name, e.Command, apdu)
+		return nil, errors.New("unexpected command")
+	}
+	r.script = r.script[1:]
+	return e.Response, nil
+}
+
+func (c *card) Close() error {
+	return nil
+}
@@ -0,0 +1,211 @@
+// Package cardstest provides a SoftHSM2 token for testing the PKCS#11 path of
+// package cards with the real pkcs11 code.
+package cardstest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+const (
+	// Label, PIN and KeyID of the token created by SoftHSM.
+	Label = "eidas-test"
+	PIN   = "123456"
+	KeyID = "\x01"
+
+	soPIN = "12345678"
+)
+
+// modules are the usual install locations of libsofthsm2.
+var modules = []string{
+	"/usr/lib/softhsm/libsofthsm2.so",
+	"/usr/lib/x86_64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib/aarch64-linux-gnu/softhsm/libsofthsm2.so",
+	"/usr/lib64/pkcs11/libsofthsm2.so",
+	"/usr/local/lib/softhsm/libsofthsm2.so",
+	"/opt/homebrew/lib/softhsm/libsofthsm2.so",
+}
+
+// HSM is a SoftHSM2 token holding a P-384 key and its self-signed
+// certificate.
+type HSM struct {
+	Path string // the PKCS#11 module
+	Key  *ecdsa.PrivateKey
+	Cert *x509.Certificate
+}
+
+// Module returns the SoftHSM2 module in $SOFTHSM2_MODULE or one of the usual
+// locations, "" if there is none.
+func Module() string {
+	if path := os.Getenv("SOFTHSM2_MODULE"); path != "" {
+		return path
+	}
+	for _, path := range modules {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// SoftHSM initialises a token in a temporary SoftHSM2 store and imports a new
+// key and certificate, it skips the test when libsofthsm2 is absent. The
+// module is finalised on return so that package cards can initialise it.
+// SOFTHSM2_CONF is set for the test, so it can not run in parallel.
+func SoftHSM(t testing.TB) *HSM {
+	t.Helper()
+	path := Module()
+	if path == "" {
+		t.Skip("libsofthsm2 not found, set SOFTHSM2_MODULE")
+	}
+	dir := t.TempDir()
+	conf := filepath.Join(dir, "softhsm2.conf")
+	tokens := filepath.Join(dir, "tokens")
+	if err := os.Mkdir(tokens, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf("directories.tokendir = %s\nobjectstore.backend = file\nlog.level = ERROR\n", tokens)
+	if err := os.WriteFile(conf, []byte(config), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SOFTHSM2_CONF", conf)
+
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := selfSign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := initToken(path, key, cert); err != nil {
+		t.Fatalf("softhsm: %v", err)
+	}
+	return &HSM{Path: path, Key: key, Cert: cert}
+}
+
+func selfSign(key *ecdsa.PrivateKey) (*x509.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "SoftHSM Test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("create cert: %w", err)
+	}
+	return x509.ParseCertificate(der)
+}
+
+func initToken(path string, key *ecdsa.PrivateKey, cert *x509.Certificate) error {
+	p := pkcs11.New(path)
+	if p == nil {
+		return fmt.Errorf("load %s", path)
+	}
+	defer p.Destroy()
+	if err := p.Initialize(); err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+	defer p.Finalize()
+	slots, err := p.GetSlotList(false)
+	if err != nil || len(slots) == 0 {
+		return fmt.Errorf("get slots: %v", err)
+	}
+	if err := p.InitToken(slots[0], soPIN, Label); err != nil {
+		return fmt.Errorf("init token: %w", err)
+	}
+	// SoftHSM moves the initialised token to a new slot
+	slot, err := findSlot(p)
+	if err != nil {
+		return err
+	}
+	session, err := p.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		return fmt.Errorf("open session: %w", err)
+	}
+	defer p.CloseSession(session)
+	if err := p.Login(session, pkcs11.CKU_SO, soPIN); err != nil {
+		return fmt.Errorf("login SO: %w", err)
+	}
+	if err := p.InitPIN(session, PIN); err != nil {
+		return fmt.Errorf("init PIN: %w", err)
+	}
+	if err := p.Logout(session); err != nil {
+		return fmt.Errorf("logout: %w", err)
+	}
+	if err := p.Login(session, pkcs11.CKU_USER, PIN); err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+	defer p.Logout(session)
+	for _, template := range objects(key, cert) {
+		if _, err := p.CreateObject(session, template); err != nil {
+			return fmt.Errorf("create object: %w", err)
+		}
+	}
+	return nil
+}
+
+func findSlot(p *pkcs11.Ctx) (uint, error) {
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return 0, fmt.Errorf("get slots: %w", err)
+	}
+	for _, slot := range slots {
+		info, err := p.GetTokenInfo(slot)
+		if err == nil && info.Label == Label {
+			return slot, nil
+		}
+	}
+	return 0, fmt.Errorf("token %q not found", Label)
+}
+
+// objects returns the templates of the private and public key and of the
+// certificate, all with KeyID.
+func objects(key *ecdsa.PrivateKey, cert *x509.Certificate) [][]*pkcs11.Attribute {
+	// secp384r1
+	params, _ := asn1.Marshal(asn1.ObjectIdentifier{1, 3, 132, 0, 34})
+	//nolint:staticcheck // the uncompressed point is the PKCS#11 encoding
+	point, _ := asn1.Marshal(elliptic.Marshal(key.Curve, key.X, key.Y))
+	common := func(class uint) []*pkcs11.Attribute {
+		return []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(KeyID)),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, Label),
+		}
+	}
+	return [][]*pkcs11.Attribute{
+		append(common(pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, key.D.FillBytes(make([]byte, 48))),
+		),
+		append(common(pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_EC),
+			pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, params),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, point),
+		),
+		append(common(pkcs11.CKO_CERTIFICATE),
+			pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+			pkcs11.NewAttribute(pkcs11.CKA_SUBJECT, cert.RawSubject),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, cert.Raw),
+		),
+	}
+}
@@ -0,0 +1,375 @@
+package cards
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The algorithm OIDs of signatures/signHash.
+const (
+	oidSHA256      = "2.16.840.1.101.3.4.2.1"
+	oidSHA384      = "2.16.840.1.101.3.4.2.2"
+	oidECDSASHA256 = "1.2.840.10045.4.3.2"
+	oidECDSASHA384 = "1.2.840.10045.4.3.3"
+)
+
+// CSC is a backend signing with a remote qualified signature creation device
+// over the Cloud Signature Consortium API v2. Every credential of the user is
+// a token, its slot is the index in credentials/list and its label the
+// credential ID. The PIN is sent with credentials/authorize, credentials
+// authorised out of band, on a phone for example, have a protected
+// authentication path. Credentials authorised with an OAuth 2 authorization
+// code flow of their own are not supported.
+type CSC struct {
+	// URL is the base URI of the service, ending in /csc/v2.
+	URL string
+	// Token is the OAuth 2 access token of the service scope.
+	Token  string
+	Client *http.Client
+
+	mu  sync.Mutex
+	pin string
+}
+
+// NewCSC returns a backend for the service at url.
+func NewCSC(url, token string) *CSC {
+	return &CSC{URL: strings.TrimSuffix(url, "/"), Token: token, Client: http.DefaultClient}
+}
+
+// CSCError is an error response of the service.
+type CSCError struct {
+	Status      int
+	Code        string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func (e *CSCError) Error() string {
+	if e.Description == "" {
+		return fmt.Sprintf("csc: %s (%d)", e.Code, e.Status)
+	}
+	return fmt.Sprintf("csc: %s: %s (%d)", e.Code, e.Description, e.Status)
+}
+
+// call POSTs the request to the method and decodes the response.
+func (c *CSC) call(ctx context.Context, method string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.URL+"/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if c.Token != "" {
+		r.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	res, err := c.Client.Do(r)
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	if res.StatusCode != http.StatusOK {
+		cerr := &CSCError{Status: res.StatusCode}
+		if json.Unmarshal(data, cerr) != nil || cerr.Code == "" {
+			cerr.Code = http.StatusText(res.StatusCode)
+		}
+		return fmt.Errorf("%s: %w", method, cerr)
+	}
+	if err := json.Unmarshal(data, resp); err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	return nil
+}
+
+type cscCredential struct {
+	Key struct {
+		Status string   `json:"status"`
+		Algo   []string `json:"algo"`
+		Len    int      `json:"len"`
+	} `json:"key"`
+	Cert struct {
+		Status       string   `json:"status"`
+		Certificates []string `json:"certificates"`
+	} `json:"cert"`
+	AuthMode string `json:"authMode"`
+	PIN      *struct {
+		Presence string `json:"presence"`
+	} `json:"PIN"`
+}
+
+// explicitPIN tells whether the credential is authorised with a PIN.
+func (cred *cscCredential) explicitPIN() bool {
+	return cred.AuthMode == "explicit" && cred.PIN != nil && cred.PIN.Presence != "false"
+}
+
+// supported fails for the credentials authorised with the oauth2code mode,
+// whose credential scoped token the bridge cannot obtain.
+func (cred *cscCredential) supported() error {
+	if cred.AuthMode == "oauth2code" {
+		return errors.New("authMode oauth2code is not supported")
+	}
+	return nil
+}
+
+func (c *CSC) credentialIDs(ctx context.Context) ([]string, error) {
+	var resp struct {
+		CredentialIDs []string `json:"credentialIDs"`
+	}
+	if err := c.call(ctx, "credentials/list", struct{}{}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.CredentialIDs, nil
+}
+
+func (c *CSC) credential(ctx context.Context, id string) (*cscCredential, *x509.Certificate, error) {
+	req := struct {
+		CredentialID string `json:"credentialID"`
+		Certificates string `json:"certificates"`
+		CertInfo     bool   `json:"certInfo"`
+		AuthInfo     bool   `json:"authInfo"`
+	}{id, "single", false, true}
+	var cred cscCredential
+	if err := c.call(ctx, "credentials/info", req, &cred); err != nil {
+		return nil, nil, err
+	}
+	if len(cred.Cert.Certificates) == 0 {
+		return nil, nil, fmt.Errorf("credential %q has no certificate", id)
+	}
+	der, err := base64.StdEncoding.DecodeString(cred.Cert.Certificates[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("credential %q: %w", id, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, fmt.Errorf("credential %q: %w", id, err)
+	}
+	return &cred, cert, nil
+}
+
+// EnumerateTokens returns the enabled and supported credentials with a valid
+// certificate. Credentials whose information cannot be read are logged and
+// skipped.
+func (c *CSC) EnumerateTokens() ([]*Token, error) {
+	ctx := context.Background()
+	ids, err := c.credentialIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*Token
+	for i, id := range ids {
+		cred, cert, err := c.credential(ctx, id)
+		if err == nil {
+			err = cred.supported()
+		}
+		if err != nil {
+			log.Printf("csc: skipping credential %q: %v", id, err)
+			continue
+		}
+		if cred.Key.Status == "disabled" || (cred.Cert.Status != "" && cred.Cert.Status != "valid") {
+			continue
+		}
+		ret = append(ret, &Token{
+			Slot:              uint(i),
+			Label:             id,
+			Serial:            hex.EncodeToString(cert.SerialNumber.Bytes()),
+			Manufacturer:      "CSC",
+			ProtectedAuthPath: !cred.explicitPIN(),
+		})
+	}
+	return ret, nil
+}
+
+// Watch reports the credentials once, they are not inserted or removed.
+func (c *CSC) Watch(ctx context.Context) (<-chan Event, error) {
+	tokens, err := c.EnumerateTokens()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		for _, e := range diff(make(map[uint]*Token), tokens) {
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+		<-ctx.Done()
+	}()
+	return ch, nil
+}
+
+// PINStatus is unknown, the service does not report the retry counter.
+func (c *CSC) PINStatus(token *Token) (PINStatus, error) {
+	return PINStatus{}, nil
+}
+
+func (c *CSC) Select(sel *Selector, in []*Token) ([]*Token, error) {
+	if sel == nil {
+		return in, nil
+	}
+	var ret []*Token
+	for _, t := range in {
+		if !sel.matchInfo(t) {
+			continue
+		}
+		if sel.Fingerprint != nil {
+			_, cert, err := c.credential(context.Background(), t.Label)
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(Fingerprint(cert), sel.Fingerprint) {
+				continue
+			}
+		}
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
+
+func (c *CSC) FilterTokens(hint string, in []*Token) []*Token {
+	var ret []*Token
+	for _, t := range in {
+		if strings.Contains(t.Label, hint) {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+func (c *CSC) SetPIN(pin string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pin = pin
+}
+
+// GetSigner returns a signer of the credential. The PIN is checked by the
+// service when signing, so a wrong PIN fails Sign with a PINError.
+func (c *CSC) GetSigner(token *Token) (*x509.Certificate, *ecdsa.PublicKey, crypto.Signer, error) {
+	cred, cert, err := c.credential(context.Background(), token.Label)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := cred.supported(); err != nil {
+		return nil, nil, nil, fmt.Errorf("credential %q: %w", token.Label, err)
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("certificate key %T is not ECDSA", cert.PublicKey)
+	}
+	c.mu.Lock()
+	pin := c.pin
+	c.mu.Unlock()
+	if !cred.explicitPIN() {
+		pin = ""
+	}
+	return cert, pub, &cscSigner{csc: c, id: token.Label, pin: pin, pub: pub}, nil
+}
+
+// Certificates reads the certificate of the credential.
+func (c *CSC) Certificates(token *Token) ([]*x509.Certificate, error) {
+	_, cert, err := c.credential(context.Background(), token.Label)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{cert}, nil
+}
+
+func (c *CSC) Signer(token *Token, cert *x509.Certificate) (crypto.Signer, error) {
+	got, _, signer, err := c.GetSigner(token)
+	if err != nil {
+		return nil, err
+	}
+	if !got.Equal(cert) {
+		return nil, fmt.Errorf("no key for cert %q on credential %q", cert.Subject.CommonName, token.Label)
+	}
+	return signer, nil
+}
+
+func (c *CSC) CloseToken(*Token) error {
+	return nil
+}
+
+func (c *CSC) Close() error {
+	return nil
+}
+
+type cscSigner struct {
+	csc *CSC
+	id  string
+	pin string
+	pub *ecdsa.PublicKey
+}
+
+func (s *cscSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign authorises the credential for the digest and signs it with
+// signatures/signHash, the digest has to be SHA-256 or SHA-384.
+func (s *cscSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	var hashAlgo, signAlgo string
+	switch len(digest) {
+	case 32:
+		hashAlgo, signAlgo = oidSHA256, oidECDSASHA256
+	case 48:
+		hashAlgo, signAlgo = oidSHA384, oidECDSASHA384
+	default:
+		return nil, fmt.Errorf("digest of %d bytes is neither SHA-256 nor SHA-384", len(digest))
+	}
+	ctx := context.Background()
+	hash := base64.StdEncoding.EncodeToString(digest)
+	auth := struct {
+		CredentialID  string   `json:"credentialID"`
+		NumSignatures int      `json:"numSignatures"`
+		Hashes        []string `json:"hashes"`
+		HashAlgorithm string   `json:"hashAlgorithmOID"`
+		PIN           string   `json:"PIN,omitempty"`
+	}{s.id, 1, []string{hash}, hashAlgo, s.pin}
+	var sad struct {
+		SAD string `json:"SAD"`
+	}
+	if err := s.csc.call(ctx, "credentials/authorize", auth, &sad); err != nil {
+		var cerr *CSCError
+		if errors.As(err, &cerr) && cerr.Code == "invalid_pin" {
+			return nil, &PINError{Err: ErrWrongPIN, cause: err}
+		}
+		return nil, err
+	}
+	req := struct {
+		CredentialID string   `json:"credentialID"`
+		SAD          string   `json:"SAD"`
+		Hashes       []string `json:"hashes"`
+		HashAlgo     string   `json:"hashAlgo"`
+		SignAlgo     string   `json:"signAlgo"`
+	}{s.id, sad.SAD, []string{hash}, hashAlgo, signAlgo}
+	var resp struct {
+		Signatures []string `json:"signatures"`
+	}
+	if err := s.csc.call(ctx, "signatures/signHash", req, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Signatures) != 1 {
+		return nil, fmt.Errorf("signatures/signHash: %d signatures", len(resp.Signatures))
+	}
+	return base64.StdEncoding.DecodeString(resp.Signatures[0])
+}
@@ -0,0 +1,95 @@
+package cards_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"errors"
+	"testing"
+
+	"github.com/ritave/eIDAS-bridge/snark/cards"
+	"github.com/ritave/eIDAS-bridge/snark/cards/cardstest"
+)
+
+func TestCSC(t *testing.T) {
+	qes := cardstest.NewCredential(t, "qes-1", "1234")
+	remote := cardstest.NewCredential(t, "smart-id", "")
+	oauth := cardstest.NewCredential(t, "oauth", "")
+	oauth.AuthMode = "oauth2code"
+	broken := &cardstest.CSCCredential{ID: "broken"}
+	srv := cardstest.NewCSC(t, qes, broken, remote, oauth)
+	c := cards.NewCSC(srv.URL, srv.Token)
+
+	// the broken and the oauth2code credentials are skipped
+	tokens, err := c.EnumerateTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0].Label != "qes-1" || tokens[0].ProtectedAuthPath || tokens[1].Slot != 2 || !tokens[1].ProtectedAuthPath {
+		t.Fatalf("unexpected tokens %+v", tokens)
+	}
+	if _, _, _, err := c.GetSigner(&cards.Token{Slot: 3, Label: "oauth"}); err == nil {
+		t.Fatal("signer of an oauth2code credential")
+	}
+	selected, err := c.Select(&cards.Selector{Fingerprint: cards.Fingerprint(remote.Cert)}, tokens)
+	if err != nil || len(selected) != 1 || selected[0].Label != "smart-id" {
+		t.Fatalf("select by fingerprint: %v %v", selected, err)
+	}
+
+	c.SetPIN("0000")
+	_, _, signer, err := c.GetSigner(tokens[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("challenge"))
+	_, err = signer.Sign(nil, digest[:], nil)
+	if !errors.Is(err, cards.ErrWrongPIN) {
+		t.Fatalf("expected wrong PIN, got %v", err)
+	}
+
+	c.SetPIN("1234")
+	for _, tt := range []struct {
+		token  *cards.Token
+		digest []byte
+	}{
+		{tokens[0], digest[:]},
+		{tokens[1], sha512.New384().Sum(nil)},
+	} {
+		cert, pub, signer, err := c.GetSigner(tt.token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cert.Subject.String() == "" || !pub.Equal(cert.PublicKey) {
+			t.Fatal("signer does not match the certificate")
+		}
+		sig, err := signer.Sign(nil, tt.digest, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ecdsa.VerifyASN1(pub, tt.digest, sig) {
+			t.Fatal("signature does not verify")
+		}
+	}
+	if n := srv.Signed(); n != 2 {
+		t.Fatalf("expected 2 signatures, got %d", n)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := c.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if e := <-events; e.Type != cards.TokenInserted {
+			t.Fatalf("unexpected event %+v", e)
+		}
+	}
+
+	bad := cards.NewCSC(srv.URL, "wrong")
+	var cerr *cards.CSCError
+	if _, err := bad.EnumerateTokens(); !errors.As(err, &cerr) || cerr.Status != 401 || cerr.Code != "invalid_token" {
+		t.Fatalf("expected invalid token, got %v", err)
+	}
+}
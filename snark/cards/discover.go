@@ -0,0 +1,223 @@
+package cards
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Modules are the well-known locations of PKCS#11 modules for eID cards,
+// tried in order by Discover after the modules registered with p11-kit.
+var Modules = map[string][]string{
+	"darwin": {
+		"/opt/homebrew/lib/opensc-pkcs11.so",
+		"/usr/local/lib/opensc-pkcs11.so",
+		"/Library/OpenSC/lib/opensc-pkcs11.so",
+		"/Library/Frameworks/eToken.framework/Versions/Current/libIDPrimePKCS11.dylib",
+		"/Library/mPollux/lib/libidprime.dylib",
+		"/usr/local/lib/libcvP11.dylib",
+		"/Library/Application Support/IDEMIA/lib/libidemia_pkcs11.dylib",
+	},
+	"linux": {
+		"/usr/lib/x86_64-linux-gnu/onepin-opensc-pkcs11.so",
+		"/usr/lib/aarch64-linux-gnu/onepin-opensc-pkcs11.so",
+		"/usr/lib/onepin-opensc-pkcs11.so",
+		"/usr/lib/x86_64-linux-gnu/opensc-pkcs11.so",
+		"/usr/lib/aarch64-linux-gnu/opensc-pkcs11.so",
+		"/usr/lib64/opensc-pkcs11.so",
+		"/usr/lib/opensc-pkcs11.so",
+		"/usr/local/lib/opensc-pkcs11.so",
+		"/usr/lib/pkcs11/opensc-pkcs11.so",
+		"/usr/lib/libcvP11.so",
+		"/usr/lib/libidprimepkcs11.so",
+		"/usr/lib/x64-athena/libASEP11.so",
+		"/opt/idemia/lib/libidemia_pkcs11.so",
+	},
+	"windows": {
+		`C:\Windows\System32\opensc-pkcs11.dll`,
+		`C:\Program Files\OpenSC Project\OpenSC\pkcs11\opensc-pkcs11.dll`,
+		`C:\Windows\System32\cvP11.dll`,
+		`C:\Windows\System32\eTPKCS11.dll`,
+		`C:\Windows\System32\idemia_pkcs11.dll`,
+	},
+}
+
+// P11KitConfigs are the directories of p11-kit module configs, system wide
+// and of the user.
+var P11KitConfigs = []string{
+	"/etc/pkcs11/modules",
+	"/usr/share/p11-kit/modules",
+	"~/.config/pkcs11/modules",
+}
+
+// p11KitModules are the directories in which p11-kit resolves relative module
+// paths.
+var p11KitModules = []string{
+	"/usr/lib/x86_64-linux-gnu/pkcs11",
+	"/usr/lib/aarch64-linux-gnu/pkcs11",
+	"/usr/lib64/pkcs11",
+	"/usr/lib/pkcs11",
+}
+
+// ErrNoModule is returned by Discover when no PKCS#11 module is installed.
+var ErrNoModule = errors.New("no PKCS#11 module found")
+
+// Candidates returns the modules Discover tries: those in $EIDAS_PKCS11_MODULES,
+// a list separated like $PATH, those enabled in the p11-kit configs and the
+// well-known ones of the platform.
+func Candidates() []string {
+	var ret []string
+	if list := os.Getenv("EIDAS_PKCS11_MODULES"); list != "" {
+		ret = append(ret, filepath.SplitList(list)...)
+	}
+	for _, dir := range P11KitConfigs {
+		ret = append(ret, p11KitDir(expandHome(dir))...)
+	}
+	return append(ret, Modules[runtime.GOOS]...)
+}
+
+// Discover returns the first of the paths that exists, or of Candidates when
+// paths is empty.
+func Discover(paths ...string) (string, error) {
+	if len(paths) == 0 {
+		paths = Candidates()
+	}
+	for _, path := range paths {
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path, nil
+		}
+	}
+	return "", ErrNoModule
+}
+
+// p11KitDir returns the modules of the *.module configs in dir, by file name.
+func p11KitDir(dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.module"))
+	if err != nil {
+		return nil
+	}
+	sort.Strings(files)
+	var ret []string
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		module, err := parseP11Kit(f)
+		f.Close()
+		if err != nil || module == "" {
+			continue
+		}
+		if filepath.IsAbs(module) {
+			ret = append(ret, module)
+			continue
+		}
+		for _, dir := range p11KitModules {
+			ret = append(ret, filepath.Join(dir, module))
+		}
+	}
+	return ret
+}
+
+// parseP11Kit returns the module of a p11-kit module config, "" when the
+// module is disabled for this program or is a trust policy module, such as
+// p11-kit-trust with the CA certificates, which holds no signing keys.
+func parseP11Kit(r io.Reader) (string, error) {
+	var module string
+	enabled := true
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return "", fmt.Errorf("invalid line %q", line)
+		}
+		value = strings.TrimSpace(value)
+		switch strings.TrimSpace(key) {
+		case "module":
+			module = value
+		case "disable-in":
+			if programIn(value) {
+				enabled = false
+			}
+		case "enable-in":
+			if !programIn(value) {
+				enabled = false
+			}
+		case "trust-policy":
+			if value == "yes" {
+				enabled = false
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return "", err
+	}
+	if !enabled {
+		return "", nil
+	}
+	return module, nil
+}
+
+// programIn tells whether this program is in the list of program names of
+// p11-kit's enable-in and disable-in.
+func programIn(list string) bool {
+	name := filepath.Base(os.Args[0])
+	for _, p := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// ModuleInfo describes a loaded PKCS#11 module.
+type ModuleInfo struct {
+	Path         string
+	Manufacturer string
+	Description  string
+	Version      string
+}
+
+func (m ModuleInfo) String() string {
+	return fmt.Sprintf("%s %s %s (%s)", m.Manufacturer, m.Description, m.Version, m.Path)
+}
+
+// Module loads the module and reports what it is.
+func (ctx *Config) Module() (ModuleInfo, error) {
+	p, err := ctx.acquire()
+	if err != nil {
+		return ModuleInfo{}, err
+	}
+	defer ctx.release()
+	info, err := p.GetInfo()
+	if err != nil {
+		return ModuleInfo{}, fmt.Errorf("get info: %w", err)
+	}
+	return ModuleInfo{
+		Path:         ctx.Path,
+		Manufacturer: strings.TrimSpace(info.ManufacturerID),
+		Description:  strings.TrimSpace(info.LibraryDescription),
+		Version:      fmt.Sprintf("%d.%d", info.LibraryVersion.Major, info.LibraryVersion.Minor),
+	}, nil
+}
@@ -0,0 +1,70 @@
+package cards
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseP11Kit(t *testing.T) {
+	for _, tt := range []struct {
+		config string
+		module string
+	}{
+		{"module: opensc-pkcs11.so\n", "opensc-pkcs11.so"},
+		{"# OpenSC\nmodule: /usr/lib/opensc-pkcs11.so\ncritical: no\n", "/usr/lib/opensc-pkcs11.so"},
+		{"module: opensc-pkcs11.so\ndisable-in: " + filepath.Base(os.Args[0]) + "\n", ""},
+		{"module: opensc-pkcs11.so\nenable-in: firefox, chromium\n", ""},
+		{"module: opensc-pkcs11.so\nenable-in: firefox, " + filepath.Base(os.Args[0]) + "\n", "opensc-pkcs11.so"},
+		{"module: p11-kit-trust.so\npriority: 1\ntrust-policy: yes\n", ""},
+		{"module: opensc-pkcs11.so\ntrust-policy: no\n", "opensc-pkcs11.so"},
+	} {
+		module, err := parseP11Kit(strings.NewReader(tt.config))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if module != tt.module {
+			t.Errorf("%q: expected %q, got %q", tt.config, tt.module, module)
+		}
+	}
+	if _, err := parseP11Kit(strings.NewReader("module")); err == nil {
+		t.Error("expected error for a line without a colon")
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	dir := t.TempDir()
+	module := filepath.Join(dir, "onepin-opensc-pkcs11.so")
+	if err := os.WriteFile(module, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "onepin.module"), []byte("module: "+module+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	configs := P11KitConfigs
+	defer func() { P11KitConfigs = configs }()
+	P11KitConfigs = []string{dir}
+	t.Setenv("EIDAS_PKCS11_MODULES", "")
+
+	if c := Candidates(); len(c) == 0 || c[0] != module {
+		t.Fatalf("expected the p11-kit module first, got %v", c)
+	}
+	path, err := Discover()
+	if err != nil || path != module {
+		t.Fatalf("expected %s, got %s %v", module, path, err)
+	}
+	if _, err := Discover(filepath.Join(dir, "missing.so"), dir); !errors.Is(err, ErrNoModule) {
+		t.Fatalf("expected no module, got %v", err)
+	}
+
+	other := filepath.Join(dir, "other.so")
+	if err := os.WriteFile(other, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("EIDAS_PKCS11_MODULES", filepath.Join(dir, "missing.so")+string(filepath.ListSeparator)+other)
+	if path, err := Discover(); err != nil || path != other {
+		t.Fatalf("expected %s, got %s %v", other, path, err)
+	}
+}
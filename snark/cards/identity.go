@@ -0,0 +1,85 @@
+package cards
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"fmt"
+)
+
+// IdentitySource is a source of certificates and the signers of their keys,
+// whatever holds the keys.
+type IdentitySource interface {
+	// Certificates returns the certificates a signer is available for.
+	Certificates(ctx context.Context) ([]*x509.Certificate, error)
+	// Signer returns the signer of the key of cert, it may log in with the
+	// PIN.
+	Signer(ctx context.Context, cert *x509.Certificate) (crypto.Signer, error)
+	// Close releases the signer.
+	Close() error
+}
+
+// TokenSigner is the part of a Backend giving the identities of a token.
+type TokenSigner interface {
+	// Certificates returns the certificates of the keys the backend signs
+	// with, which does not need the PIN.
+	Certificates(token *Token) ([]*x509.Certificate, error)
+	Signer(token *Token, cert *x509.Certificate) (crypto.Signer, error)
+	// CloseToken releases the signers of the token, Close those of every
+	// token.
+	CloseToken(token *Token) error
+	Close() error
+}
+
+// Identities returns the identities on the token of a backend, logging in
+// with the PIN set on the backend.
+func Identities(b TokenSigner, token *Token) IdentitySource {
+	return &tokenIdentities{b: b, token: token}
+}
+
+type tokenIdentities struct {
+	b     TokenSigner
+	token *Token
+}
+
+func (t *tokenIdentities) Certificates(ctx context.Context) ([]*x509.Certificate, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return t.b.Certificates(t.token)
+}
+
+func (t *tokenIdentities) Signer(ctx context.Context, cert *x509.Certificate) (crypto.Signer, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return t.b.Signer(t.token, cert)
+}
+
+// Close releases only the token, the backend may sign with others.
+func (t *tokenIdentities) Close() error {
+	return t.b.CloseToken(t.token)
+}
+
+// KeyPair is the identity of a certificate and its key held in memory.
+type KeyPair struct {
+	Certificate *x509.Certificate
+	Key         crypto.Signer
+}
+
+var _ IdentitySource = (*KeyPair)(nil)
+
+func (k *KeyPair) Certificates(context.Context) ([]*x509.Certificate, error) {
+	return []*x509.Certificate{k.Certificate}, nil
+}
+
+func (k *KeyPair) Signer(_ context.Context, cert *x509.Certificate) (crypto.Signer, error) {
+	if !cert.Equal(k.Certificate) {
+		return nil, fmt.Errorf("no key for cert %q", cert.Subject.CommonName)
+	}
+	return k.Key, nil
+}
+
+func (k *KeyPair) Close() error {
+	return nil
+}
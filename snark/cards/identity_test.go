@@ -0,0 +1,99 @@
+package cards
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestIdentities(t *testing.T) {
+	s, err := NewSoftToken(DefaultSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewSoftToken(DefaultSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := s.EnumerateTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetPIN(SoftTokenPIN)
+	_, _, key, err := s.GetSigner(tokens[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("challenge"))
+
+	for name, src := range map[string]IdentitySource{
+		"token":   Identities(s, tokens[0]),
+		"keypair": &KeyPair{Certificate: s.Certificate(), Key: key},
+	} {
+		ctx := context.Background()
+		certs, err := src.Certificates(ctx)
+		if err != nil || len(certs) != 1 || !certs[0].Equal(s.Certificate()) {
+			t.Fatalf("%s: unexpected certificates %v %v", name, certs, err)
+		}
+		if _, err := src.Signer(ctx, other.Certificate()); err == nil {
+			t.Fatalf("%s: expected no key for another certificate", name)
+		}
+		signer, err := src.Signer(ctx, certs[0])
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		sig, err := signer.Sign(nil, digest[:], nil)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		if !ecdsa.VerifyASN1(certs[0].PublicKey.(*ecdsa.PublicKey), digest[:], sig) {
+			t.Fatalf("%s: signature does not verify", name)
+		}
+		if err := src.Close(); err != nil {
+			t.Fatal(name, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := Identities(s, tokens[0]).Certificates(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled, got %v", err)
+	}
+}
+
+// closeRecorder records which of the close methods are called.
+type closeRecorder struct {
+	*SoftToken
+	closed []*Token
+	all    bool
+}
+
+func (c *closeRecorder) CloseToken(token *Token) error {
+	c.closed = append(c.closed, token)
+	return nil
+}
+
+func (c *closeRecorder) Close() error {
+	c.all = true
+	return nil
+}
+
+func TestIdentitiesCloseToken(t *testing.T) {
+	s, err := NewSoftToken(DefaultSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := s.EnumerateTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &closeRecorder{SoftToken: s}
+	if err := Identities(rec, tokens[0]).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rec.all || len(rec.closed) != 1 || rec.closed[0] != tokens[0] {
+		t.Fatalf("expected only the token closed, got %v, all %v", rec.closed, rec.all)
+	}
+}
@@ -0,0 +1,250 @@
+package cards
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Key is a certificate on a token, its private key has the same ID and is
+// found after the login.
+type Key struct {
+	ID          []byte
+	Label       string
+	Certificate *x509.Certificate
+	// Paired is set when the token lists a private or public key with the
+	// ID before the login.
+	Paired bool
+}
+
+// KeyUsage returns the key usage of the certificate.
+func (k *Key) KeyUsage() x509.KeyUsage {
+	return k.Certificate.KeyUsage
+}
+
+// KeyPolicy picks a key of a token. The zero KeyPolicy matches every key,
+// set fields must all match.
+type KeyPolicy struct {
+	ID    []byte
+	Label string
+	// Usage must all be set in the key usage of the certificate, and NotUsage
+	// none of them.
+	Usage    x509.KeyUsage
+	NotUsage x509.KeyUsage
+}
+
+// AuthenticationKey is the policy used when a token holds several keys: eID
+// cards separate the authentication key from the one for qualified
+// signatures, which asserts non-repudiation.
+var AuthenticationKey = &KeyPolicy{
+	Usage:    x509.KeyUsageDigitalSignature,
+	NotUsage: x509.KeyUsageContentCommitment,
+}
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalSignature": x509.KeyUsageDigitalSignature,
+	"nonRepudiation":   x509.KeyUsageContentCommitment,
+	"keyEncipherment":  x509.KeyUsageKeyEncipherment,
+	"dataEncipherment": x509.KeyUsageDataEncipherment,
+	"keyAgreement":     x509.KeyUsageKeyAgreement,
+	"keyCertSign":      x509.KeyUsageCertSign,
+	"cRLSign":          x509.KeyUsageCRLSign,
+}
+
+// ParseKeyPolicy parses comma separated key=value pairs, for example
+// "keyUsage=digitalSignature,notKeyUsage=nonRepudiation" or "id=01". The keys
+// are id (hex), label, keyUsage and notKeyUsage, the usages are named as in
+// RFC 5280 and may repeat.
+func ParseKeyPolicy(s string) (*KeyPolicy, error) {
+	p := &KeyPolicy{}
+	if strings.TrimSpace(s) == "" {
+		return p, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("key policy %q: expected key=value", kv)
+		}
+		switch strings.TrimSpace(k) {
+		case "id":
+			id, err := hex.DecodeString(v)
+			if err != nil {
+				return nil, fmt.Errorf("id: %w", err)
+			}
+			p.ID = id
+		case "label":
+			p.Label = v
+		case "keyUsage", "notKeyUsage":
+			u, ok := keyUsages[v]
+			if !ok {
+				return nil, fmt.Errorf("key policy: unknown key usage %q", v)
+			}
+			if strings.TrimSpace(k) == "keyUsage" {
+				p.Usage |= u
+			} else {
+				p.NotUsage |= u
+			}
+		default:
+			return nil, fmt.Errorf("key policy: unknown key %q", k)
+		}
+	}
+	return p, nil
+}
+
+func (p *KeyPolicy) match(k *Key) bool {
+	return (p.ID == nil || bytes.Equal(p.ID, k.ID)) &&
+		(p.Label == "" || p.Label == k.Label) &&
+		k.KeyUsage()&p.Usage == p.Usage &&
+		k.KeyUsage()&p.NotUsage == 0
+}
+
+// Select returns the keys matching the policy.
+func (p *KeyPolicy) Select(keys []*Key) []*Key {
+	var ret []*Key
+	for _, k := range keys {
+		if p.match(k) {
+			ret = append(ret, k)
+		}
+	}
+	return ret
+}
+
+// policyKeys returns the keys allowed by the policy of ctx. Without one, a
+// single key is used as is, and AuthenticationKey chooses among several.
+func (ctx *Config) policyKeys(keys []*Key) []*Key {
+	policy := ctx.Key
+	if policy == nil {
+		if len(keys) == 1 {
+			return keys
+		}
+		policy = AuthenticationKey
+	}
+	return policy.Select(keys)
+}
+
+// chooseKey picks the single key allowed by the policy of ctx.
+func (ctx *Config) chooseKey(keys []*Key) (*Key, error) {
+	matching := ctx.policyKeys(keys)
+	switch len(matching) {
+	case 0:
+		return nil, fmt.Errorf("none of %d keys matches the key policy", len(keys))
+	case 1:
+		return matching[0], nil
+	default:
+		return nil, fmt.Errorf("%d of %d keys match the key policy, select one by id or label", len(matching), len(keys))
+	}
+}
+
+// Keys reads the certificates on the token which have a key with the same ID,
+// with their key IDs and labels. Most middleware hides the private keys until
+// C_Login, so the public key objects count as well. A token which lists no
+// keys at all before the login keeps every certificate, the private key is
+// then looked up after the login. Certificates which do not parse are
+// skipped, see CertificateObjects.
+func (ctx *Config) Keys(token *Token) ([]*Key, error) {
+	certs, _, err := ctx.CertificateObjects(token)
+	if err != nil {
+		return nil, err
+	}
+	return paired(certs), nil
+}
+
+// paired returns the certificates with a key, or all of them when none has
+// one.
+func paired(certs []*Key) []*Key {
+	var ret []*Key
+	for _, k := range certs {
+		if k.Paired {
+			ret = append(ret, k)
+		}
+	}
+	if ret == nil {
+		return certs
+	}
+	return ret
+}
+
+// CertificateObjects reads every X.509 certificate on the token, also those
+// without a key. Certificates which do not parse are returned as skipped
+// errors instead.
+func (ctx *Config) CertificateObjects(token *Token) (keys []*Key, skipped []error, err error) {
+	p, err := ctx.acquire()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer ctx.release()
+	session, err := p.OpenSession(token.Slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		return nil, nil, fmt.Errorf("open session: %w", err)
+	}
+	defer p.CloseSession(session)
+	handles, err := findObjects(p, session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_CERTIFICATE),
+		pkcs11.NewAttribute(pkcs11.CKA_CERTIFICATE_TYPE, pkcs11.CKC_X_509),
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("find certs: %w", err)
+	}
+	ids := make(map[string]bool)
+	for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+		keyHandles, err := findObjects(p, session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("find keys: %w", err)
+		}
+		for _, h := range keyHandles {
+			attrs, err := p.GetAttributeValue(session, h, []*pkcs11.Attribute{pkcs11.NewAttribute(pkcs11.CKA_ID, nil)})
+			if err != nil {
+				return nil, nil, fmt.Errorf("read key: %w", err)
+			}
+			ids[string(attrs[0].Value)] = true
+		}
+	}
+	for _, h := range handles {
+		attrs, err := p.GetAttributeValue(session, h, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("read cert: %w", err)
+		}
+		cert, err := x509.ParseCertificate(attrs[2].Value)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("certificate %x %q: %w", attrs[0].Value, attrs[1].Value, err))
+			continue
+		}
+		keys = append(keys, &Key{
+			ID:          attrs[0].Value,
+			Label:       string(attrs[1].Value),
+			Certificate: cert,
+			Paired:      ids[string(attrs[0].Value)],
+		})
+	}
+	return keys, skipped, nil
+}
+
+// findObjects returns the handles of all objects matching the template.
+func findObjects(p *pkcs11.Ctx, session pkcs11.SessionHandle, template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	if err := p.FindObjectsInit(session, template); err != nil {
+		return nil, err
+	}
+	var ret []pkcs11.ObjectHandle
+	for {
+		found, _, err := p.FindObjects(session, 16)
+		if err != nil {
+			p.FindObjectsFinal(session)
+			return nil, err
+		}
+		if len(found) == 0 {
+			break
+		}
+		ret = append(ret, found...)
+	}
+	return ret, p.FindObjectsFinal(session)
+}
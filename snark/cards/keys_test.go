@@ -0,0 +1,92 @@
+package cards
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+)
+
+func newKey(t *testing.T, id byte, label string, usage x509.KeyUsage) *Key {
+	priv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(int64(id)),
+		Subject:      pkix.Name{CommonName: label},
+		KeyUsage:     usage,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Key{ID: []byte{id}, Label: label, Certificate: cert}
+}
+
+func TestChooseKey(t *testing.T) {
+	auth := newKey(t, 1, "Authentication", x509.KeyUsageDigitalSignature)
+	sign := newKey(t, 2, "Signature", x509.KeyUsageDigitalSignature|x509.KeyUsageContentCommitment)
+	enc := newKey(t, 3, "Encryption", x509.KeyUsageKeyAgreement)
+	keys := []*Key{sign, auth, enc}
+
+	ctx := New("", "")
+	if k, err := ctx.chooseKey(keys); err != nil || k != auth {
+		t.Fatalf("expected authentication key, got %v %v", k, err)
+	}
+	if k, err := ctx.chooseKey([]*Key{sign}); err != nil || k != sign {
+		t.Fatalf("expected the single key, got %v %v", k, err)
+	}
+	for _, tc := range []struct {
+		policy string
+		want   *Key
+	}{
+		{"id=02", sign},
+		{"label=Encryption", enc},
+		{"keyUsage=digitalSignature,keyUsage=nonRepudiation", sign},
+		{"keyUsage=digitalSignature,notKeyUsage=nonRepudiation", auth},
+	} {
+		var err error
+		ctx.Key, err = ParseKeyPolicy(tc.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if k, err := ctx.chooseKey(keys); err != nil || k != tc.want {
+			t.Fatalf("%q: expected %s, got %v %v", tc.policy, tc.want.Label, k, err)
+		}
+	}
+	ctx.Key, _ = ParseKeyPolicy("keyUsage=digitalSignature")
+	if _, err := ctx.chooseKey(keys); err == nil {
+		t.Fatal("expected ambiguous policy error")
+	}
+	ctx.Key, _ = ParseKeyPolicy("keyUsage=keyCertSign")
+	if _, err := ctx.chooseKey(keys); err == nil {
+		t.Fatal("expected no match error")
+	}
+	for _, s := range []string{"id=zz", "keyUsage=sign", "color=red"} {
+		if _, err := ParseKeyPolicy(s); err == nil {
+			t.Fatalf("%q: expected error", s)
+		}
+	}
+}
+
+func TestPaired(t *testing.T) {
+	auth := newKey(t, 1, "Authentication", x509.KeyUsageDigitalSignature)
+	ca := newKey(t, 2, "CA", x509.KeyUsageCertSign)
+	auth.Paired = true
+	if got := paired([]*Key{ca, auth}); len(got) != 1 || got[0] != auth {
+		t.Fatalf("expected the paired key, got %v", got)
+	}
+	// no keys listed before the login
+	auth.Paired = false
+	if got := paired([]*Key{ca, auth}); len(got) != 2 {
+		t.Fatalf("expected every certificate, got %v", got)
+	}
+}
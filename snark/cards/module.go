@@ -0,0 +1,96 @@
+package cards
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// The PKCS#11 library is initialised once per process, so enumeration, the
+// watchers and the signing sessions share a single handle, counted in refs.
+// It is finalised when the last of them releases it.
+
+// acquire returns the initialised library, release it when done.
+func (ctx *Config) acquire() (*pkcs11.Ctx, error) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	for ctx.unloading != nil {
+		// the library is initialised again once it is finalised
+		unloading := ctx.unloading
+		ctx.mu.Unlock()
+		<-unloading
+		ctx.mu.Lock()
+	}
+	if ctx.refs == 0 {
+		p := pkcs11.New(ctx.Path)
+		if p == nil {
+			return nil, fmt.Errorf("load %s", ctx.Path)
+		}
+		if err := p.Initialize(); err != nil {
+			p.Destroy()
+			return nil, fmt.Errorf("init: %w", err)
+		}
+		ctx.module = p
+	}
+	ctx.refs++
+	return ctx.module, nil
+}
+
+// release finalises the library when the last reference is released. The
+// wait for the watchers to leave it is done without holding ctx.mu, so the
+// PIN and the other references are not blocked meanwhile.
+func (ctx *Config) release() {
+	ctx.mu.Lock()
+	ctx.refs--
+	if ctx.refs != 0 {
+		ctx.mu.Unlock()
+		return
+	}
+	module, waits := ctx.module, ctx.waits
+	ctx.module, ctx.waits = nil, nil
+	unloading := make(chan struct{})
+	ctx.unloading = unloading
+	ctx.mu.Unlock()
+
+	module.Finalize()
+	// C_Finalize returns the pending C_WaitForSlotEvent calls, the library
+	// is only unloaded once they left it
+	unload := true
+	for _, w := range waits {
+		select {
+		case <-w:
+		case <-time.After(time.Second):
+			unload = false
+		}
+	}
+	if unload {
+		module.Destroy()
+	}
+	ctx.mu.Lock()
+	ctx.unloading = nil
+	ctx.mu.Unlock()
+	close(unloading)
+}
+
+// waitSlotEvent calls C_WaitForSlotEvent, blocking until a slot changes or
+// the library is finalised.
+func (ctx *Config) waitSlotEvent(p *pkcs11.Ctx) <-chan pkcs11.SlotEvent {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	w := p.WaitForSlotEvent(0)
+	ctx.waits = append(ctx.waits, w)
+	return w
+}
+
+// forgetWait drops a returned C_WaitForSlotEvent call.
+func (ctx *Config) forgetWait(w <-chan pkcs11.SlotEvent) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	for i := range ctx.waits {
+		if ctx.waits[i] == w {
+			ctx.waits = append(ctx.waits[:i], ctx.waits[i+1:]...)
+			return
+		}
+	}
+}
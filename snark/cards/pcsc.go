@@ -0,0 +1,77 @@
+//go:build pcsc
+
+package cards
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	pcsc "github.com/gballet/go-libpcsclite"
+)
+
+// pcscClient is the context with pcscd, shared by the readers and
+// established again after an error.
+var pcscClient struct {
+	sync.Mutex
+	*pcsc.Client
+}
+
+// PCSCReaders lists the readers of pcscd.
+func PCSCReaders() ([]Reader, error) {
+	pcscClient.Lock()
+	defer pcscClient.Unlock()
+	if pcscClient.Client == nil {
+		client, err := pcsc.EstablishContext(pcsc.PCSCDSockName, pcsc.ScopeSystem)
+		if err != nil {
+			return nil, fmt.Errorf("establish context: %w", err)
+		}
+		pcscClient.Client = client
+	}
+	names, err := pcscClient.ListReaders()
+	if err != nil {
+		pcscClient.ReleaseContext()
+		pcscClient.Client = nil
+		return nil, fmt.Errorf("list readers: %w", err)
+	}
+	ret := make([]Reader, len(names))
+	for i, name := range names {
+		ret[i] = &pcscReader{client: pcscClient.Client, name: name}
+	}
+	return ret, nil
+}
+
+type pcscReader struct {
+	client *pcsc.Client
+	name   string
+}
+
+func (r *pcscReader) Name() string {
+	return r.name
+}
+
+func (r *pcscReader) Connect() (Card, error) {
+	card, err := r.client.Connect(r.name, pcsc.ShareExclusive, pcsc.ProtocolAny)
+	if err != nil {
+		// the library reports the return code only in the message
+		if strings.Contains(err.Error(), fmt.Sprintf("%x", uint32(pcsc.ErrSCardNoSmartCard))) ||
+			strings.Contains(err.Error(), fmt.Sprintf("%x", uint32(pcsc.ErrSCardRemovedCard))) {
+			return nil, ErrNoCard
+		}
+		return nil, err
+	}
+	return &pcscCard{card}, nil
+}
+
+type pcscCard struct {
+	card *pcsc.Card
+}
+
+func (c *pcscCard) Transmit(apdu []byte) ([]byte, error) {
+	resp, _, err := c.card.Transmit(apdu)
+	return resp, err
+}
+
+func (c *pcscCard) Close() error {
+	return c.card.Disconnect(pcsc.LeaveCard)
+}
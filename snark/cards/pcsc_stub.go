@@ -0,0 +1,11 @@
+//go:build !pcsc
+
+package cards
+
+import "errors"
+
+// PCSCReaders lists the readers of pcscd, it requires building with the pcsc
+// tag.
+func PCSCReaders() ([]Reader, error) {
+	return nil, errors.New("built without PC/SC support, build with -tags pcsc")
+}
@@ -0,0 +1,125 @@
+package cards
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+var (
+	ErrWrongPIN  = errors.New("wrong PIN")
+	ErrPINLocked = errors.New("PIN locked")
+)
+
+// PINStatus is the retry state of the user PIN reported by the token flags.
+type PINStatus struct {
+	CountLow bool // an incorrect PIN was entered since the last successful login
+	FinalTry bool // the next incorrect PIN locks the card
+	Locked   bool
+}
+
+func pinStatus(flags uint) PINStatus {
+	return PINStatus{
+		CountLow: flags&pkcs11.CKF_USER_PIN_COUNT_LOW != 0,
+		FinalTry: flags&pkcs11.CKF_USER_PIN_FINAL_TRY != 0,
+		Locked:   flags&pkcs11.CKF_USER_PIN_LOCKED != 0,
+	}
+}
+
+// Remaining returns the number of PIN attempts left. Tokens do not report the
+// count, only the final try, so it is -1 when more than one attempt is left.
+func (s PINStatus) Remaining() int {
+	switch {
+	case s.Locked:
+		return 0
+	case s.FinalTry:
+		return 1
+	default:
+		return -1
+	}
+}
+
+// PINError is a rejected PIN. Err is ErrWrongPIN or ErrPINLocked, Status is
+// the state of the token after the attempt.
+type PINError struct {
+	Err    error
+	Status PINStatus
+	cause  error
+}
+
+func (e *PINError) Error() string {
+	msg := e.Err.Error()
+	if e.Err == ErrWrongPIN {
+		switch n := e.Status.Remaining(); n {
+		case 1:
+			msg += ", final attempt left"
+		case -1:
+		default:
+			msg += fmt.Sprintf(", %d attempts left", n)
+		}
+	}
+	if e.cause != nil {
+		msg += ": " + e.cause.Error()
+	}
+	return msg
+}
+
+func (e *PINError) Unwrap() []error {
+	if e.cause == nil {
+		return []error{e.Err}
+	}
+	return []error{e.Err, e.cause}
+}
+
+// PINStatus reads the retry state of the token's user PIN.
+func (ctx *Config) PINStatus(token *Token) (PINStatus, error) {
+	p, err := ctx.acquire()
+	if err != nil {
+		return PINStatus{}, err
+	}
+	defer ctx.release()
+	slots, err := p.GetSlotList(true)
+	if err != nil {
+		return PINStatus{}, fmt.Errorf("get slots: %w", err)
+	}
+	for _, slot := range slots {
+		tinfo, err := p.GetTokenInfo(slot)
+		if err != nil {
+			return PINStatus{}, fmt.Errorf("get token info: %w", err)
+		}
+		if tinfo.Label == token.Label && tinfo.SerialNumber == token.Serial {
+			return pinStatus(tinfo.Flags), nil
+		}
+	}
+	return PINStatus{}, fmt.Errorf("token %q not present", token.Label)
+}
+
+// loginError maps the PKCS#11 PIN errors of a failed login to a PINError with
+// the status of the token after the attempt.
+func (ctx *Config) loginError(token *Token, err error) error {
+	var perr pkcs11.Error
+	if !errors.As(err, &perr) {
+		return err
+	}
+	var sentinel error
+	switch perr {
+	case pkcs11.CKR_PIN_INCORRECT, pkcs11.CKR_PIN_INVALID, pkcs11.CKR_PIN_LEN_RANGE:
+		sentinel = ErrWrongPIN
+	case pkcs11.CKR_PIN_LOCKED:
+		sentinel = ErrPINLocked
+	default:
+		return err
+	}
+	status, serr := ctx.PINStatus(token)
+	if serr != nil {
+		// the error of the login is more useful than the one of the status
+		status = PINStatus{}
+	}
+	if sentinel == ErrPINLocked {
+		status.Locked = true
+	} else if status.Locked {
+		sentinel = ErrPINLocked
+	}
+	return &PINError{Err: sentinel, Status: status, cause: err}
+}
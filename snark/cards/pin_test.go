@@ -0,0 +1,65 @@
+package cards
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/miekg/pkcs11"
+)
+
+func TestPINStatus(t *testing.T) {
+	for _, tt := range []struct {
+		flags     uint
+		remaining int
+	}{
+		{0, -1},
+		{pkcs11.CKF_USER_PIN_COUNT_LOW, -1},
+		{pkcs11.CKF_USER_PIN_COUNT_LOW | pkcs11.CKF_USER_PIN_FINAL_TRY, 1},
+		{pkcs11.CKF_USER_PIN_LOCKED, 0},
+	} {
+		if n := pinStatus(tt.flags).Remaining(); n != tt.remaining {
+			t.Errorf("flags %#x: %d remaining, expected %d", tt.flags, n, tt.remaining)
+		}
+	}
+}
+
+func TestLoginError(t *testing.T) {
+	ctx := New("", "")
+	token := &Token{Label: "fake"}
+	wrapped := func(code uint) error {
+		return fmt.Errorf("failed to log into long term session: %w", pkcs11.Error(code))
+	}
+	var perr *PINError
+	err := ctx.loginError(token, wrapped(pkcs11.CKR_PIN_INCORRECT))
+	if !errors.Is(err, ErrWrongPIN) || !errors.As(err, &perr) {
+		t.Fatalf("expected wrong PIN, got %v", err)
+	}
+	if !errors.Is(err, pkcs11.Error(pkcs11.CKR_PIN_INCORRECT)) {
+		t.Fatal("cause lost")
+	}
+	err = ctx.loginError(token, wrapped(pkcs11.CKR_PIN_LOCKED))
+	if !errors.Is(err, ErrPINLocked) || !errors.As(err, &perr) || perr.Status.Remaining() != 0 {
+		t.Fatalf("expected locked PIN, got %v", err)
+	}
+	err = ctx.loginError(token, wrapped(pkcs11.CKR_TOKEN_NOT_PRESENT))
+	if errors.As(err, &perr) {
+		t.Fatalf("unexpected PIN error %v", err)
+	}
+
+	token.PIN.Locked = true
+	if _, _, _, err := ctx.GetSigner(token); !errors.Is(err, ErrPINLocked) {
+		t.Fatalf("locked PIN tried, got %v", err)
+	}
+}
+
+func TestNewToken(t *testing.T) {
+	token := newToken(3, pkcs11.TokenInfo{
+		Label:        "PIN1",
+		SerialNumber: "1234",
+		Flags:        pkcs11.CKF_PROTECTED_AUTHENTICATION_PATH | pkcs11.CKF_USER_PIN_FINAL_TRY,
+	})
+	if token.Slot != 3 || !token.ProtectedAuthPath || token.PIN.Remaining() != 1 {
+		t.Fatalf("unexpected token %+v", token)
+	}
+}
@@ -0,0 +1,490 @@
+package cards
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Key references of the PIV slots.
+const (
+	PIVAuthentication byte = 0x9a
+	PIVSignature      byte = 0x9c
+	PIVKeyManagement  byte = 0x9d
+	PIVCardAuth       byte = 0x9e
+)
+
+// errSignerOpen is returned by GetSigner while the card is held by a signer.
+var errSignerOpen = errors.New("signer open")
+
+var pivAID = []byte{0xa0, 0x00, 0x00, 0x03, 0x08}
+
+// pivCHUID is the Card Holder Unique Identifier data object.
+var pivCHUID = []byte{0x5f, 0xc1, 0x02}
+
+// pivObjects are the certificate data objects of the key references.
+var pivObjects = map[byte][]byte{
+	PIVAuthentication: {0x5f, 0xc1, 0x05},
+	PIVSignature:      {0x5f, 0xc1, 0x0a},
+	PIVKeyManagement:  {0x5f, 0xc1, 0x0b},
+	PIVCardAuth:       {0x5f, 0xc1, 0x01},
+}
+
+const (
+	insSelect      = 0xa4
+	insVerify      = 0x20
+	insGetData     = 0xcb
+	insGeneralAuth = 0x87
+
+	pivPINRef = 0x80
+	pivP256   = 0x11
+	pivP384   = 0x14
+)
+
+// PIV is a backend speaking to PIV applets over PC/SC, without a PKCS#11
+// module. Every reader with a PIV card is a token, its slot is the index of
+// the reader.
+type PIV struct {
+	readers func() ([]Reader, error)
+	// Key is the key reference GetSigner signs with, PIVAuthentication when
+	// zero.
+	Key byte
+	// Tries is the PIN retry count of a new card, which varies between
+	// cards. Fewer tries left are reported as PINStatus.CountLow, never when
+	// zero.
+	Tries int
+
+	mu   sync.Mutex
+	pin  string
+	card Card // connected between GetSigner and Close
+	slot uint // of card
+}
+
+// NewPIV returns a PIV backend on the readers, PCSCReaders for the readers
+// of the system.
+func NewPIV(readers func() ([]Reader, error)) *PIV {
+	return &PIV{readers: readers}
+}
+
+func (p *PIV) key() byte {
+	if p.Key == 0 {
+		return PIVAuthentication
+	}
+	return p.Key
+}
+
+// connect selects the PIV applet on the card of the token's reader.
+func (p *PIV) connect(token *Token) (Card, error) {
+	readers, err := p.readers()
+	if err != nil {
+		return nil, fmt.Errorf("list readers: %w", err)
+	}
+	if int(token.Slot) >= len(readers) || readers[token.Slot].Name() != token.Label {
+		return nil, fmt.Errorf("reader %q: %w", token.Label, pkcs11.Error(pkcs11.CKR_TOKEN_NOT_PRESENT))
+	}
+	return connectPIV(readers[token.Slot])
+}
+
+func connectPIV(r Reader) (Card, error) {
+	card, err := r.Connect()
+	if errors.Is(err, ErrNoCard) {
+		return nil, fmt.Errorf("reader %q: %w", r.Name(), pkcs11.Error(pkcs11.CKR_TOKEN_NOT_PRESENT))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("connect %q: %w", r.Name(), err)
+	}
+	if _, err := transmit(card, 0x00, insSelect, 0x04, 0x00, pivAID); err != nil {
+		card.Close()
+		return nil, fmt.Errorf("select PIV: %w", err)
+	}
+	return card, nil
+}
+
+// pivCertificate reads the certificate of the key reference.
+func pivCertificate(card Card, key byte) (*x509.Certificate, error) {
+	object, ok := pivObjects[key]
+	if !ok {
+		return nil, fmt.Errorf("no certificate object for key %02x", key)
+	}
+	resp, err := transmit(card, 0x00, insGetData, 0x3f, 0xff, tlv([]byte{0x5c}, object))
+	if err != nil {
+		return nil, fmt.Errorf("get data %x: %w", object, err)
+	}
+	data, err := findTLV(resp, 0x53)
+	if err != nil {
+		return nil, err
+	}
+	if info, err := findTLV(data, 0x71); err == nil && len(info) > 0 && info[0]&0x01 != 0 {
+		return nil, errors.New("compressed certificates are not supported")
+	}
+	der, err := findTLV(data, 0x70)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// pivSerial returns the GUID of the CHUID in hex, or its FASC-N when the GUID
+// is zero. Cards without a CHUID have no serial.
+func pivSerial(card Card) (string, error) {
+	resp, err := transmit(card, 0x00, insGetData, 0x3f, 0xff, tlv([]byte{0x5c}, pivCHUID))
+	var sw StatusError
+	if errors.As(err, &sw) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("get data %x: %w", pivCHUID, err)
+	}
+	data, err := findTLV(resp, 0x53)
+	if err != nil {
+		return "", err
+	}
+	if guid, err := findTLV(data, 0x34); err == nil && len(bytes.Trim(guid, "\x00")) > 0 {
+		return hex.EncodeToString(guid), nil
+	}
+	if fascn, err := findTLV(data, 0x30); err == nil {
+		return hex.EncodeToString(fascn), nil
+	}
+	return "", nil
+}
+
+// pivPINStatus asks for the retry counter with an empty VERIFY.
+func pivPINStatus(card Card, tries int) (PINStatus, error) {
+	_, err := exchange(card, 0x00, insVerify, 0x00, pivPINRef, nil, false)
+	return verifyStatus(err, tries)
+}
+
+// pivPresent tells whether the card still answers, any status word will do.
+func pivPresent(card Card) bool {
+	_, err := exchange(card, 0x00, insVerify, 0x00, pivPINRef, nil, false)
+	var sw StatusError
+	return err == nil || errors.As(err, &sw)
+}
+
+// verifyStatus maps the status word of VERIFY to the PIN status, the count
+// is low when fewer than tries are left.
+func verifyStatus(err error, tries int) (PINStatus, error) {
+	var sw StatusError
+	switch {
+	case err == nil:
+		return PINStatus{}, nil
+	case !errors.As(err, &sw):
+		return PINStatus{}, err
+	case sw == swAuthBlocked:
+		return PINStatus{CountLow: true, Locked: true}, nil
+	case sw&0xfff0 == swVerifyFail:
+		left := int(sw & 0x0f)
+		return PINStatus{CountLow: left < tries, FinalTry: left == 1, Locked: left == 0}, nil
+	default:
+		return PINStatus{}, err
+	}
+}
+
+// pivVerify presents the PIN, padded with FF to 8 bytes.
+func pivVerify(card Card, pin string, tries int) error {
+	if len(pin) > 8 {
+		return &PINError{Err: ErrWrongPIN, cause: errors.New("PIN longer than 8 characters")}
+	}
+	padded := append([]byte(pin), bytes.Repeat([]byte{0xff}, 8-len(pin))...)
+	_, err := exchange(card, 0x00, insVerify, 0x00, pivPINRef, padded, false)
+	if err == nil {
+		return nil
+	}
+	status, serr := verifyStatus(err, tries)
+	if serr != nil {
+		return fmt.Errorf("verify: %w", serr)
+	}
+	sentinel := ErrWrongPIN
+	if status.Locked {
+		sentinel = ErrPINLocked
+	}
+	return &PINError{Err: sentinel, Status: status, cause: err}
+}
+
+// token reads the card in the reader, its serial is the one of the CHUID
+// rather than of the certificate.
+func (p *PIV) token(slot int, r Reader) (*Token, error) {
+	card, err := connectPIV(r)
+	if err != nil {
+		return nil, err
+	}
+	defer card.Close()
+	if _, err := pivCertificate(card, p.key()); err != nil {
+		return nil, err
+	}
+	serial, err := pivSerial(card)
+	if err != nil {
+		return nil, err
+	}
+	status, err := pivPINStatus(card, p.Tries)
+	if err != nil {
+		return nil, err
+	}
+	return &Token{
+		Slot:         uint(slot),
+		Label:        r.Name(),
+		Serial:       serial,
+		Manufacturer: "PIV",
+		PIN:          status,
+	}, nil
+}
+
+// EnumerateTokens returns the readers holding a PIV card with a certificate
+// for Key.
+func (p *PIV) EnumerateTokens() ([]*Token, error) {
+	readers, err := p.readers()
+	if err != nil {
+		return nil, fmt.Errorf("list readers: %w", err)
+	}
+	var ret []*Token
+	for i, r := range readers {
+		t, err := p.token(i, r)
+		if err != nil {
+			// empty readers and other cards
+			continue
+		}
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
+
+// Watch rescans the readers every second, PC/SC change notifications are not
+// used. The card of a signer is connected exclusively, it is only checked
+// for removal until Close.
+func (p *PIV) Watch(ctx context.Context) (<-chan Event, error) {
+	if _, err := p.readers(); err != nil {
+		return nil, fmt.Errorf("list readers: %w", err)
+	}
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		present := make(map[uint]*Token)
+		for {
+			p.mu.Lock()
+			signing, slot := p.card != nil, p.slot
+			removed := signing && !pivPresent(p.card)
+			p.mu.Unlock()
+			var tokens []*Token
+			var err error
+			if signing {
+				for s, t := range present {
+					if s != slot || !removed {
+						tokens = append(tokens, t)
+					}
+				}
+			} else {
+				tokens, err = p.EnumerateTokens()
+			}
+			if err == nil {
+				for _, e := range diff(present, tokens) {
+					select {
+					case ch <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+			select {
+			case <-time.After(watchPoll):
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (p *PIV) PINStatus(token *Token) (PINStatus, error) {
+	card, err := p.connect(token)
+	if err != nil {
+		return PINStatus{}, err
+	}
+	defer card.Close()
+	return pivPINStatus(card, p.Tries)
+}
+
+func (p *PIV) Select(sel *Selector, in []*Token) ([]*Token, error) {
+	if sel == nil {
+		return in, nil
+	}
+	var ret []*Token
+	for _, t := range in {
+		if !sel.matchInfo(t) {
+			continue
+		}
+		if sel.Fingerprint != nil {
+			card, err := p.connect(t)
+			if err != nil {
+				return nil, err
+			}
+			cert, err := pivCertificate(card, p.key())
+			card.Close()
+			if err != nil {
+				return nil, err
+			}
+			if !bytes.Equal(Fingerprint(cert), sel.Fingerprint) {
+				continue
+			}
+		}
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
+
+func (p *PIV) FilterTokens(hint string, in []*Token) []*Token {
+	var ret []*Token
+	for _, t := range in {
+		if strings.Contains(t.Label, hint) {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+func (p *PIV) SetPIN(pin string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pin = pin
+}
+
+// GetSigner verifies the PIN and keeps the card connected until Close, the
+// signer signs with GENERAL AUTHENTICATE.
+func (p *PIV) GetSigner(token *Token) (*x509.Certificate, *ecdsa.PublicKey, crypto.Signer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.card != nil {
+		return nil, nil, nil, errSignerOpen
+	}
+	card, err := p.connect(token)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	cert, err := pivCertificate(card, p.key())
+	if err != nil {
+		card.Close()
+		return nil, nil, nil, err
+	}
+	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		card.Close()
+		return nil, nil, nil, fmt.Errorf("certificate key %T is not ECDSA", cert.PublicKey)
+	}
+	var alg byte
+	switch pub.Curve {
+	case elliptic.P256():
+		alg = pivP256
+	case elliptic.P384():
+		alg = pivP384
+	default:
+		card.Close()
+		return nil, nil, nil, fmt.Errorf("unsupported curve %s", pub.Curve.Params().Name)
+	}
+	if err := pivVerify(card, p.pin, p.Tries); err != nil {
+		card.Close()
+		return nil, nil, nil, err
+	}
+	p.card, p.slot = card, token.Slot
+	return cert, pub, &pivSigner{p: p, card: card, key: p.key(), alg: alg, pub: pub}, nil
+}
+
+// Certificates reads the certificate of Key.
+func (p *PIV) Certificates(token *Token) ([]*x509.Certificate, error) {
+	card, err := p.connect(token)
+	if err != nil {
+		return nil, err
+	}
+	defer card.Close()
+	cert, err := pivCertificate(card, p.key())
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{cert}, nil
+}
+
+func (p *PIV) Signer(token *Token, cert *x509.Certificate) (crypto.Signer, error) {
+	got, _, signer, err := p.GetSigner(token)
+	if err != nil {
+		return nil, err
+	}
+	if !got.Equal(cert) {
+		p.Close()
+		return nil, fmt.Errorf("no key for cert %q on token %q", cert.Subject.CommonName, token.Label)
+	}
+	return signer, nil
+}
+
+// CloseToken disconnects the card if it is the one of token.
+func (p *PIV) CloseToken(token *Token) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.card == nil || p.slot != token.Slot {
+		return nil
+	}
+	return p.disconnect()
+}
+
+func (p *PIV) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.card == nil {
+		return nil
+	}
+	return p.disconnect()
+}
+
+// disconnect closes the card, p.mu is held.
+func (p *PIV) disconnect() error {
+	err := p.card.Close()
+	p.card = nil
+	return err
+}
+
+type pivSigner struct {
+	p    *PIV
+	card Card
+	key  byte
+	alg  byte
+	pub  *ecdsa.PublicKey
+}
+
+func (s *pivSigner) Public() crypto.PublicKey {
+	return s.pub
+}
+
+// Sign signs the digest, left padded with zeros or truncated to the size of
+// the key as the card expects. The signature is ASN.1 DER. The card is shared
+// with the removal check of Watch, so the exchange holds the lock of PIV.
+func (s *pivSigner) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	s.p.mu.Lock()
+	defer s.p.mu.Unlock()
+	if s.p.card != s.card {
+		return nil, errors.New("signer closed")
+	}
+	size := (s.pub.Curve.Params().BitSize + 7) / 8
+	if len(digest) > size {
+		digest = digest[:size]
+	}
+	input := append(make([]byte, size-len(digest)), digest...)
+	cmd := tlv([]byte{0x7c}, tlv([]byte{0x82}), tlv([]byte{0x81}, input))
+	resp, err := transmit(s.card, 0x00, insGeneralAuth, s.alg, s.key, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("general authenticate: %w", err)
+	}
+	template, err := findTLV(resp, 0x7c)
+	if err != nil {
+		return nil, err
+	}
+	return findTLV(template, 0x82)
+}
@@ -0,0 +1,219 @@
+package cards_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/miekg/pkcs11"
+	"github.com/ritave/eIDAS-bridge/snark/cards"
+	"github.com/ritave/eIDAS-bridge/snark/cards/cardstest"
+)
+
+// the APDUs of cards.PIV
+var (
+	selectPIV   = cardstest.Exchange{Command: []byte{0x00, 0xa4, 0x04, 0x00, 0x05, 0xa0, 0x00, 0x00, 0x03, 0x08, 0x00}, Response: []byte{0x90, 0x00}}
+	getCertAuth = []byte{0x00, 0xcb, 0x3f, 0xff, 0x05, 0x5c, 0x03, 0x5f, 0xc1, 0x05, 0x00}
+	getCHUID    = []byte{0x00, 0xcb, 0x3f, 0xff, 0x05, 0x5c, 0x03, 0x5f, 0xc1, 0x02, 0x00}
+	getResponse = []byte{0x00, 0xc0, 0x00, 0x00, 0x00}
+	pinStatus   = []byte{0x00, 0x20, 0x00, 0x80}
+)
+
+func pivCard(t *testing.T) (*ecdsa.PrivateKey, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(0x1234),
+		Subject:      pkix.Name{CommonName: "PIV Authentication"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+// readCert returns the exchanges reading the certificate object, the response
+// split over GET RESPONSE like cards do.
+func readCert(cert *x509.Certificate) []cardstest.Exchange {
+	object := append([]byte{0x70, 0x82, byte(len(cert.Raw) >> 8), byte(len(cert.Raw))}, cert.Raw...)
+	object = append(object, 0x71, 0x01, 0x00, 0xfe, 0x00)
+	data := append([]byte{0x53, 0x82, byte(len(object) >> 8), byte(len(object))}, object...)
+	first, rest := data[:256], data[256:]
+	return []cardstest.Exchange{
+		{Command: getCertAuth, Response: append(append([]byte{}, first...), 0x61, byte(len(rest)))},
+		{Command: getResponse, Response: append(append([]byte{}, rest...), 0x90, 0x00)},
+	}
+}
+
+func verifyPIN(pin string, sw ...byte) cardstest.Exchange {
+	padded := append([]byte(pin), bytes.Repeat([]byte{0xff}, 8-len(pin))...)
+	return cardstest.Exchange{Command: append(append(append([]byte{}, pinStatus...), 0x08), padded...), Response: sw}
+}
+
+// readCHUID returns the exchange reading a CHUID with the GUID, a card
+// without one when guid is nil.
+func readCHUID(guid []byte) cardstest.Exchange {
+	if guid == nil {
+		return cardstest.Exchange{Command: getCHUID, Response: []byte{0x6a, 0x82}}
+	}
+	fascn := bytes.Repeat([]byte{0xd4}, 25)
+	chuid := append(append([]byte{0x30, byte(len(fascn))}, fascn...), 0x34, byte(len(guid)))
+	chuid = append(append(chuid, guid...), 0xfe, 0x00)
+	data := append([]byte{0x53, byte(len(chuid))}, chuid...)
+	return cardstest.Exchange{Command: getCHUID, Response: append(data, 0x90, 0x00)}
+}
+
+// enumerate returns the exchanges of listing a card with the GUID and tries
+// PIN attempts left.
+func enumerate(cert *x509.Certificate, guid []byte, tries byte) []cardstest.Exchange {
+	script := append([]cardstest.Exchange{selectPIV}, readCert(cert)...)
+	return append(script, readCHUID(guid),
+		cardstest.Exchange{Command: pinStatus, Response: []byte{0x63, 0xc0 | tries}})
+}
+
+func TestPIV(t *testing.T) {
+	key, cert := pivCard(t)
+	reader := cardstest.NewReader(t, "Yubico YubiKey CCID 00 00")
+	empty := cardstest.NewReader(t, "Empty Reader 01 00")
+	empty.Remove()
+	p := cards.NewPIV(func() ([]cards.Reader, error) {
+		return []cards.Reader{empty, reader}, nil
+	})
+	p.Tries = 3
+
+	guid := []byte{0x0f, 0x1e, 0x2d, 0x3c, 0x4b, 0x5a, 0x69, 0x78, 0x87, 0x96, 0xa5, 0xb4, 0xc3, 0xd2, 0xe1, 0xf0}
+	reader.Play(enumerate(cert, guid, 3)...)
+	tokens, err := p.EnumerateTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].Slot != 1 || tokens[0].Serial != "0f1e2d3c4b5a69788796a5b4c3d2e1f0" || tokens[0].PIN != (cards.PINStatus{}) {
+		t.Fatalf("unexpected tokens %+v", tokens)
+	}
+	token := tokens[0]
+
+	// wrong PIN
+	reader.Play(selectPIV)
+	reader.Play(readCert(cert)...)
+	reader.Play(verifyPIN("000000", 0x63, 0xc2))
+	p.SetPIN("000000")
+	_, _, _, err = p.GetSigner(token)
+	var perr *cards.PINError
+	if !errors.As(err, &perr) || !errors.Is(err, cards.ErrWrongPIN) || !perr.Status.CountLow {
+		t.Fatalf("expected wrong PIN, got %v", err)
+	}
+
+	// sign with GENERAL AUTHENTICATE
+	digest := sha256.Sum256([]byte("challenge"))
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := append(make([]byte, 16), digest[:]...)
+	auth := append([]byte{0x00, 0x87, 0x14, 0x9a, 0x36, 0x7c, 0x34, 0x82, 0x00, 0x81, 0x30}, input...)
+	reader.Play(selectPIV)
+	reader.Play(readCert(cert)...)
+	reader.Play(verifyPIN("123456", 0x90, 0x00))
+	reader.Play(cardstest.Exchange{
+		Command:  append(auth, 0x00),
+		Response: append(append([]byte{0x7c, byte(len(sig) + 2), 0x82, byte(len(sig))}, sig...), 0x90, 0x00),
+	})
+	p.SetPIN("123456")
+	got, pub, signer, err := p.GetSigner(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Equal(cert) || !pub.Equal(&key.PublicKey) {
+		t.Fatal("signer does not match the card")
+	}
+	signature, err := signer.Sign(nil, digest[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(pub, digest[:], signature) {
+		t.Fatal("signature does not verify")
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// removed card
+	reader.Remove()
+	_, _, _, err = p.GetSigner(token)
+	if !errors.Is(err, pkcs11.Error(pkcs11.CKR_TOKEN_NOT_PRESENT)) {
+		t.Fatalf("expected card not present, got %v", err)
+	}
+}
+
+func TestPIVLocked(t *testing.T) {
+	_, cert := pivCard(t)
+	reader := cardstest.NewReader(t, "Reader")
+	p := cards.NewPIV(func() ([]cards.Reader, error) { return []cards.Reader{reader}, nil })
+	reader.Play(enumerate(cert, nil, 1)...)
+	tokens, err := p.EnumerateTokens()
+	if err != nil || len(tokens) != 1 || tokens[0].Serial != "" || !tokens[0].PIN.FinalTry || tokens[0].PIN.Remaining() != 1 {
+		t.Fatalf("expected the final try, got %+v %v", tokens, err)
+	}
+	reader.Play(selectPIV)
+	reader.Play(readCert(cert)...)
+	reader.Play(verifyPIN("000000", 0x69, 0x83))
+	p.SetPIN("000000")
+	if _, _, _, err := p.GetSigner(tokens[0]); !errors.Is(err, cards.ErrPINLocked) {
+		t.Fatalf("expected a locked PIN, got %v", err)
+	}
+}
+
+func TestPIVRemovedWhileSigning(t *testing.T) {
+	_, cert := pivCard(t)
+	reader := cardstest.NewReader(t, "Reader")
+	p := cards.NewPIV(func() ([]cards.Reader, error) { return []cards.Reader{reader}, nil })
+	reader.Play(enumerate(cert, nil, 3)...)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := p.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := <-events
+	if e.Type != cards.TokenInserted {
+		t.Fatalf("expected an insertion, got %v", e.Type)
+	}
+
+	// the watch only checks the card of the signer
+	reader.Play(selectPIV)
+	reader.Play(readCert(cert)...)
+	reader.Play(verifyPIN("123456", 0x90, 0x00))
+	p.SetPIN("123456")
+	if _, _, _, err := p.GetSigner(e.Token); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+	reader.Remove()
+	select {
+	case e := <-events:
+		if e.Type != cards.TokenRemoved || e.Token.Slot != 0 {
+			t.Fatalf("expected the removal, got %v %+v", e.Type, e.Token)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no removal while signing")
+	}
+}
@@ -0,0 +1,127 @@
+package cards
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Selector matches tokens. The zero Selector matches every token, set fields
+// must all match.
+type Selector struct {
+	Serial       string
+	Slot         *uint
+	Label        *regexp.Regexp
+	Manufacturer string
+	// Fingerprint is the SHA-256 of a certificate on the token.
+	Fingerprint []byte
+}
+
+// ParseSelector parses comma separated key=value pairs, for example
+// "label=^PIN1,serial=0123" or "fingerprint=<hex>". The keys are serial,
+// slot, label (a regular expression), manufacturer and fingerprint.
+func ParseSelector(s string) (*Selector, error) {
+	sel := &Selector{}
+	if strings.TrimSpace(s) == "" {
+		return sel, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok {
+			return nil, fmt.Errorf("selector %q: expected key=value", kv)
+		}
+		switch strings.TrimSpace(k) {
+		case "serial":
+			sel.Serial = v
+		case "slot":
+			slot, err := strconv.ParseUint(v, 10, 0)
+			if err != nil {
+				return nil, fmt.Errorf("slot: %w", err)
+			}
+			u := uint(slot)
+			sel.Slot = &u
+		case "label":
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return nil, fmt.Errorf("label: %w", err)
+			}
+			sel.Label = re
+		case "manufacturer":
+			sel.Manufacturer = v
+		case "fingerprint":
+			fp, err := hex.DecodeString(strings.ReplaceAll(v, ":", ""))
+			if err != nil {
+				return nil, fmt.Errorf("fingerprint: %w", err)
+			}
+			if len(fp) != sha256.Size {
+				return nil, fmt.Errorf("fingerprint: expected %d bytes, got %d", sha256.Size, len(fp))
+			}
+			sel.Fingerprint = fp
+		default:
+			return nil, fmt.Errorf("selector: unknown key %q", k)
+		}
+	}
+	return sel, nil
+}
+
+// matchInfo matches everything but the fingerprint, which needs the token.
+func (s *Selector) matchInfo(t *Token) bool {
+	return (s.Serial == "" || s.Serial == t.Serial) &&
+		(s.Slot == nil || *s.Slot == t.Slot) &&
+		(s.Label == nil || s.Label.MatchString(t.Label)) &&
+		(s.Manufacturer == "" || s.Manufacturer == t.Manufacturer)
+}
+
+// Fingerprint returns the SHA-256 of the DER encoded certificate.
+func Fingerprint(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.Raw)
+	return sum[:]
+}
+
+// Select returns the tokens matching sel, a nil sel matches every token. The
+// certificates are only read when matching by fingerprint.
+func (ctx *Config) Select(sel *Selector, in []*Token) ([]*Token, error) {
+	if sel == nil {
+		return in, nil
+	}
+	var ret []*Token
+	for _, t := range in {
+		if !sel.matchInfo(t) {
+			continue
+		}
+		if sel.Fingerprint != nil {
+			keys, err := ctx.Keys(t)
+			if err != nil {
+				return nil, fmt.Errorf("token %q: %w", t.Label, err)
+			}
+			found := false
+			for _, k := range keys {
+				found = found || bytes.Equal(Fingerprint(k.Certificate), sel.Fingerprint)
+			}
+			if !found {
+				continue
+			}
+		}
+		ret = append(ret, t)
+	}
+	return ret, nil
+}
+
+// Certificates reads the certificates of the keys allowed by the key policy,
+// which does not need a login.
+func (ctx *Config) Certificates(token *Token) ([]*x509.Certificate, error) {
+	keys, err := ctx.Keys(token)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*x509.Certificate
+	for _, k := range ctx.policyKeys(keys) {
+		ret = append(ret, k.Certificate)
+	}
+	return ret, nil
+}
@@ -0,0 +1,57 @@
+package cards
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSelect(t *testing.T) {
+	tokens := []*Token{
+		{Slot: 0, Label: "PIN1 (auth)", Serial: "a", Manufacturer: "PWPW"},
+		{Slot: 1, Label: "PIN2 (sign)", Serial: "a", Manufacturer: "PWPW"},
+		{Slot: 4, Label: "PIV", Serial: "b", Manufacturer: "Yubico"},
+	}
+	for _, tc := range []struct {
+		selector string
+		want     []uint
+	}{
+		{"", []uint{0, 1, 4}},
+		{"label=^PIN1", []uint{0}},
+		{"serial=a", []uint{0, 1}},
+		{"serial=a, slot=1", []uint{1}},
+		{"manufacturer=Yubico", []uint{4}},
+		{"slot=2", nil},
+	} {
+		sel, err := ParseSelector(tc.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := New("", "").Select(sel, tokens)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var slots []uint
+		for _, t := range got {
+			slots = append(slots, t.Slot)
+		}
+		if fmt.Sprint(slots) != fmt.Sprint(tc.want) {
+			t.Fatalf("%q: got slots %v, expected %v", tc.selector, slots, tc.want)
+		}
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	sel, err := ParseSelector("fingerprint=" + strings.Repeat("ab:", 31) + "ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sel.Fingerprint) != 32 || sel.Fingerprint[0] != 0xab {
+		t.Fatalf("unexpected fingerprint %x", sel.Fingerprint)
+	}
+	for _, s := range []string{"serial", "color=red", "slot=x", "label=(", "fingerprint=abcd"} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Fatalf("%q: expected error", s)
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package cards
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"github.com/ritave/eIDAS-bridge/snark/cards/sig"
+)
+
+var errSessionClosed = errors.New("session closed")
+
+// session is a logged in session on a token, shared by the signers of the
+// token until Config.Close or until the PIN changes. PKCS#11 operations span
+// several calls, so they are serialised by mu. A session on a protected
+// authentication path logs out after every signature, so each one is
+// confirmed on the PIN pad.
+type session struct {
+	p         *pkcs11.Ctx
+	handle    pkcs11.SessionHandle
+	serial    string
+	pin       string // logged in with, "" on a protected authentication path
+	protected bool
+
+	mu       sync.Mutex
+	closed   bool
+	loggedIn bool
+}
+
+// openSession returns the session of the token, opening and logging into it
+// on first use. A session logged in with another PIN than the current one is
+// logged out, so a wrong PIN is never hidden by an earlier login. Each
+// session holds a reference on the library until it is closed.
+func (ctx *Config) openSession(token *Token) (*session, error) {
+	ctx.sessionsMu.Lock()
+	defer ctx.sessionsMu.Unlock()
+	pin := ctx.pin()
+	if token.ProtectedAuthPath {
+		// an empty PIN is passed as NULL to C_Login
+		pin = ""
+	}
+	if s, ok := ctx.sessions[token.Slot]; ok {
+		if s.serial == token.Serial && s.pin == pin {
+			// a protected session waits for the PIN pad again
+			err := s.login()
+			if err == nil {
+				return s, nil
+			}
+			delete(ctx.sessions, token.Slot)
+			s.close()
+			ctx.release()
+			return nil, fmt.Errorf("login: %w", ctx.loginError(token, err))
+		}
+		// another token was inserted into the slot or the PIN changed
+		delete(ctx.sessions, token.Slot)
+		s.close()
+		ctx.release()
+	}
+	p, err := ctx.acquire()
+	if err != nil {
+		return nil, err
+	}
+	h, err := p.OpenSession(token.Slot, pkcs11.CKF_SERIAL_SESSION)
+	if err != nil {
+		ctx.release()
+		return nil, fmt.Errorf("open session: %w", err)
+	}
+	s := &session{p: p, handle: h, serial: token.Serial, pin: pin, protected: token.ProtectedAuthPath}
+	if err := s.login(); err != nil {
+		p.CloseSession(h)
+		ctx.release()
+		return nil, fmt.Errorf("login: %w", ctx.loginError(token, err))
+	}
+	if ctx.sessions == nil {
+		ctx.sessions = make(map[uint]*session)
+	}
+	ctx.sessions[token.Slot] = s
+	return s, nil
+}
+
+// login logs into the session unless it is logged in already. A protected
+// session is logged out first, so the PIN pad confirms every login.
+func (s *session) login() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return errSessionClosed
+	}
+	if s.loggedIn && s.protected {
+		s.logout()
+	}
+	return s.loginLocked()
+}
+
+// loginLocked logs in if needed, s.mu is held.
+func (s *session) loginLocked() error {
+	if s.loggedIn {
+		return nil
+	}
+	if err := s.p.Login(s.handle, pkcs11.CKU_USER, s.pin); err != nil && !errors.Is(err, pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN)) {
+		return err
+	}
+	s.loggedIn = true
+	return nil
+}
+
+// logout logs out of the session, s.mu is held. The token may be gone
+// already, so errors are ignored.
+func (s *session) logout() {
+	s.p.Logout(s.handle)
+	s.loggedIn = false
+}
+
+// findKey returns the private key with the ID.
+func (s *session) findKey(id []byte) (pkcs11.ObjectHandle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, errSessionClosed
+	}
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	if err := s.p.FindObjectsInit(s.handle, template); err != nil {
+		return 0, err
+	}
+	found, _, err := s.p.FindObjects(s.handle, 1)
+	if ferr := s.p.FindObjectsFinal(s.handle); err == nil {
+		err = ferr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(found) == 0 {
+		return 0, errors.New("not found")
+	}
+	return found[0], nil
+}
+
+// sign returns the raw r || s ECDSA signature of the digest. A protected
+// session logs in again on the PIN pad when an earlier signature logged it
+// out, and logs out afterwards.
+func (s *session) sign(key pkcs11.ObjectHandle, digest []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil, errSessionClosed
+	}
+	if err := s.loginLocked(); err != nil {
+		return nil, fmt.Errorf("login: %w", err)
+	}
+	if s.protected {
+		defer s.logout()
+	}
+	mech := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}
+	if err := s.p.SignInit(s.handle, mech, key); err != nil {
+		return nil, fmt.Errorf("sign init: %w", err)
+	}
+	sig, err := s.p.Sign(s.handle, digest)
+	if err != nil {
+		return nil, fmt.Errorf("sign: %w", err)
+	}
+	return sig, nil
+}
+
+// close logs out and closes the session, the signers fail afterwards.
+func (s *session) close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	// only the close is reported
+	s.logout()
+	return s.p.CloseSession(s.handle)
+}
+
+// p11Signer is a private key in a token session.
+type p11Signer struct {
+	s   *session
+	key pkcs11.ObjectHandle
+	pub *ecdsa.PublicKey
+}
+
+func (k *p11Signer) Public() crypto.PublicKey {
+	return k.pub
+}
+
+// Sign signs the digest with CKM_ECDSA and returns the ASN.1 signature. The
+// mechanism returns r || s, but some modules return DER already.
+func (k *p11Signer) Sign(_ io.Reader, digest []byte, _ crypto.SignerOpts) ([]byte, error) {
+	signature, err := k.s.sign(k.key, digest)
+	if err != nil {
+		return nil, err
+	}
+	r, s, err := sig.Unmarshal(signature, k.pub.Curve)
+	if err != nil {
+		return nil, fmt.Errorf("signature of %d bytes: %w", len(signature), err)
+	}
+	return sig.Marshal(r, s)
+}
@@ -0,0 +1,125 @@
+// Package sig encodes and parses the ECDSA signatures of cards. It is pure Go,
+// so the circuits parse signatures without the PKCS#11 bindings of cards.
+package sig
+
+import (
+	"crypto/elliptic"
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// Marshal encodes an ECDSA signature as the ASN.1 SEQUENCE of r and s, the
+// inverse of Unmarshal.
+func Marshal(r, s *big.Int) ([]byte, error) {
+	var b cryptobyte.Builder
+	b.AddASN1(asn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1BigInt(r)
+		b.AddASN1BigInt(s)
+	})
+	return b.Bytes()
+}
+
+// Format is the encoding of an ECDSA signature.
+type Format int
+
+const (
+	// DER is the ASN.1 SEQUENCE of r and s of X.509 and crypto.Signer.
+	DER Format = iota
+	// Raw is r || s, each zero padded to the size of the curve order, as
+	// returned by CKM_ECDSA.
+	Raw
+)
+
+func (f Format) String() string {
+	switch f {
+	case DER:
+		return "DER"
+	case Raw:
+		return "raw"
+	default:
+		return "unknown"
+	}
+}
+
+// DetectFormat tells the encoding of an ECDSA signature on the curve. A
+// signature parsing as strict DER is DER, otherwise one of twice the size of
+// the curve order is raw.
+func DetectFormat(sig []byte, curve elliptic.Curve) (Format, error) {
+	if _, _, err := unmarshalDER(sig); err == nil {
+		return DER, nil
+	}
+	if len(sig) == 2*orderSize(curve) {
+		return Raw, nil
+	}
+	return 0, errors.New("invalid ASN.1")
+}
+
+// Unmarshal parses an ECDSA signature on the curve, in DER or raw r || s as
+// told by DetectFormat. DER has to be minimally encoded without trailing
+// data, and r and s in [1, N-1].
+func Unmarshal(sig []byte, curve elliptic.Curve) (r, s *big.Int, err error) {
+	format, err := DetectFormat(sig, curve)
+	if err != nil {
+		return nil, nil, err
+	}
+	if format == Raw {
+		n := len(sig) / 2
+		r, s = new(big.Int).SetBytes(sig[:n]), new(big.Int).SetBytes(sig[n:])
+	} else if r, s, err = unmarshalDER(sig); err != nil {
+		return nil, nil, err
+	}
+	n := curve.Params().N
+	if r.Sign() <= 0 || s.Sign() <= 0 || r.Cmp(n) >= 0 || s.Cmp(n) >= 0 {
+		return nil, nil, errors.New("signature out of range")
+	}
+	return r, s, nil
+}
+
+func unmarshalDER(sig []byte) (r, s *big.Int, err error) {
+	var inner cryptobyte.String
+	r, s = new(big.Int), new(big.Int)
+	input := cryptobyte.String(sig)
+	// cryptobyte rejects non-minimal lengths and integers
+	if !input.ReadASN1(&inner, asn1.SEQUENCE) ||
+		!input.Empty() ||
+		!inner.ReadASN1Integer(r) ||
+		!inner.ReadASN1Integer(s) ||
+		!inner.Empty() {
+		return nil, nil, errors.New("invalid ASN.1")
+	}
+	return r, s, nil
+}
+
+// MarshalRaw encodes r || s, each padded to the size of the curve order, r
+// and s have to be below it.
+func MarshalRaw(r, s *big.Int, curve elliptic.Curve) []byte {
+	n := orderSize(curve)
+	ret := make([]byte, 2*n)
+	r.FillBytes(ret[:n])
+	s.FillBytes(ret[n:])
+	return ret
+}
+
+// orderSize is the size in bytes of the curve order, 66 for P-521.
+func orderSize(curve elliptic.Curve) int {
+	return (curve.Params().N.BitLen() + 7) / 8
+}
+
+// NormalizeS returns the low form of s, N-s when s is in the upper half of
+// the curve order. (r, s) and (r, N-s) are both valid, the circuits only
+// accept the low one so a signature gives a single proof.
+func NormalizeS(curve elliptic.Curve, s *big.Int) *big.Int {
+	n := curve.Params().N
+	if IsLowS(curve, s) {
+		return s
+	}
+	return new(big.Int).Sub(n, s)
+}
+
+// IsLowS tells whether s is at most (N-1)/2.
+func IsLowS(curve elliptic.Curve, s *big.Int) bool {
+	return s.Cmp(new(big.Int).Rsh(curve.Params().N, 1)) <= 0
+}
@@ -0,0 +1,124 @@
+package sig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+)
+
+func TestUnmarshalSignature(t *testing.T) {
+	curve := elliptic.P384()
+	n := curve.Params().N
+	one := big.NewInt(1)
+	der := func(r, s *big.Int) []byte {
+		sig, err := Marshal(r, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sig
+	}
+	valid := der(big.NewInt(0x1234), new(big.Int).Sub(n, one))
+	for _, tt := range []struct {
+		name string
+		sig  []byte
+		ok   bool
+	}{
+		{"valid", valid, true},
+		{"trailing data", append(append([]byte{}, valid...), 0), false},
+		{"zero r", der(new(big.Int), one), false},
+		{"negative s", der(one, big.NewInt(-1)), false},
+		{"s of N", der(one, n), false},
+		{"oversized r", der(new(big.Int).Lsh(one, 400), one), false},
+		{"non-minimal integer", []byte{0x30, 0x07, 0x02, 0x02, 0x00, 0x01, 0x02, 0x01, 0x01}, false},
+		{"non-minimal length", []byte{0x30, 0x81, 0x06, 0x02, 0x01, 0x01, 0x02, 0x01, 0x01}, false},
+	} {
+		r, s, err := Unmarshal(tt.sig, curve)
+		if tt.ok != (err == nil) {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if tt.ok && (r.Int64() != 0x1234 || s.Cmp(new(big.Int).Sub(n, one)) != 0) {
+			t.Errorf("%s: unexpected r=%s s=%s", tt.name, r, s)
+		}
+	}
+}
+
+func TestNormalizeS(t *testing.T) {
+	curve := elliptic.P256()
+	n := curve.Params().N
+	half := new(big.Int).Rsh(n, 1)
+	if s := NormalizeS(curve, half); s.Cmp(half) != 0 {
+		t.Fatalf("(N-1)/2 changed to %s", s)
+	}
+	above := new(big.Int).Add(half, big.NewInt(1))
+	if s := NormalizeS(curve, above); s.Cmp(half) != 0 || !IsLowS(curve, s) {
+		t.Fatalf("(N+1)/2 normalised to %s", s)
+	}
+}
+
+func TestSignatureFormats(t *testing.T) {
+	digest := sha256.Sum256([]byte("challenge"))
+	for _, tt := range []struct {
+		curve elliptic.Curve
+		raw   int
+	}{
+		{elliptic.P256(), 64},
+		{elliptic.P384(), 96},
+		{elliptic.P521(), 132},
+	} {
+		name := tt.curve.Params().Name
+		key, err := ecdsa.GenerateKey(tt.curve, rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := Marshal(r, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw := MarshalRaw(r, s, tt.curve)
+		if len(raw) != tt.raw {
+			t.Fatalf("%s: raw signature of %d bytes, expected %d", name, len(raw), tt.raw)
+		}
+		// a short r is padded and still detected as raw
+		short := MarshalRaw(big.NewInt(1), s, tt.curve)
+		for _, sig := range []struct {
+			enc    []byte
+			format Format
+			r      *big.Int
+		}{
+			{der, DER, r},
+			{raw, Raw, r},
+			{short, Raw, big.NewInt(1)},
+		} {
+			format, err := DetectFormat(sig.enc, tt.curve)
+			if err != nil || format != sig.format {
+				t.Fatalf("%s: detected %v %v, expected %v", name, format, err, sig.format)
+			}
+			gotR, gotS, err := Unmarshal(sig.enc, tt.curve)
+			if err != nil {
+				t.Fatalf("%s %v: %v", name, sig.format, err)
+			}
+			if gotR.Cmp(sig.r) != 0 || gotS.Cmp(s) != 0 {
+				t.Fatalf("%s %v: unexpected r=%s s=%s", name, sig.format, gotR, gotS)
+			}
+		}
+		if _, err := DetectFormat(raw[1:], tt.curve); err == nil {
+			t.Fatalf("%s: truncated raw signature detected", name)
+		}
+		// the raw signature of another curve is not taken for this one
+		for _, other := range []elliptic.Curve{elliptic.P256(), elliptic.P384(), elliptic.P521()} {
+			if other == tt.curve {
+				continue
+			}
+			if _, _, err := Unmarshal(raw, other); err == nil {
+				t.Fatalf("%s signature parsed on %s", name, other.Params().Name)
+			}
+		}
+	}
+}
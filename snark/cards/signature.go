@@ -0,0 +1,53 @@
+package cards
+
+import (
+	"crypto/elliptic"
+	"math/big"
+
+	"github.com/ritave/eIDAS-bridge/snark/cards/sig"
+)
+
+// The signature encoding lives in the pure-Go cards/sig, which the circuits
+// import without the PKCS#11 bindings. The names below keep the API of cards.
+
+// SignatureFormat is the encoding of an ECDSA signature.
+type SignatureFormat = sig.Format
+
+const (
+	SignatureDER = sig.DER
+	SignatureRaw = sig.Raw
+)
+
+// MarshalSignature encodes an ECDSA signature as the ASN.1 SEQUENCE of r and
+// s, see sig.Marshal.
+func MarshalSignature(r, s *big.Int) ([]byte, error) {
+	return sig.Marshal(r, s)
+}
+
+// MarshalRawSignature encodes r || s, see sig.MarshalRaw.
+func MarshalRawSignature(r, s *big.Int, curve elliptic.Curve) []byte {
+	return sig.MarshalRaw(r, s, curve)
+}
+
+// DetectSignatureFormat tells the encoding of an ECDSA signature on the
+// curve, see sig.DetectFormat.
+func DetectSignatureFormat(signature []byte, curve elliptic.Curve) (SignatureFormat, error) {
+	return sig.DetectFormat(signature, curve)
+}
+
+// UnmarshalSignature parses a DER or raw ECDSA signature on the curve, see
+// sig.Unmarshal.
+func UnmarshalSignature(signature []byte, curve elliptic.Curve) (r, s *big.Int, err error) {
+	return sig.Unmarshal(signature, curve)
+}
+
+// NormalizeS returns s in the lower half of the curve order, see
+// sig.NormalizeS.
+func NormalizeS(curve elliptic.Curve, s *big.Int) *big.Int {
+	return sig.NormalizeS(curve, s)
+}
+
+// IsLowS tells whether s is in the lower half of the curve order.
+func IsLowS(curve elliptic.Curve, s *big.Int) bool {
+	return sig.IsLowS(curve, s)
+}
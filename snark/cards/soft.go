@@ -0,0 +1,302 @@
+package cards
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// SoftTokenPIN is the PIN of a new SoftToken.
+const SoftTokenPIN = "123456"
+
+const softTokenTries = 3
+
+var (
+	oidGivenName = asn1.ObjectIdentifier{2, 5, 4, 42}
+	oidSurname   = asn1.ObjectIdentifier{2, 5, 4, 4}
+	// id-pkinit-KPClientAuth, smart card logon
+	oidPKINITClientAuth = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 3, 4}
+)
+
+// DefaultSubject is an eID-like subject. With it the certificate of a
+// SoftToken has the layout expected by circuits.Circuit.
+var DefaultSubject = pkix.Name{
+	CommonName: "Nowak, Adam",
+	ExtraNames: []pkix.AttributeTypeAndValue{
+		{Type: oidGivenName, Value: "Adam"},
+		{Type: oidSurname, Value: "Nowak"},
+	},
+}
+
+// SoftToken is an in-memory token with a P-384 key and a self-signed
+// authentication certificate, for tests and development without a card. It
+// counts PIN attempts like a card and locks after three wrong ones.
+type SoftToken struct {
+	mu      sync.Mutex
+	token   Token
+	key     *ecdsa.PrivateKey
+	cert    *x509.Certificate
+	pin     string
+	entered string
+	tries   int
+	present bool
+	changed chan struct{}
+}
+
+// NewSoftToken generates the key and certificate of a present token with
+// SoftTokenPIN.
+func NewSoftToken(subject pkix.Name) (*SoftToken, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate key: %w", err)
+	}
+	cert, err := selfSign(subject, key)
+	if err != nil {
+		return nil, err
+	}
+	return &SoftToken{
+		token: Token{
+			Label:        "SoftToken",
+			Serial:       hex.EncodeToString(cert.SerialNumber.Bytes()),
+			Manufacturer: "eIDAS-bridge",
+		},
+		key:     key,
+		cert:    cert,
+		pin:     SoftTokenPIN,
+		tries:   softTokenTries,
+		present: true,
+		changed: make(chan struct{}),
+	}, nil
+}
+
+// selfSign creates the certificate with ECDSA over SHA-256. The signature is
+// drawn again until r and s both take 49 bytes in DER, so that certificates
+// of a subject have a fixed length.
+func selfSign(subject pkix.Name, key *ecdsa.PrivateKey) (*x509.Certificate, error) {
+	serial := make([]byte, 9)
+	if _, err := io.ReadFull(rand.Reader, serial); err != nil {
+		return nil, fmt.Errorf("serial: %w", err)
+	}
+	serial[0] = serial[0]&0x7f | 0x01
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("marshal key: %w", err)
+	}
+	ski := sha1.Sum(pub)
+	now := time.Now().UTC().Truncate(time.Second)
+	template := &x509.Certificate{
+		SerialNumber:          new(big.Int).SetBytes(serial),
+		Subject:               subject,
+		NotBefore:             now,
+		NotAfter:              now.AddDate(2, 0, 0),
+		SignatureAlgorithm:    x509.ECDSAWithSHA256,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		UnknownExtKeyUsage:    []asn1.ObjectIdentifier{oidPKINITClientAuth},
+		BasicConstraintsValid: true,
+		SubjectKeyId:          ski[:],
+	}
+	for {
+		der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		if err != nil {
+			return nil, fmt.Errorf("create cert: %w", err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parse cert: %w", err)
+		}
+		// 30 68 02 31 r 02 31 s
+		if len(cert.Signature) == 2+2*(2+49) {
+			return cert, nil
+		}
+	}
+}
+
+// Certificate returns the certificate of the token.
+func (s *SoftToken) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+// SetPINPad makes the token report a protected authentication path, it then
+// signs without checking the PIN.
+func (s *SoftToken) SetPINPad(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token.ProtectedAuthPath = on
+}
+
+// Insert and Remove simulate the card being inserted into or removed from the
+// reader.
+func (s *SoftToken) Insert() {
+	s.setPresent(true)
+}
+
+func (s *SoftToken) Remove() {
+	s.setPresent(false)
+}
+
+func (s *SoftToken) setPresent(present bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.present == present {
+		return
+	}
+	s.present = present
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+func (s *SoftToken) status() PINStatus {
+	return PINStatus{
+		CountLow: s.tries < softTokenTries,
+		FinalTry: s.tries == 1,
+		Locked:   s.tries == 0,
+	}
+}
+
+// tokens returns the present token and a channel closed on the next change.
+func (s *SoftToken) tokens() ([]*Token, <-chan struct{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.present {
+		return nil, s.changed
+	}
+	t := s.token
+	t.PIN = s.status()
+	return []*Token{&t}, s.changed
+}
+
+func (s *SoftToken) EnumerateTokens() ([]*Token, error) {
+	tokens, _ := s.tokens()
+	return tokens, nil
+}
+
+func (s *SoftToken) Watch(ctx context.Context) (<-chan Event, error) {
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		present := make(map[uint]*Token)
+		for {
+			tokens, changed := s.tokens()
+			for _, e := range diff(present, tokens) {
+				select {
+				case ch <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+			select {
+			case <-changed:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func (s *SoftToken) PINStatus(token *Token) (PINStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.present {
+		return PINStatus{}, fmt.Errorf("token %q not present", token.Label)
+	}
+	return s.status(), nil
+}
+
+func (s *SoftToken) Select(sel *Selector, in []*Token) ([]*Token, error) {
+	if sel == nil {
+		return in, nil
+	}
+	var ret []*Token
+	for _, t := range in {
+		if sel.matchInfo(t) && (sel.Fingerprint == nil || bytes.Equal(Fingerprint(s.cert), sel.Fingerprint)) {
+			ret = append(ret, t)
+		}
+	}
+	return ret, nil
+}
+
+func (s *SoftToken) FilterTokens(hint string, in []*Token) []*Token {
+	var ret []*Token
+	for _, t := range in {
+		if strings.Contains(t.Label, hint) {
+			ret = append(ret, t)
+		}
+	}
+	return ret
+}
+
+func (s *SoftToken) SetPIN(pin string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entered = pin
+}
+
+// GetSigner checks the PIN like a card, the errors are those of Config.
+func (s *SoftToken) GetSigner(token *Token) (*x509.Certificate, *ecdsa.PublicKey, crypto.Signer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.present {
+		return nil, nil, nil, fmt.Errorf("configure: %w", pkcs11.Error(pkcs11.CKR_TOKEN_NOT_PRESENT))
+	}
+	if s.tries == 0 {
+		return nil, nil, nil, &PINError{Err: ErrPINLocked, Status: s.status()}
+	}
+	if !s.token.ProtectedAuthPath {
+		if s.entered != s.pin {
+			s.tries--
+			sentinel := ErrWrongPIN
+			if s.tries == 0 {
+				sentinel = ErrPINLocked
+			}
+			return nil, nil, nil, fmt.Errorf("configure: %w", &PINError{Err: sentinel, Status: s.status()})
+		}
+	}
+	s.tries = softTokenTries
+	return s.cert, &s.key.PublicKey, softSigner{s.key}, nil
+}
+
+func (s *SoftToken) Certificates(token *Token) ([]*x509.Certificate, error) {
+	return []*x509.Certificate{s.cert}, nil
+}
+
+func (s *SoftToken) Signer(token *Token, cert *x509.Certificate) (crypto.Signer, error) {
+	if !cert.Equal(s.cert) {
+		return nil, fmt.Errorf("no key for cert %q on token %q", cert.Subject.CommonName, token.Label)
+	}
+	_, _, signer, err := s.GetSigner(token)
+	return signer, err
+}
+
+func (s *SoftToken) CloseToken(*Token) error {
+	return nil
+}
+
+func (s *SoftToken) Close() error {
+	return nil
+}
+
+// softSigner signs like a card, which takes no randomness from the caller.
+type softSigner struct {
+	*ecdsa.PrivateKey
+}
+
+func (s softSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return s.PrivateKey.Sign(rand.Reader, digest, opts)
+}
@@ -0,0 +1,171 @@
+package cards
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestSoftTokenLayout(t *testing.T) {
+	s, err := NewSoftToken(DefaultSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := s.Certificate()
+	pub := cert.PublicKey.(*ecdsa.PublicKey)
+	key, err := pub.ECDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	point := key.Bytes()
+	tbs := cert.RawTBSCertificate
+	// the offsets of circuits.Circuit
+	if len(cert.Raw) != 502 || len(tbs) != 379 {
+		t.Fatalf("unexpected lengths %d %d", len(cert.Raw), len(tbs))
+	}
+	if string(tbs[132:132+11]) != DefaultSubject.CommonName {
+		t.Fatalf("subject not at 132: %q", tbs[132:143])
+	}
+	if !bytes.Equal(tbs[197:197+97], point) {
+		t.Fatal("public key not at 197")
+	}
+	if !bytes.Equal(cert.Raw[400:402], []byte{0x02, 0x31}) {
+		t.Fatalf("signature not at 400: %x", cert.Raw[400:402])
+	}
+}
+
+func TestSoftToken(t *testing.T) {
+	s, err := NewSoftToken(DefaultSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := s.EnumerateTokens()
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("expected one token, got %v %v", tokens, err)
+	}
+	token := tokens[0]
+
+	s.SetPIN("000000")
+	_, _, _, err = s.GetSigner(token)
+	var pinErr *PINError
+	if !errors.As(err, &pinErr) || pinErr.Err != ErrWrongPIN || !pinErr.Status.CountLow {
+		t.Fatalf("expected wrong PIN, got %v", err)
+	}
+	s.SetPIN(SoftTokenPIN)
+	_, pub, priv, err := s.GetSigner(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	digest := make([]byte, 32)
+	sig, err := priv.Sign(nil, digest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(pub, digest, sig) {
+		t.Fatal("signature not verified")
+	}
+
+	s.SetPIN("000000")
+	for i := 0; i < softTokenTries; i++ {
+		_, _, _, err = s.GetSigner(token)
+	}
+	if !errors.Is(err, ErrPINLocked) {
+		t.Fatalf("expected locked PIN, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := <-events; e.Type != TokenInserted {
+		t.Fatalf("expected insertion, got %v", e.Type)
+	}
+	s.Remove()
+	if e := <-events; e.Type != TokenRemoved {
+		t.Fatalf("expected removal, got %v", e.Type)
+	}
+	if _, _, _, err := s.GetSigner(token); err == nil {
+		t.Fatal("signed with the card removed")
+	}
+}
+
+// TestSoftTokenConcurrent enumerates, watches and signs from several
+// goroutines like the bridge sessions do, run it with -race.
+func TestSoftTokenConcurrent(t *testing.T) {
+	s, err := NewSoftToken(DefaultSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetPIN(SoftTokenPIN)
+	ctx, cancel := context.WithCancel(context.Background())
+	events, err := s.Watch(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := s.EnumerateTokens()
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("expected one token, got %v %v", tokens, err)
+	}
+	token := tokens[0]
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := s.EnumerateTokens(); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := s.PINStatus(token); err != nil {
+					errs <- err
+					return
+				}
+				s.SetPIN(SoftTokenPIN)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			src := Identities(s, token)
+			defer src.Close()
+			for j := 0; j < 20; j++ {
+				certs, err := src.Certificates(ctx)
+				if err != nil {
+					errs <- err
+					return
+				}
+				signer, err := src.Signer(ctx, certs[0])
+				if err != nil {
+					errs <- err
+					return
+				}
+				digest := sha256.Sum256([]byte{byte(i), byte(j)})
+				sig, err := signer.Sign(nil, digest[:], nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !ecdsa.VerifyASN1(signer.Public().(*ecdsa.PublicKey), digest[:], sig) {
+					errs <- errors.New("signature does not verify")
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,202 @@
+package cards_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ritave/eIDAS-bridge/snark/cards"
+	"github.com/ritave/eIDAS-bridge/snark/cards/cardstest"
+)
+
+func TestSoftHSM(t *testing.T) {
+	hsm := cardstest.SoftHSM(t)
+	ctx := cards.New(hsm.Path, cardstest.PIN)
+	info, err := ctx.Module()
+	if err != nil || info.Path != hsm.Path || !strings.Contains(info.Manufacturer, "SoftHSM") {
+		t.Fatalf("unexpected module %+v %v", info, err)
+	}
+	tokens, err := ctx.EnumerateTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens = ctx.FilterTokens(cardstest.Label, tokens)
+	if len(tokens) != 1 {
+		t.Fatalf("expected the test token, got %v", tokens)
+	}
+	token := tokens[0]
+
+	fp := cards.Fingerprint(hsm.Cert)
+	selected, err := ctx.Select(&cards.Selector{Fingerprint: fp}, tokens)
+	if err != nil || len(selected) != 1 {
+		t.Fatalf("select by fingerprint: %v %v", selected, err)
+	}
+	keys, err := ctx.Keys(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || string(keys[0].ID) != cardstest.KeyID || !bytes.Equal(keys[0].Certificate.Raw, hsm.Cert.Raw) {
+		t.Fatalf("unexpected keys %+v", keys)
+	}
+
+	cert, pub, signer, err := ctx.GetSigner(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cert.Raw, hsm.Cert.Raw) || !pub.Equal(&hsm.Key.PublicKey) {
+		t.Fatal("signer does not match the imported key")
+	}
+	digest := sha256.Sum256([]byte("test msg"))
+	sig, err := signer.Sign(nil, digest[:], nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		t.Fatal("signature does not verify")
+	}
+	if err := ctx.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	src := cards.Identities(ctx, token)
+	certs, err := src.Certificates(context.Background())
+	if err != nil || len(certs) != 1 || !certs[0].Equal(hsm.Cert) {
+		t.Fatalf("unexpected certificates %v %v", certs, err)
+	}
+	signer, err = src.Signer(context.Background(), certs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sig, err = signer.Sign(nil, digest[:], nil); err != nil || !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		t.Fatalf("identity signature does not verify: %v", err)
+	}
+
+	// the session logged in with the right PIN is not reused for another
+	ctx.SetPIN("000000")
+	_, _, _, err = ctx.GetSigner(token)
+	var perr *cards.PINError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected a PIN error, got %v", err)
+	}
+	if _, err := signer.Sign(nil, digest[:], nil); err == nil {
+		t.Fatal("signed after the PIN changed")
+	}
+	if err := src.Close(); err != nil {
+		t.Fatal(err)
+	}
+	status, err := ctx.PINStatus(token)
+	if err != nil || !status.CountLow {
+		t.Fatalf("expected a low count, got %+v %v", status, err)
+	}
+}
+
+func TestSoftHSMWatch(t *testing.T) {
+	hsm := cardstest.SoftHSM(t)
+	ctx := cards.New(hsm.Path, cardstest.PIN)
+	c, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	events, err := ctx.Watch(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		select {
+		case e := <-events:
+			if e.Type == cards.TokenInserted && e.Token.Label == cardstest.Label {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("no insertion of the test token")
+		}
+	}
+}
+
+// TestSoftHSMConcurrent enumerates, watches and signs from several goroutines
+// on the shared library handle.
+func TestSoftHSMConcurrent(t *testing.T) {
+	hsm := cardstest.SoftHSM(t)
+	ctx := cards.New(hsm.Path, cardstest.PIN)
+	c, cancel := context.WithCancel(context.Background())
+	events, err := ctx.Watch(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := ctx.EnumerateTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens = ctx.FilterTokens(cardstest.Label, tokens)
+	if len(tokens) != 1 {
+		t.Fatalf("expected the test token, got %v", tokens)
+	}
+	token := tokens[0]
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				if _, err := ctx.EnumerateTokens(); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := ctx.Keys(token); err != nil {
+					errs <- err
+					return
+				}
+				if _, err := ctx.PINStatus(token); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				_, pub, signer, err := ctx.GetSigner(token)
+				if err != nil {
+					errs <- err
+					return
+				}
+				digest := sha256.Sum256([]byte{byte(i), byte(j)})
+				sig, err := signer.Sign(nil, digest[:], nil)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+					errs <- errors.New("signature does not verify")
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	_, _, signer, err := ctx.GetSigner(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ctx.Close(); err != nil {
+		t.Fatal(err)
+	}
+	digest := sha256.Sum256([]byte("closed"))
+	if _, err := signer.Sign(nil, digest[:], nil); err == nil {
+		t.Fatal("signed after Close")
+	}
+	cancel()
+	for range events {
+	}
+}
@@ -0,0 +1,159 @@
+package cards
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// watchPoll is the interval of the rescans when the library does not support
+// C_WaitForSlotEvent. watchRetry spaces the waits which returned without a
+// change, so a library failing them is not called in a busy loop. A wait
+// which returns sooner than watchRetry without a change is taken as
+// CKR_FUNCTION_NOT_SUPPORTED, which the pkcs11 package does not return.
+var (
+	watchPoll  = 1 * time.Second
+	watchRetry = 100 * time.Millisecond
+)
+
+type EventType int
+
+const (
+	TokenInserted EventType = iota
+	TokenRemoved
+)
+
+func (t EventType) String() string {
+	switch t {
+	case TokenInserted:
+		return "inserted"
+	case TokenRemoved:
+		return "removed"
+	default:
+		return "unknown"
+	}
+}
+
+// Event is a token inserted into or removed from a slot. Token is the state
+// when it was inserted.
+type Event struct {
+	Type  EventType
+	Token *Token
+}
+
+// Watch emits an inserted event for every present token and then an event
+// for every change, until c is cancelled and the channel is closed. It waits
+// with C_WaitForSlotEvent and rescans every second once the library turns
+// out not to support it. The watch shares the library with the signers, so a
+// token removed while signing is reported right away.
+func (ctx *Config) Watch(c context.Context) (<-chan Event, error) {
+	p, err := ctx.acquire()
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan Event)
+	go func() {
+		defer close(ch)
+		defer ctx.release()
+		w := &watcher{ctx: ctx, c: c, ch: ch, present: make(map[uint]*Token)}
+		w.run(p)
+	}()
+	return ch, nil
+}
+
+type watcher struct {
+	ctx     *Config
+	c       context.Context
+	ch      chan<- Event
+	present map[uint]*Token
+	// poll is set when the library does not support C_WaitForSlotEvent
+	poll bool
+	// waited is when the last wait started
+	waited time.Time
+}
+
+// run watches the slots until the watch is cancelled.
+func (w *watcher) run(p *pkcs11.Ctx) {
+	var wait <-chan pkcs11.SlotEvent
+	for {
+		tokens, err := enumerate(p)
+		changed := false
+		if err == nil {
+			changed = w.update(tokens)
+		}
+		var tick <-chan time.Time
+		switch {
+		case w.poll:
+			tick = time.After(watchPoll)
+		case wait != nil && !changed:
+			// an event of another kind, or an error
+			w.ctx.forgetWait(wait)
+			wait = nil
+			if time.Since(w.waited) < watchRetry {
+				w.poll = true
+				tick = time.After(watchPoll)
+			} else {
+				tick = time.After(watchRetry)
+			}
+		default:
+			if wait != nil {
+				w.ctx.forgetWait(wait)
+			}
+			wait = w.ctx.waitSlotEvent(p)
+			w.waited = time.Now()
+		}
+		select {
+		case <-wait:
+		case <-tick:
+		case <-w.c.Done():
+			return
+		}
+	}
+}
+
+// update emits the difference between the present tokens and tokens, it
+// returns whether there was any.
+func (w *watcher) update(tokens []*Token) bool {
+	events := diff(w.present, tokens)
+	for _, e := range events {
+		select {
+		case w.ch <- e:
+		case <-w.c.Done():
+			return true
+		}
+	}
+	return len(events) > 0
+}
+
+// diff updates present to tokens and returns the events. A token whose
+// serial changed in the same slot was replaced.
+func diff(present map[uint]*Token, tokens []*Token) []Event {
+	var ret []Event
+	seen := make(map[uint]bool)
+	for _, t := range tokens {
+		seen[t.Slot] = true
+		old, ok := present[t.Slot]
+		if ok && old.Serial == t.Serial && old.Label == t.Label {
+			continue
+		}
+		if ok {
+			ret = append(ret, Event{Type: TokenRemoved, Token: old})
+		}
+		present[t.Slot] = t
+		ret = append(ret, Event{Type: TokenInserted, Token: t})
+	}
+	var removed []uint
+	for slot := range present {
+		if !seen[slot] {
+			removed = append(removed, slot)
+		}
+	}
+	sort.Slice(removed, func(i, j int) bool { return removed[i] < removed[j] })
+	for _, slot := range removed {
+		ret = append(ret, Event{Type: TokenRemoved, Token: present[slot]})
+		delete(present, slot)
+	}
+	return ret
+}
@@ -0,0 +1,33 @@
+package cards
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	present := make(map[uint]*Token)
+	format := func(events []Event) string {
+		var ret string
+		for _, e := range events {
+			ret += fmt.Sprintf("%s %d %s;", e.Type, e.Token.Slot, e.Token.Serial)
+		}
+		return ret
+	}
+	steps := []struct {
+		tokens []*Token
+		want   string
+	}{
+		{[]*Token{{Slot: 0, Serial: "a"}, {Slot: 2, Serial: "b"}}, "inserted 0 a;inserted 2 b;"},
+		{[]*Token{{Slot: 0, Serial: "a"}, {Slot: 2, Serial: "b"}}, ""},
+		{[]*Token{{Slot: 2, Serial: "b"}}, "removed 0 a;"},
+		// replaced between two scans
+		{[]*Token{{Slot: 2, Serial: "c"}}, "removed 2 b;inserted 2 c;"},
+		{nil, "removed 2 c;"},
+	}
+	for i, step := range steps {
+		if got := format(diff(present, step.tokens)); got != step.want {
+			t.Fatalf("step %d: got %q, expected %q", i, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Package ceremony implements the phase-2 (circuit specific) multi-party
+// trusted setup for the Groth16 keys. Phase 1 (Powers of Tau) is taken as an
+// input, every participant contributes their own randomness to phase 2 and
+// the keys are extracted from the final contribution. As long as a single
+// participant destroys their randomness, nobody knows the toxic waste.
+//
+// The MPC setup does not support Pedersen commitments, so the circuit has to
+// be compiled with NewBuilder which hides the commitment capability from the
+// gadgets and makes them fall back to plain range checks.
+package ceremony
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/fft"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/groth16/bn254/mpcsetup"
+	"github.com/consensys/gnark/constraint"
+	cs "github.com/consensys/gnark/constraint/bn254"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+)
+
+var (
+	ErrUnsupportedCS   = errors.New("constraint system is not a BN254 R1CS")
+	ErrCommitment      = errors.New("circuits with commitments are not supported by the MPC setup")
+	ErrPowersMismatch  = errors.New("powers of tau size does not match constraint system domain")
+	ErrInitMismatch    = errors.New("not derived from the powers of tau and the constraint system")
+	ErrCircuitMismatch = errors.New("constraint system is not the one of the circuit")
+)
+
+// kvStore mirrors the internal gnark key-value store interface which the
+// gadgets use for sharing state during compilation.
+type kvStore interface {
+	SetKeyValue(key, value any)
+	GetKeyValue(key any) (value any)
+}
+
+// builder embeds only frontend.Builder and the key-value store so that the
+// gadgets do not see the frontend.Committer implemented by the underlying
+// R1CS builder.
+type builder struct {
+	frontend.Builder
+	kvStore
+}
+
+// NewBuilder returns an R1CS builder which does not create commitments.
+func NewBuilder(field *big.Int, config frontend.CompileConfig) (frontend.Builder, error) {
+	b, err := r1cs.NewBuilder(field, config)
+	if err != nil {
+		return nil, err
+	}
+	kv, ok := b.(kvStore)
+	if !ok {
+		return nil, fmt.Errorf("builder does not implement key-value store")
+	}
+	return builder{b, kv}, nil
+}
+
+// Compile compiles the circuit over BN254 with NewBuilder.
+func Compile(circuit frontend.Circuit) (constraint.ConstraintSystem, error) {
+	return frontend.Compile(ecc.BN254.ScalarField(), NewBuilder, circuit)
+}
+
+// CheckCircuit compiles the circuit again and fails with ErrCircuitMismatch
+// unless ccs is its constraint system. The constraint system next to a
+// transcript comes from whoever ran Init, so it is not trusted.
+func CheckCircuit(ccs constraint.ConstraintSystem, circuit frontend.Circuit) error {
+	want, err := Compile(circuit)
+	if err != nil {
+		return fmt.Errorf("compile: %w", err)
+	}
+	if same, err := equal(want, ccs); err != nil || !same {
+		return errOr(err, ErrCircuitMismatch)
+	}
+	return nil
+}
+
+// Init prepares the initial phase-2 contribution and the circuit evaluations
+// from the Powers of Tau. The evaluations are not changed by contributions
+// but are needed again in Finalise.
+func Init(ccs constraint.ConstraintSystem, ptau *mpcsetup.Phase1) (*mpcsetup.Phase2, *mpcsetup.Phase2Evaluations, error) {
+	r1cs, err := toR1CS(ccs)
+	if err != nil {
+		return nil, nil, err
+	}
+	domain := fft.NewDomain(uint64(r1cs.GetNbConstraints()))
+	if uint64(len(ptau.Parameters.G1.AlphaTau)) != domain.Cardinality {
+		return nil, nil, fmt.Errorf("%w: have %d, need %d", ErrPowersMismatch, len(ptau.Parameters.G1.AlphaTau), domain.Cardinality)
+	}
+	phase2, evals := mpcsetup.InitPhase2(r1cs, ptau)
+	return &phase2, &evals, nil
+}
+
+// Contribute returns a new contribution on top of prev using fresh randomness.
+// prev is not modified.
+func Contribute(prev *mpcsetup.Phase2) (*mpcsetup.Phase2, error) {
+	next, err := clone(prev)
+	if err != nil {
+		return nil, fmt.Errorf("clone: %w", err)
+	}
+	next.Contribute()
+	return next, nil
+}
+
+// Verify checks that the transcript starts with the output of Init for ccs
+// and ptau, with the same evaluations, and that every contribution is built
+// on top of the previous one. Otherwise the first contribution could come
+// with toxic waste known to whoever made it.
+func Verify(ccs constraint.ConstraintSystem, ptau *mpcsetup.Phase1, evals *mpcsetup.Phase2Evaluations, transcript []*mpcsetup.Phase2) error {
+	if len(transcript) < 2 {
+		return fmt.Errorf("transcript needs at least two contributions")
+	}
+	initial, wantEvals, err := Init(ccs, ptau)
+	if err != nil {
+		return err
+	}
+	if !sameParameters(initial, transcript[0]) {
+		return fmt.Errorf("initial contribution %w", ErrInitMismatch)
+	}
+	if same, err := equal(wantEvals, evals); err != nil || !same {
+		return fmt.Errorf("evaluations %w", errOr(err, ErrInitMismatch))
+	}
+	if err := mpcsetup.VerifyPhase2(transcript[0], transcript[1], transcript[2:]...); err != nil {
+		return fmt.Errorf("verify: %w", err)
+	}
+	return nil
+}
+
+// VerifyPhase1 checks the Powers of Tau transcript and returns its last
+// contribution. A single contribution is accepted only when its hash is the
+// published one, hash is ignored otherwise.
+func VerifyPhase1(transcript []*mpcsetup.Phase1, hash []byte) (*mpcsetup.Phase1, error) {
+	if len(transcript) == 0 {
+		return nil, errors.New("no powers of tau")
+	}
+	last := transcript[len(transcript)-1]
+	if len(transcript) == 1 {
+		if len(hash) == 0 {
+			return nil, errors.New("a single powers of tau needs its published hash")
+		}
+		if !bytes.Equal(last.Hash, hash) {
+			return nil, fmt.Errorf("powers of tau hash %x is not %x", last.Hash, hash)
+		}
+		return last, nil
+	}
+	if err := mpcsetup.VerifyPhase1(transcript[0], transcript[1], transcript[2:]...); err != nil {
+		return nil, fmt.Errorf("verify powers of tau: %w", err)
+	}
+	return last, nil
+}
+
+// Finalise verifies the transcript and extracts the proving and verifying
+// keys from its last contribution.
+func Finalise(ccs constraint.ConstraintSystem, ptau *mpcsetup.Phase1, evals *mpcsetup.Phase2Evaluations, transcript []*mpcsetup.Phase2) (groth16.ProvingKey, groth16.VerifyingKey, error) {
+	if err := Verify(ccs, ptau, evals, transcript); err != nil {
+		return nil, nil, err
+	}
+	r1cs, err := toR1CS(ccs)
+	if err != nil {
+		return nil, nil, err
+	}
+	pk, vk := mpcsetup.ExtractKeys(ptau, transcript[len(transcript)-1], evals, r1cs.GetNbConstraints())
+	return &pk, &vk, nil
+}
+
+func toR1CS(ccs constraint.ConstraintSystem) (*cs.R1CS, error) {
+	r1cs, ok := ccs.(*cs.R1CS)
+	if !ok {
+		return nil, ErrUnsupportedCS
+	}
+	if r1cs.CommitmentInfo.Is() {
+		return nil, ErrCommitment
+	}
+	return r1cs, nil
+}
+
+// sameParameters compares the keys of the contributions. The public key of
+// the initial δ = 1 is randomised, so whole contributions of Init differ.
+func sameParameters(a, b *mpcsetup.Phase2) bool {
+	pa, pb := &a.Parameters, &b.Parameters
+	if !pa.G1.Delta.Equal(&pb.G1.Delta) || !pa.G2.Delta.Equal(&pb.G2.Delta) ||
+		len(pa.G1.L) != len(pb.G1.L) || len(pa.G1.Z) != len(pb.G1.Z) {
+		return false
+	}
+	for i := range pa.G1.L {
+		if !pa.G1.L[i].Equal(&pb.G1.L[i]) {
+			return false
+		}
+	}
+	for i := range pa.G1.Z {
+		if !pa.G1.Z[i].Equal(&pb.G1.Z[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// equal compares the serialisations of a and b.
+func equal(a, b io.WriterTo) (bool, error) {
+	var ba, bb bytes.Buffer
+	if _, err := a.WriteTo(&ba); err != nil {
+		return false, err
+	}
+	if _, err := b.WriteTo(&bb); err != nil {
+		return false, err
+	}
+	return bytes.Equal(ba.Bytes(), bb.Bytes()), nil
+}
+
+func errOr(err, otherwise error) error {
+	if err != nil {
+		return err
+	}
+	return otherwise
+}
+
+func clone(c *mpcsetup.Phase2) (*mpcsetup.Phase2, error) {
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		return nil, err
+	}
+	var ret mpcsetup.Phase2
+	if _, err := ret.ReadFrom(&buf); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+// ReadPhase1 reads Powers of Tau in gnark mpcsetup format.
+func ReadPhase1(name string) (*mpcsetup.Phase1, error) {
+	var ret mpcsetup.Phase1
+	if err := readFile(name, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func ReadPhase2(name string) (*mpcsetup.Phase2, error) {
+	var ret mpcsetup.Phase2
+	if err := readFile(name, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func ReadEvaluations(name string) (*mpcsetup.Phase2Evaluations, error) {
+	var ret mpcsetup.Phase2Evaluations
+	if err := readFile(name, &ret); err != nil {
+		return nil, err
+	}
+	return &ret, nil
+}
+
+func readFile(name string, obj io.ReaderFrom) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return fmt.Errorf("open: %w", err)
+	}
+	defer f.Close()
+	if _, err := obj.ReadFrom(f); err != nil {
+		return fmt.Errorf("read %s: %w", name, err)
+	}
+	return nil
+}
+
+// WriteFile writes any of the ceremony objects to name.
+func WriteFile(name string, obj io.WriterTo) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return fmt.Errorf("create: %w", err)
+	}
+	if _, err := obj.WriteTo(f); err != nil {
+		f.Close()
+		return fmt.Errorf("write %s: %w", name, err)
+	}
+	return f.Close()
+}
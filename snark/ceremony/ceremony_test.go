@@ -0,0 +1,150 @@
+package ceremony
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark-crypto/ecc/bn254/fr/fft"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/groth16/bn254/mpcsetup"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/std/rangecheck"
+)
+
+type rangeCircuit struct {
+	X frontend.Variable
+	Y frontend.Variable `gnark:",public"`
+}
+
+func (c *rangeCircuit) Define(api frontend.API) error {
+	rangecheck.New(api).Check(c.X, 8)
+	api.AssertIsEqual(api.Mul(c.X, c.X), c.Y)
+	return nil
+}
+
+func powerFor(t *testing.T, nbConstraints int) int {
+	card := fft.NewDomain(uint64(nbConstraints)).Cardinality
+	power := 0
+	for 1<<power < card {
+		power++
+	}
+	return power
+}
+
+func TestCommitmentRejected(t *testing.T) {
+	ccs, err := frontend.Compile(ecc.BN254.ScalarField(), r1cs.NewBuilder, &rangeCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ptau := mpcsetup.InitPhase1(powerFor(t, ccs.GetNbConstraints()))
+	if _, _, err := Init(ccs, &ptau); !errors.Is(err, ErrCommitment) {
+		t.Fatalf("expected commitment error, got %v", err)
+	}
+}
+
+// squareCircuit has the inputs of rangeCircuit without the range check.
+type squareCircuit rangeCircuit
+
+func (c *squareCircuit) Define(api frontend.API) error {
+	api.AssertIsEqual(api.Mul(c.X, c.X), c.Y)
+	return nil
+}
+
+func TestCheckCircuit(t *testing.T) {
+	ccs, err := Compile(&rangeCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCircuit(ccs, &rangeCircuit{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckCircuit(ccs, &squareCircuit{}); !errors.Is(err, ErrCircuitMismatch) {
+		t.Fatalf("expected a circuit mismatch, got %v", err)
+	}
+}
+
+func TestCeremony(t *testing.T) {
+	ccs, err := Compile(&rangeCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	power := powerFor(t, ccs.GetNbConstraints())
+	wrong := mpcsetup.InitPhase1(power + 1)
+	if _, _, err := Init(ccs, &wrong); !errors.Is(err, ErrPowersMismatch) {
+		t.Fatalf("expected size mismatch, got %v", err)
+	}
+	first := mpcsetup.InitPhase1(power)
+	var buf bytes.Buffer
+	if _, err := first.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	var ptau mpcsetup.Phase1
+	if _, err := ptau.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	ptau.Contribute()
+	if _, err := VerifyPhase1([]*mpcsetup.Phase1{&ptau}, nil); err == nil {
+		t.Fatal("unpinned powers of tau accepted")
+	}
+	if _, err := VerifyPhase1([]*mpcsetup.Phase1{&ptau}, ptau.Hash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyPhase1([]*mpcsetup.Phase1{&first, &ptau}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	initial, evals, err := Init(ccs, &ptau)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transcript := []*mpcsetup.Phase2{initial}
+	for i := 0; i < 3; i++ {
+		next, err := Contribute(transcript[len(transcript)-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		transcript = append(transcript, next)
+	}
+	if err := Verify(ccs, &ptau, evals, transcript); err != nil {
+		t.Fatal(err)
+	}
+	// skipping a contribution breaks the chain
+	if err := Verify(ccs, &ptau, evals, []*mpcsetup.Phase2{transcript[0], transcript[2]}); err == nil {
+		t.Fatal("broken transcript verified")
+	}
+	// a coordinator starting from their own contribution
+	if err := Verify(ccs, &ptau, evals, transcript[1:]); !errors.Is(err, ErrInitMismatch) {
+		t.Fatalf("expected an initial contribution mismatch, got %v", err)
+	}
+	// evaluations of other powers of tau
+	_, otherEvals, err := Init(ccs, &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(ccs, &ptau, otherEvals, transcript); !errors.Is(err, ErrInitMismatch) {
+		t.Fatalf("expected an evaluations mismatch, got %v", err)
+	}
+
+	pk, vk, err := Finalise(ccs, &ptau, evals, transcript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	witness, err := frontend.NewWitness(&rangeCircuit{X: 7, Y: 49}, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proof, err := groth16.Prove(ccs, pk, witness)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := witness.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := groth16.Verify(proof, vk, public); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -2,80 +2,103 @@ package cert
 
 import (
 	"bytes"
-	"crypto/ecdsa"
-	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"os"
+	"path/filepath"
 	"testing"
 )
 
-func TestVerify(t *testing.T) {
-	bts, err := os.ReadFile("../cert.pem")
-	if err != nil {
-		t.Fatal(err)
-	}
-	d, rest := pem.Decode(bts)
-	if len(rest) != 0 {
-		t.Fatal("rest")
-	}
-	cert, err := x509.ParseCertificate(d.Bytes)
+// corpus are the synthetic certificates of ../testdata/certs, see its README,
+// with the common name of the subject and its offset for AssertSubject.
+var corpus = []struct {
+	name    string
+	subject string
+	offset  int
+}{
+	{"pl-p384", "Nowak, Adam", 134},                           // the soft token certificate
+	{"ee-p384", "TAMM,MARI-LIIS,49001011234", 172},            // Estonian ID card
+	{"be-p384", "Lucas Peeters (Authentication)", 172},        // Belgian eID
+	{"de-p256", "Erika Mustermann", 171},                      // German P-256 key
+	{"es-rsa2048", "GARCIA LOPEZ, JUAN (AUTENTICACIÓN)", 169}, // Spanish DNIe
+}
+
+// readChain returns the certificates of the file, the card certificate first
+// and the root last.
+func readChain(t *testing.T, name string) []*x509.Certificate {
+	data, err := os.ReadFile(filepath.Join("..", "testdata", "certs", name+".pem"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	t.Logf("%x\n", cert.Raw)
-	cp := x509.NewCertPool()
-	cp.AddCert(cert)
-	chains, err := cert.Verify(x509.VerifyOptions{Roots: cp})
-	t.Log(err)
-	t.Log(chains)
-	msg := cert.RawTBSCertificate
-	digest := sha256.Sum256(msg)
-	pub, ok := cert.PublicKey.(*ecdsa.PublicKey)
-	if !ok {
-		t.Fatal("pub")
+	var ret []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		c, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ret = append(ret, c)
 	}
-	if !ecdsa.VerifyASN1(pub, digest[:], cert.Signature) {
-		t.Error("not valid")
+	if len(ret) == 0 || len(bytes.TrimSpace(data)) != 0 {
+		t.Fatal("not a PEM certificate chain")
 	}
+	return ret
+}
 
-	_ = cert
+func TestVerify(t *testing.T) {
+	for _, tc := range corpus {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := readChain(t, tc.name)
+			roots := x509.NewCertPool()
+			roots.AddCert(chain[len(chain)-1])
+			_, err := chain[0].Verify(x509.VerifyOptions{
+				Roots:       roots,
+				CurrentTime: chain[0].NotBefore,
+				KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
 }
 
 func TestMarshalRound(t *testing.T) {
-	bts, err := os.ReadFile("../cert.pem")
-	if err != nil {
-		t.Fatal(err)
-	}
-	d, rest := pem.Decode(bts)
-	if len(rest) != 0 {
-		t.Fatal("rest")
-	}
-	c, err := Unmarshal(d.Bytes)
-	if err != nil {
-		t.Fatal("unmarshal")
-	}
-	dd, err := Marshal(c)
-	if err != nil {
-		t.Fatal("marshal", err)
+	for _, tc := range corpus {
+		t.Run(tc.name, func(t *testing.T) {
+			crt := readChain(t, tc.name)[0]
+			c, err := Unmarshal(crt.Raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dd, err := Marshal(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(dd, crt.Raw) {
+				t.Fatal("not equal")
+			}
+			if !bytes.Equal(c.TBSCertificate.Raw, crt.RawTBSCertificate) {
+				t.Fatal("TBS certificate differs")
+			}
+		})
 	}
-	if !bytes.Equal(dd, d.Bytes) {
-		t.Fatal("not equal")
-	}
-	t.Logf("%x\n", c.TBSCertificate.PublicKey.PublicKey.Bytes)
-	t.Logf("%s\n", c.TBSCertificate.Subject.FullBytes)
 }
 
 func TestAssertSubject(t *testing.T) {
-	bts, err := os.ReadFile("../cert.pem")
-	if err != nil {
-		t.Fatal(err)
-	}
-	d, rest := pem.Decode(bts)
-	if len(rest) != 0 {
-		t.Fatal("rest")
-	}
-	if !AssertSubject(d.Bytes, "PN:11223344", 134) {
-		t.Fatal("not subject")
+	for _, tc := range corpus {
+		t.Run(tc.name, func(t *testing.T) {
+			der := readChain(t, tc.name)[0].Raw
+			if !AssertSubject(der, tc.subject, tc.offset) {
+				t.Fatal("not subject")
+			}
+			if AssertSubject(der, tc.subject, tc.offset+1) {
+				t.Fatal("subject at the next offset")
+			}
+		})
 	}
 }
@@ -0,0 +1,51 @@
+package circuits
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/std/hash/sha2"
+	"github.com/consensys/gnark/std/math/emulated"
+	"github.com/consensys/gnark/std/math/uints"
+	"github.com/ritave/eIDAS-bridge/snark/p384"
+)
+
+// ChallengeSize is the size of the public challenge of FCircuit.
+const ChallengeSize = 32
+
+// Challenge returns the public challenge of FCircuit for a challenge of any
+// length: the challenge zero padded to ChallengeSize bytes, or its SHA-256
+// when it is longer.
+func Challenge(challenge []byte) []byte {
+	if len(challenge) > ChallengeSize {
+		dgst := sha256.Sum256(challenge)
+		return dgst[:]
+	}
+	return append(append([]byte{}, challenge...), make([]byte, ChallengeSize-len(challenge))...)
+}
+
+// ChallengeDigest returns the digest signed by the card for the public
+// challenge, its SHA-256. The circuits hash the challenge the same way.
+//
+// SHA-384 is not supported: the pinned gnark only has a SHA-256 gadget, and
+// its 64-bit words do not constrain the carry of additions, so SHA-512 rounds
+// would need an adder of our own. The card does not hash itself, CKM_ECDSA
+// and the PIV and CSC backends sign the digest the bridge passes, so cards
+// which only offer CKM_ECDSA_SHA384 can not be used. An ECDSA signature over
+// a 32 byte digest is as valid on P-384 as one over 48 bytes, only the
+// collision resistance of the digest is that of SHA-256.
+func ChallengeDigest(public []byte) []byte {
+	dgst := sha256.Sum256(public)
+	return dgst[:]
+}
+
+// HashChallenge returns the SHA-256 of the challenge as the ECDSA message.
+func HashChallenge(api frontend.API, challenge []uints.U8) (*emulated.Element[p384.P384Fr], error) {
+	hasher, err := sha2.New(api)
+	if err != nil {
+		return nil, fmt.Errorf("sha2: %w", err)
+	}
+	hasher.Write(challenge)
+	return BytesToMessage(api, hasher.Sum())
+}
@@ -2,6 +2,7 @@ package circuits
 
 import (
 	"fmt"
+	"math/big"
 
 	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/std/hash/sha2"
@@ -12,28 +13,40 @@ import (
 	"github.com/ritave/eIDAS-bridge/snark/p384"
 )
 
+// The layout of the certificates proved by Circuit, see CertLayout.
+const (
+	CertificateSize = 502
+	TBSSize         = 379
+	SubjectOffset   = 132 // of the subject common name in the TBS certificate
+	SubjectSize     = 11
+	PubkeyOffset    = 197 // of the uncompressed point in the TBS certificate
+	PubkeySize      = 97
+	SignatureOffset = 400 // of the integers r and s in the certificate
+	SignatureSize   = 102
+)
+
 func AssertCertSubjectPubkey(uapi *uints.BinaryField[uints.U32], tbsCertificate []uints.U8, subject []uints.U8, pubkey []uints.U8) error {
-	if len(subject) != 11 {
+	if len(subject) != SubjectSize {
 		return fmt.Errorf("subject length invalid")
 	}
-	if len(pubkey) != 97 {
+	if len(pubkey) != PubkeySize {
 		return fmt.Errorf("pubkey length invalid")
 	}
 	for i := range subject {
-		uapi.ByteAssertEq(tbsCertificate[132+i], subject[i])
+		uapi.ByteAssertEq(tbsCertificate[SubjectOffset+i], subject[i])
 	}
 	for i := range pubkey {
-		uapi.ByteAssertEq(tbsCertificate[197+i], pubkey[i])
+		uapi.ByteAssertEq(tbsCertificate[PubkeyOffset+i], pubkey[i])
 	}
 	return nil
 }
 
 func AssertCertificateSignature(uapi *uints.BinaryField[uints.U32], fullcert []uints.U8, signature []uints.U8) error {
-	if len(signature) != 100 {
+	if len(signature) != SignatureSize {
 		return fmt.Errorf("signature length invalid")
 	}
 	for i := range signature {
-		uapi.ByteAssertEq(fullcert[400+i], signature[i])
+		uapi.ByteAssertEq(fullcert[SignatureOffset+i], signature[i])
 	}
 	return nil
 }
@@ -96,8 +109,12 @@ func BytesToMessage(api frontend.API, dgst []uints.U8) (*emulated.Element[p384.P
 	return m, nil
 }
 
+// SignatureToBytes returns the DER integers r and s of the signature as they
+// appear in the certificate: 02 31 00 R 02 31 00 S, R and S big-endian with
+// the high bit set. Earlier versions wrote 02 31 R, which is one byte short
+// of the announced length, and took the bytes of R and S little-endian, so
+// no DER signature matched.
 func SignatureToBytes(api frontend.API, signature *ecdsa.Signature[p384.P384Fr]) ([]uints.U8, error) {
-	// 02 31 R 02 31 S
 	efr, err := emulated.NewField[p384.P384Fr](api)
 	if err != nil {
 		return nil, fmt.Errorf("field %w", err)
@@ -108,34 +125,54 @@ func SignatureToBytes(api frontend.API, signature *ecdsa.Signature[p384.P384Fr])
 	}
 	rbits := efr.ToBits(&signature.R)
 	sbits := efr.ToBits(&signature.S)
-	res := make([]uints.U8, 4+2*48)
-	res[0] = uints.NewU8(0x02)
-	res[1] = uints.NewU8(0x31)
-	res[50] = uints.NewU8(0x02)
-	res[51] = uints.NewU8(0x31)
+	res := make([]uints.U8, 2*(3+48))
+	for _, off := range []int{0, 51} {
+		res[off] = uints.NewU8(0x02)
+		res[off+1] = uints.NewU8(0x31)
+		res[off+2] = uints.NewU8(0x00)
+	}
 	for i := 0; i < 48; i++ {
-		rbt := bits.FromBinary(api, rbits[i*8:(i+1)*8], bits.WithUnconstrainedInputs())
-		res[2+i] = uapi.ByteValueOf(rbt)
-		sbt := bits.FromBinary(api, sbits[i*8:(i+1)*8], bits.WithUnconstrainedInputs())
-		res[50+i] = uapi.ByteValueOf(sbt)
+		// ToBits is little-endian
+		j := 47 - i
+		rbt := bits.FromBinary(api, rbits[j*8:(j+1)*8], bits.WithUnconstrainedInputs())
+		res[3+i] = uapi.ByteValueOf(rbt)
+		sbt := bits.FromBinary(api, sbits[j*8:(j+1)*8], bits.WithUnconstrainedInputs())
+		res[54+i] = uapi.ByteValueOf(sbt)
 	}
 	return res, nil
 }
 
+// AssertLowS asserts that s of the signature is at most (N-1)/2. Both (r, s)
+// and (r, N-s) verify, so without it a card signature gives two proofs.
+func AssertLowS(api frontend.API, signature *ecdsa.Signature[p384.P384Fr]) error {
+	f, err := emulated.NewField[p384.P384Fr](api)
+	if err != nil {
+		return err
+	}
+	half := new(big.Int).Rsh(p384.P384Fr{}.Modulus(), 1)
+	f.AssertIsLessOrEqual(&signature.S, f.NewElement(half))
+	return nil
+}
+
+// CircuitVersion is increased on every change of Circuit which requires a new
+// setup, like FCircuitVersion. Version 2 reads the certificate signature as
+// DER encodes it, see SignatureToBytes.
+const CircuitVersion = 2
+
 type Circuit struct {
-	Challenge [16]uints.U8 // signed by the smart card. Used by the smart contract to ensure liveness
-	Subject   [11]uints.U8 // this is used in smart contract to mint identity NFT
+	Challenge [16]uints.U8          // signed by the smart card. Used by the smart contract to ensure liveness
+	Subject   [SubjectSize]uints.U8 // this is used in smart contract to mint identity NFT
 
 	ChallengeSignature ecdsa.Signature[p384.P384Fr] `gnark:",secret"`
 
-	Certificate    [502]uints.U8 `gnark:",secret"` // full certificate with signature
-	TBSCertificate [379]uints.U8 `gnark:",secret"` // only the CSR part of the certificate for digest
+	Certificate    [CertificateSize]uints.U8 `gnark:",secret"` // full certificate with signature
+	TBSCertificate [TBSSize]uints.U8         `gnark:",secret"` // only the CSR part of the certificate for digest
 
 	// these we could theoretically parse from the certificate using hints
 	// in-circuit but until gnark doesn't provide hints for byte arrays do
 	// externally and only validate correctness.
-	SubjectPubkey [97]uints.U8 `gnark:",secret"`
-	IssuerPubKey  [97]uints.U8 `gnark:",secret"` // right now self-signed
+	SubjectPubkey [PubkeySize]uints.U8 `gnark:",secret"`
+	IssuerPubKey  [PubkeySize]uints.U8 `gnark:",secret"` // right now self-signed
 
 	CertificateSignature ecdsa.Signature[p384.P384Fr] `gnark:",secret"`
 }
@@ -181,27 +218,37 @@ func (c *Circuit) Define(api frontend.API) error {
 	if err != nil {
 		return fmt.Errorf("subkey: %w", err)
 	}
-	// 7. check that Challenge verifies with SubjectPubKey and ChallengeSignature
-	challengeS, err := BytesToMessage(api, c.Challenge[:])
+	// 7. check that the SHA-256 of Challenge verifies with SubjectPubKey and
+	// ChallengeSignature
+	challengeS, err := HashChallenge(api, c.Challenge[:])
 	if err != nil {
 		return fmt.Errorf("challenge: %w", err)
 	}
 	subKey.Verify(api, p384.GetP384Params(), challengeS, &c.ChallengeSignature)
-	return nil
+	// 8. check that ChallengeSignature is in the low-S form
+	return AssertLowS(api, &c.ChallengeSignature)
 }
 
+// FCircuitName and FCircuitVersion are recorded in the artifact manifest. The
+// version has to be increased on every change of FCircuit which requires a
+// new setup.
+const (
+	FCircuitName    = "FCircuit"
+	FCircuitVersion = 3
+)
+
 // for MVP
 type FCircuit struct {
 	ChallengeSignature ecdsa.Signature[p384.P384Fr]              `gnark:",secret"`
 	SubjectPubkey      ecdsa.PublicKey[p384.P384Fp, p384.P384Fr] `gnark:",secret"`
-	Challenge          [32]uints.U8                              `gnark:",public"` // signed by the smart card. Used by the smart contract to ensure liveness
+	Challenge          [ChallengeSize]uints.U8                   `gnark:",public"` // hashed and signed by the smart card. Used by the smart contract to ensure liveness
 }
 
 func (c *FCircuit) Define(api frontend.API) error {
-	challengeS, err := BytesToMessage(api, c.Challenge[:])
+	challengeS, err := HashChallenge(api, c.Challenge[:])
 	if err != nil {
 		return fmt.Errorf("challenge: %w", err)
 	}
 	c.SubjectPubkey.Verify(api, p384.GetP384Params(), challengeS, &c.ChallengeSignature)
-	return nil
+	return AssertLowS(api, &c.ChallengeSignature)
 }
@@ -1,24 +1,31 @@
 package circuits
 
 import (
+	"bytes"
+	"context"
 	"crypto"
 	stdecdsa "crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
 	"crypto/x509"
+	"errors"
 	"math/big"
 	"testing"
 
 	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/frontend"
 	"github.com/consensys/gnark/std/math/emulated"
 	"github.com/consensys/gnark/std/math/uints"
 	"github.com/consensys/gnark/std/signature/ecdsa"
 	"github.com/consensys/gnark/test"
 	"github.com/ritave/eIDAS-bridge/snark/cards"
+	"github.com/ritave/eIDAS-bridge/snark/cards/sig"
 	"github.com/ritave/eIDAS-bridge/snark/cert"
 	"github.com/ritave/eIDAS-bridge/snark/p384"
 )
 
 func TestCircuit(t *testing.T) {
-	challenge := []byte("01234567890abcdef")
+	challenge := []byte("0123456789abcdef")
 	stdcert, _, signer := getSigner(t)
 	crt, err := cert.Unmarshal(stdcert.Raw)
 	if err != nil {
@@ -26,7 +33,7 @@ func TestCircuit(t *testing.T) {
 	}
 	r, s := sign(t, signer, challenge)
 	subject := getSubject(t, stdcert)
-	rr, ss, err := cards.UnmarshalSignature(crt.SignatureValue.Bytes)
+	rr, ss, err := sig.Unmarshal(crt.SignatureValue.Bytes, elliptic.P384())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -56,10 +63,38 @@ func TestCircuit(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+
+	// NewWitness builds the same witness from the stored signature
+	signature, err := sig.Marshal(r, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := NewWitness(stdcert, challenge, signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(marshalWitness(t, witness), marshalWitness(t, stored)) {
+		t.Fatal("NewWitness differs")
+	}
+}
+
+func marshalWitness(t *testing.T, assignment frontend.Circuit) []byte {
+	w, err := frontend.NewWitness(assignment, ecc.BN254.ScalarField())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := w.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
 }
 
 func getSigner(t *testing.T) (*x509.Certificate, *stdecdsa.PublicKey, crypto.Signer) {
-	ctx := cards.New("/opt/homebrew/lib/opensc-pkcs11.so", "123456")
+	ctx, err := cards.FromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
 	t.Log("enumerating smart cards")
 	tokens, err := ctx.EnumerateTokens()
 	if err != nil {
@@ -73,7 +108,20 @@ func getSigner(t *testing.T) (*x509.Certificate, *stdecdsa.PublicKey, crypto.Sig
 		t.Fatal("not one token")
 	}
 	t.Log("chosen token:", tokens[0].Label)
-	cert, pub, priv, err := ctx.GetSigner(tokens[0])
+	src := cards.Identities(ctx, tokens[0])
+	certs, err := src.Certificates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 {
+		t.Fatalf("%d certificates match the key policy", len(certs))
+	}
+	cert := certs[0]
+	pub, ok := cert.PublicKey.(*stdecdsa.PublicKey)
+	if !ok {
+		t.Fatalf("certificate key %T is not ECDSA", cert.PublicKey)
+	}
+	priv, err := src.Signer(context.Background(), cert)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -82,18 +130,20 @@ func getSigner(t *testing.T) (*x509.Certificate, *stdecdsa.PublicKey, crypto.Sig
 	return cert, pub, priv
 }
 
+// sign signs the SHA-256 of the public challenge, the message of the
+// circuits.
 func sign(t *testing.T, signer crypto.Signer, challenge []byte) (r, s *big.Int) {
-	t.Logf("creating signature for challenge: %s", challenge)
-	challenge = append(challenge, make([]byte, 32-len(challenge))...)
-	signature, err := signer.Sign(nil, challenge, nil)
+	t.Logf("creating signature for challenge: %x", challenge)
+	signature, err := signer.Sign(nil, ChallengeDigest(challenge), crypto.SHA256)
 	if err != nil {
 		t.Fatal(err)
 	}
 	t.Logf("signature %x\n", signature)
-	r, s, err = cards.UnmarshalSignature(signature)
+	r, s, err = sig.Unmarshal(signature, elliptic.P384())
 	if err != nil {
 		t.Fatal(err)
 	}
+	s = sig.NormalizeS(elliptic.P384(), s)
 	t.Logf("unmarshalled signature r=%s s=%s\n", r, s)
 	return r, s
 }
@@ -103,12 +153,47 @@ func getSubject(t *testing.T, cert *x509.Certificate) []byte {
 }
 
 func TestFCircuit(t *testing.T) {
-	challenge := []byte("test.eth")
 	_, pub, signer := getSigner(t)
-	r, s := sign(t, signer, challenge)
-	circuit := &FCircuit{}
-	witness := &FCircuit{
-		Challenge: [32]uints.U8(uints.NewU8Array(make([]uint8, 32))),
+	for _, challenge := range []string{"test.eth", "0x7e5f4552091a69125d5dfcb7b8c2659029395bdf, signed at block 17000000"} {
+		public := Challenge([]byte(challenge))
+		r, s := sign(t, signer, public)
+		witness := fcircuitWitness(public, pub, r, s)
+		t.Log("SNARK witness created, solving SNARK")
+		if err := test.IsSolved(&FCircuit{}, witness, ecc.BN254.ScalarField()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the unhashed challenge is no longer the message
+	public := Challenge([]byte("test.eth"))
+	signature, err := signer.Sign(nil, public, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, s, err := sig.Unmarshal(signature, pub.Curve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = sig.NormalizeS(pub.Curve, s)
+	if err := test.IsSolved(&FCircuit{}, fcircuitWitness(public, pub, r, s), ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("signature of the unhashed challenge verified")
+	}
+
+	// the high-S form of a valid signature is rejected
+	public = Challenge([]byte("test.eth"))
+	r, s = sign(t, signer, public)
+	high := new(big.Int).Sub(pub.Curve.Params().N, s)
+	if !stdecdsa.Verify(pub, ChallengeDigest(public), r, high) {
+		t.Fatal("high-S signature does not verify")
+	}
+	if err := test.IsSolved(&FCircuit{}, fcircuitWitness(public, pub, r, high), ecc.BN254.ScalarField()); err == nil {
+		t.Fatal("high-S signature accepted")
+	}
+}
+
+func fcircuitWitness(public []byte, pub *stdecdsa.PublicKey, r, s *big.Int) *FCircuit {
+	return &FCircuit{
+		Challenge: [ChallengeSize]uints.U8(uints.NewU8Array(public)),
 		ChallengeSignature: ecdsa.Signature[p384.P384Fr]{
 			R: emulated.ValueOf[p384.P384Fr](r),
 			S: emulated.ValueOf[p384.P384Fr](s),
@@ -118,10 +203,39 @@ func TestFCircuit(t *testing.T) {
 			Y: emulated.ValueOf[p384.P384Fp](pub.Y),
 		},
 	}
-	copy(witness.Challenge[:], uints.NewU8Array(challenge))
-	t.Log("SNARK witness created, solving SNARK")
-	err := test.IsSolved(circuit, witness, ecc.BN254.ScalarField())
-	if err != nil {
-		t.Fatal(err)
+}
+
+func TestNewFWitness(t *testing.T) {
+	stdcert, pub, signer := getSigner(t)
+	challenge := []byte("test.eth")
+	public := Challenge(challenge)
+	r, s := sign(t, signer, public)
+	// the card may return the high-S form, raw or DER
+	high := new(big.Int).Sub(pub.Curve.Params().N, s)
+	for _, signature := range [][]byte{
+		sig.MarshalRaw(r, s, pub.Curve),
+		sig.MarshalRaw(r, high, pub.Curve),
+	} {
+		w, err := NewFWitness(stdcert, challenge, signature)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(marshalWitness(t, w), marshalWitness(t, fcircuitWitness(public, pub, r, s))) {
+			t.Fatal("unexpected witness")
+		}
+	}
+	signature := sig.MarshalRaw(r, s, pub.Curve)
+	if _, err := NewFWitness(stdcert, []byte("other.eth"), signature); !errors.Is(err, ErrSignature) {
+		t.Fatalf("expected a signature error, got %v", err)
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	if c := Challenge([]byte("test.eth")); len(c) != ChallengeSize || string(c[:8]) != "test.eth" || c[8] != 0 {
+		t.Fatalf("unexpected padded challenge %x", c)
+	}
+	long := []byte("0123456789abcdef0123456789abcdef!")
+	if c, d := Challenge(long), sha256.Sum256(long); !bytes.Equal(c, d[:]) {
+		t.Fatalf("expected the SHA-256 of a long challenge, got %x", c)
 	}
 }
@@ -0,0 +1,92 @@
+package circuits
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/test"
+)
+
+// The challenges signed in ../testdata/certs, see its README.
+const (
+	corpusChallenge  = "0123456789abcdef"
+	corpusFChallenge = "test.eth"
+)
+
+// corpus tells which circuits prove the synthetic certificates of
+// ../testdata/certs.
+var corpus = []struct {
+	name     string
+	circuit  bool
+	fcircuit bool
+}{
+	{"pl-p384", true, true},      // the soft token certificate
+	{"ee-p384", false, true},     // Estonian ID card, raw r || s with high S
+	{"be-p384", false, true},     // Belgian eID, high S
+	{"de-p256", false, false},    // German P-256 key
+	{"es-rsa2048", false, false}, // Spanish DNIe
+}
+
+func readCorpus(t *testing.T, name string) (*x509.Certificate, []byte, []byte) {
+	dir := filepath.Join("..", "testdata", "certs")
+	data, err := os.ReadFile(filepath.Join(dir, name+".pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatal("no PEM certificate")
+	}
+	c, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsig, err := os.ReadFile(filepath.Join(dir, name+".sig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := os.ReadFile(filepath.Join(dir, name+".circuit.sig"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, sig, fsig
+}
+
+func TestCorpus(t *testing.T) {
+	for _, tc := range corpus {
+		t.Run(tc.name, func(t *testing.T) {
+			c, sig, fsig := readCorpus(t, tc.name)
+
+			fw, err := NewFWitness(c, []byte(corpusFChallenge), fsig)
+			if tc.fcircuit != (err == nil) {
+				t.Fatalf("FCircuit witness: %v", err)
+			}
+			if tc.fcircuit {
+				if _, err := NewFWitness(c, []byte(corpusChallenge), fsig); !errors.Is(err, ErrSignature) {
+					t.Fatalf("expected a signature error for another challenge, got %v", err)
+				}
+				solve(t, &FCircuit{}, fw)
+			}
+
+			w, err := NewWitness(c, []byte(corpusChallenge), sig)
+			if tc.circuit != (err == nil) {
+				t.Fatalf("Circuit witness: %v", err)
+			}
+			if tc.circuit {
+				solve(t, &Circuit{}, w)
+			}
+		})
+	}
+}
+
+func solve(t *testing.T, circuit, assignment frontend.Circuit) {
+	if err := test.IsSolved(circuit, assignment, ecc.BN254.ScalarField()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,163 @@
+package circuits
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	encoding_asn1 "encoding/asn1"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/cryptobyte"
+	"golang.org/x/crypto/cryptobyte/asn1"
+)
+
+var oidCommonName = encoding_asn1.ObjectIdentifier{2, 5, 4, 3}
+
+// CertLayout is where the fields proved by Circuit are in a certificate.
+type CertLayout struct {
+	CertificateSize int
+	TBSSize         int
+	SubjectOffset   int // of the subject common name in the TBS certificate, -1 without one
+	SubjectSize     int
+	PubkeyOffset    int // of the public key bits in the TBS certificate
+	PubkeySize      int
+	SignatureOffset int // of the contents of the signature SEQUENCE in the certificate
+	SignatureSize   int
+}
+
+// CircuitLayout is the layout compiled into Circuit.
+var CircuitLayout = CertLayout{
+	CertificateSize: CertificateSize,
+	TBSSize:         TBSSize,
+	SubjectOffset:   SubjectOffset,
+	SubjectSize:     SubjectSize,
+	PubkeyOffset:    PubkeyOffset,
+	PubkeySize:      PubkeySize,
+	SignatureOffset: SignatureOffset,
+	SignatureSize:   SignatureSize,
+}
+
+// LayoutOf returns the layout of a DER certificate with an ECDSA signature.
+func LayoutOf(der []byte) (*CertLayout, error) {
+	// the values read are slices of der, so their offset follows from the
+	// capacity left
+	pos := func(s cryptobyte.String) int { return cap(der) - cap(s) }
+	errInvalid := errors.New("invalid certificate")
+
+	l := &CertLayout{CertificateSize: len(der), SubjectOffset: -1}
+	input := cryptobyte.String(der)
+	var certificate, tbsElement, tbs cryptobyte.String
+	if !input.ReadASN1(&certificate, asn1.SEQUENCE) || !input.Empty() ||
+		!certificate.ReadASN1Element(&tbsElement, asn1.SEQUENCE) {
+		return nil, errInvalid
+	}
+	tbsStart := pos(tbsElement)
+	l.TBSSize = len(tbsElement)
+	if !tbsElement.ReadASN1(&tbs, asn1.SEQUENCE) ||
+		!tbs.SkipOptionalASN1(asn1.Tag(0).Constructed().ContextSpecific()) ||
+		!tbs.SkipASN1(asn1.INTEGER) || // serial number
+		!tbs.SkipASN1(asn1.SEQUENCE) || // signature algorithm
+		!tbs.SkipASN1(asn1.SEQUENCE) || // issuer
+		!tbs.SkipASN1(asn1.SEQUENCE) { // validity
+		return nil, errInvalid
+	}
+
+	var subject cryptobyte.String
+	if !tbs.ReadASN1(&subject, asn1.SEQUENCE) {
+		return nil, errInvalid
+	}
+	for !subject.Empty() {
+		var rdn cryptobyte.String
+		if !subject.ReadASN1(&rdn, asn1.SET) {
+			return nil, errInvalid
+		}
+		for !rdn.Empty() {
+			var atv, value cryptobyte.String
+			var oid encoding_asn1.ObjectIdentifier
+			var tag asn1.Tag
+			if !rdn.ReadASN1(&atv, asn1.SEQUENCE) ||
+				!atv.ReadASN1ObjectIdentifier(&oid) ||
+				!atv.ReadAnyASN1(&value, &tag) {
+				return nil, errInvalid
+			}
+			if oid.Equal(oidCommonName) && l.SubjectOffset < 0 {
+				l.SubjectOffset = pos(value) - tbsStart
+				l.SubjectSize = len(value)
+			}
+		}
+	}
+
+	var spki, key cryptobyte.String
+	if !tbs.ReadASN1(&spki, asn1.SEQUENCE) ||
+		!spki.SkipASN1(asn1.SEQUENCE) ||
+		!spki.ReadASN1(&key, asn1.BIT_STRING) || len(key) < 1 {
+		return nil, errInvalid
+	}
+	// after the count of unused bits
+	l.PubkeyOffset = pos(key) + 1 - tbsStart
+	l.PubkeySize = len(key) - 1
+
+	var signature, sigSeq cryptobyte.String
+	if !certificate.SkipASN1(asn1.SEQUENCE) ||
+		!certificate.ReadASN1(&signature, asn1.BIT_STRING) ||
+		!signature.Skip(1) ||
+		!signature.ReadASN1(&sigSeq, asn1.SEQUENCE) {
+		return nil, errors.New("signature is not ECDSA")
+	}
+	l.SignatureOffset = pos(sigSeq)
+	l.SignatureSize = len(sigSeq)
+	return l, nil
+}
+
+// Mismatches describes how the layout differs from CircuitLayout.
+func (l *CertLayout) Mismatches() []string {
+	var ret []string
+	check := func(name string, got, want int) {
+		if got != want {
+			ret = append(ret, fmt.Sprintf("%s is %d, the circuit expects %d", name, got, want))
+		}
+	}
+	c := CircuitLayout
+	check("certificate size", l.CertificateSize, c.CertificateSize)
+	check("TBS size", l.TBSSize, c.TBSSize)
+	check("subject offset", l.SubjectOffset, c.SubjectOffset)
+	check("subject size", l.SubjectSize, c.SubjectSize)
+	check("public key offset", l.PubkeyOffset, c.PubkeyOffset)
+	check("public key size", l.PubkeySize, c.PubkeySize)
+	check("signature offset", l.SignatureOffset, c.SignatureOffset)
+	check("signature size", l.SignatureSize, c.SignatureSize)
+	return ret
+}
+
+// CheckKey returns why FCircuit cannot prove signatures of the key, nothing
+// when it can.
+func CheckKey(pub crypto.PublicKey) []string {
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return []string{fmt.Sprintf("key %T is not ECDSA", pub)}
+	}
+	if key.Curve != elliptic.P384() {
+		return []string{fmt.Sprintf("curve %s is not P-384", key.Curve.Params().Name)}
+	}
+	return nil
+}
+
+// CheckCertificate returns why Circuit cannot prove the certificate, nothing
+// when it can.
+func CheckCertificate(cert *x509.Certificate) []string {
+	ret := CheckKey(cert.PublicKey)
+	if cert.SignatureAlgorithm != x509.ECDSAWithSHA256 {
+		ret = append(ret, fmt.Sprintf("signature algorithm %s is not ECDSA with SHA-256", cert.SignatureAlgorithm))
+	}
+	// the issuer key is the subject key
+	if err := cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature); err != nil {
+		ret = append(ret, "certificate is not self-signed")
+	}
+	l, err := LayoutOf(cert.Raw)
+	if err != nil {
+		return append(ret, err.Error())
+	}
+	return append(ret, l.Mismatches()...)
+}
@@ -0,0 +1,71 @@
+package circuits
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ritave/eIDAS-bridge/snark/cards"
+)
+
+func TestLayout(t *testing.T) {
+	s, err := cards.NewSoftToken(cards.DefaultSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := LayoutOf(s.Certificate().Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *l != CircuitLayout {
+		t.Fatalf("unexpected layout %+v", l)
+	}
+	if problems := CheckCertificate(s.Certificate()); len(problems) != 0 {
+		t.Fatalf("software token not provable: %v", problems)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Jan Kowalski", Country: []string{"PL"}},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err = LayoutOf(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tbs := cert.RawTBSCertificate
+	if string(tbs[l.SubjectOffset:l.SubjectOffset+l.SubjectSize]) != "Jan Kowalski" {
+		t.Fatalf("subject not at %d", l.SubjectOffset)
+	}
+	if l.PubkeySize != 65 || tbs[l.PubkeyOffset] != 0x04 {
+		t.Fatalf("public key not at %d", l.PubkeyOffset)
+	}
+	if der[l.SignatureOffset] != 0x02 || l.SignatureOffset+l.SignatureSize != len(der) {
+		t.Fatalf("signature not at %d", l.SignatureOffset)
+	}
+	problems := strings.Join(CheckCertificate(cert), "; ")
+	for _, want := range []string{"P-256 is not P-384", "subject size is 12", "public key size is 65"} {
+		if !strings.Contains(problems, want) {
+			t.Errorf("%q missing from %q", want, problems)
+		}
+	}
+}
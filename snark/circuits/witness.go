@@ -0,0 +1,104 @@
+package circuits
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/consensys/gnark/std/math/emulated"
+	"github.com/consensys/gnark/std/math/uints"
+	gnarkecdsa "github.com/consensys/gnark/std/signature/ecdsa"
+	"github.com/ritave/eIDAS-bridge/snark/cards/sig"
+	"github.com/ritave/eIDAS-bridge/snark/cert"
+	"github.com/ritave/eIDAS-bridge/snark/p384"
+)
+
+// ErrSignature is returned by the witness constructors when the signature
+// does not verify, the circuit could not be solved.
+var ErrSignature = errors.New("signature does not verify")
+
+// challengeSignature parses the signature of the card over the SHA-256 of
+// public and checks it, s is returned in the low form the circuits require.
+func challengeSignature(pub *ecdsa.PublicKey, public, signature []byte) (r, s *big.Int, err error) {
+	r, s, err = sig.Unmarshal(signature, pub.Curve)
+	if err != nil {
+		return nil, nil, fmt.Errorf("signature: %w", err)
+	}
+	if !ecdsa.Verify(pub, ChallengeDigest(public), r, s) {
+		return nil, nil, ErrSignature
+	}
+	return r, sig.NormalizeS(pub.Curve, s), nil
+}
+
+func signatureValue(r, s *big.Int) gnarkecdsa.Signature[p384.P384Fr] {
+	return gnarkecdsa.Signature[p384.P384Fr]{
+		R: emulated.ValueOf[p384.P384Fr](r),
+		S: emulated.ValueOf[p384.P384Fr](s),
+	}
+}
+
+// NewFWitness returns the assignment of FCircuit for the challenge as sent
+// to the bridge and the signature of the card over ChallengeDigest of its
+// public challenge, in DER or raw r || s.
+func NewFWitness(c *x509.Certificate, challenge, signature []byte) (*FCircuit, error) {
+	if problems := CheckKey(c.PublicKey); len(problems) != 0 {
+		return nil, fmt.Errorf("certificate: %s", strings.Join(problems, "; "))
+	}
+	pub := c.PublicKey.(*ecdsa.PublicKey)
+	public := Challenge(challenge)
+	r, s, err := challengeSignature(pub, public, signature)
+	if err != nil {
+		return nil, err
+	}
+	return &FCircuit{
+		Challenge:          [ChallengeSize]uints.U8(uints.NewU8Array(public)),
+		ChallengeSignature: signatureValue(r, s),
+		SubjectPubkey: gnarkecdsa.PublicKey[p384.P384Fp, p384.P384Fr]{
+			X: emulated.ValueOf[p384.P384Fp](pub.X),
+			Y: emulated.ValueOf[p384.P384Fp](pub.Y),
+		},
+	}, nil
+}
+
+// NewWitness returns the assignment of Circuit for a self-signed certificate
+// of its layout, the challenge of at most 16 bytes, zero padded, and the
+// signature of the card over the SHA-256 of the padded challenge.
+func NewWitness(c *x509.Certificate, challenge, signature []byte) (*Circuit, error) {
+	var w Circuit
+	if len(challenge) > len(w.Challenge) {
+		return nil, fmt.Errorf("challenge of %d bytes, at most %d", len(challenge), len(w.Challenge))
+	}
+	if problems := CheckCertificate(c); len(problems) != 0 {
+		return nil, fmt.Errorf("certificate: %s", strings.Join(problems, "; "))
+	}
+	public := append(append([]byte{}, challenge...), make([]byte, len(w.Challenge)-len(challenge))...)
+	r, s, err := challengeSignature(c.PublicKey.(*ecdsa.PublicKey), public, signature)
+	if err != nil {
+		return nil, err
+	}
+	crt, err := cert.Unmarshal(c.Raw)
+	if err != nil {
+		return nil, err
+	}
+	// the certificate signature is bound to the certificate bytes, it is
+	// not normalised
+	certR, certS, err := sig.Unmarshal(crt.SignatureValue.Bytes, elliptic.P384())
+	if err != nil {
+		return nil, fmt.Errorf("certificate signature: %w", err)
+	}
+	tbs := c.RawTBSCertificate
+	key := crt.TBSCertificate.PublicKey.PublicKey.Bytes
+	w.Challenge = [16]uints.U8(uints.NewU8Array(public))
+	w.Subject = [SubjectSize]uints.U8(uints.NewU8Array(tbs[SubjectOffset : SubjectOffset+SubjectSize]))
+	w.ChallengeSignature = signatureValue(r, s)
+	w.Certificate = [CertificateSize]uints.U8(uints.NewU8Array(c.Raw))
+	w.TBSCertificate = [TBSSize]uints.U8(uints.NewU8Array(tbs))
+	w.SubjectPubkey = [PubkeySize]uints.U8(uints.NewU8Array(key))
+	w.IssuerPubKey = w.SubjectPubkey // self-signed
+	w.CertificateSignature = signatureValue(certR, certS)
+	return &w, nil
+}
@@ -1,222 +1,396 @@
 package main
 
 import (
-	"bytes"
-	"crypto/sha256"
+	"context"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
-	"math/big"
+	"net/http"
 	"os"
-	"time"
-
-	"github.com/consensys/gnark-crypto/ecc"
-	"github.com/consensys/gnark/backend"
-	"github.com/consensys/gnark/backend/groth16"
-	"github.com/consensys/gnark/constraint/solver"
-	"github.com/consensys/gnark/frontend"
-	"github.com/consensys/gnark/frontend/cs"
+	"path/filepath"
+	"strconv"
+	"sync"
+
 	"github.com/consensys/gnark/logger"
-	"github.com/consensys/gnark/std/math/emulated"
-	"github.com/consensys/gnark/std/math/uints"
-	"github.com/consensys/gnark/std/signature/ecdsa"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
 	"github.com/ritave/eIDAS-bridge/snark/cards"
 	"github.com/ritave/eIDAS-bridge/snark/circuits"
-	"github.com/ritave/eIDAS-bridge/snark/p384"
+	"github.com/ritave/eIDAS-bridge/snark/protocol"
+	"github.com/ritave/eIDAS-bridge/snark/prover"
 )
 
 var libLoc string
 var ccsLoc string
 var pkLoc string
 var vkLoc string
+var srsLoc string
+var manifestLoc string
+var releaseKey string
+var insecure bool
+var backendName string
+var rpcURL string
+var contractAddr string
+var daemon bool
+var listenAddr string
+var origins string
+var tokenSelector string
+var keyPolicy string
+var soft bool
+var pivKey string
+var pivTries int
+var cscURL string
+var certLoc string
+var signatureLoc string
+var challenge string
+var witnessLoc string
 
 func init() {
 	logger.Disable()
 }
 
 func main() {
-	flag.StringVar(&libLoc, "opensc", "/opt/homebrew/lib/opensc-pkcs11.so", "location of opensc library")
-	flag.StringVar(&ccsLoc, "system", "EIDAS.G16.ccs", "location of SNARK circuit")
-	flag.StringVar(&pkLoc, "pkey", "EIDAS.G16.pk", "location of proving key")
-	flag.StringVar(&vkLoc, "vkey", "EIDAS.G16.vk", "location of verifying key")
+	flag.StringVar(&libLoc, "module", "", "location of the PKCS#11 module, or a list separated like $PATH to try in order (default discovered, see cards.Candidates)")
+	flag.StringVar(&libLoc, "opensc", "", "alias of -module")
+	flag.StringVar(&backendName, "backend", string(prover.Groth16), "proving backend, 'groth16' or 'plonk'")
+	flag.StringVar(&ccsLoc, "system", "", "location of SNARK circuit (default EIDAS.G16.ccs or EIDAS.PLONK.ccs)")
+	flag.StringVar(&pkLoc, "pkey", "", "location of proving key (default EIDAS.G16.pk or EIDAS.PLONK.pk)")
+	flag.StringVar(&vkLoc, "vkey", "", "location of verifying key (default EIDAS.G16.vk or EIDAS.PLONK.vk)")
+	flag.StringVar(&srsLoc, "srs", "", "location of KZG SRS, only for plonk (default EIDAS.PLONK.srs)")
+	flag.StringVar(&manifestLoc, "manifest", "", "location of artifact manifest (default EIDAS.G16.manifest.json or EIDAS.PLONK.manifest.json)")
+	flag.StringVar(&releaseKey, "release-key", prover.ReleaseKey, "hex Ed25519 public key the manifest has to be signed with")
+	flag.BoolVar(&insecure, "insecure", false, "accept an unsigned manifest when -release-key is empty, for development")
+	flag.StringVar(&rpcURL, "rpc", "", "Ethereum RPC endpoint for checking the verifier contract")
+	flag.StringVar(&contractAddr, "contract", "", "address of the deployed verifier contract, requires -rpc")
+	flag.BoolVar(&daemon, "daemon", false, "serve sessions with JSON requests on stdin until it is closed")
+	flag.StringVar(&listenAddr, "listen", "", "serve sessions over WebSocket on the address, e.g. localhost:8081")
+	flag.StringVar(&origins, "origins", "http://localhost:3000,http://localhost:8080", "comma separated origins allowed to connect over WebSocket, '*' allows any")
+	flag.StringVar(&tokenSelector, "token", "", "card selector, e.g. 'label=^PIN1' or 'serial=...,fingerprint=<sha256>', the client chooses among several matching cards")
+	flag.StringVar(&keyPolicy, "key", "", "key policy when a card holds several keys, e.g. 'id=01' or 'keyUsage=digitalSignature,notKeyUsage=nonRepudiation' (default)")
+	flag.StringVar(&pivKey, "piv", "", "talk to PIV cards over PC/SC instead of a PKCS#11 module, signing with the key reference, e.g. 9a or 9c (requires the pcsc build tag)")
+	flag.IntVar(&pivTries, "piv-tries", 3, "PIN retry count of a new PIV card, fewer left tell that a wrong PIN was entered, 0 when unknown")
+	flag.StringVar(&cscURL, "csc", "", "sign with a remote Cloud Signature Consortium API v2 service at the base URL, e.g. https://host/csc/v2, with the access token in $EIDAS_CSC_TOKEN")
+	flag.StringVar(&certLoc, "cert", "", "prove offline from the PEM certificate of the card, the -challenge and the card's -signature of it, without a card")
+	flag.StringVar(&signatureLoc, "signature", "", "file with the DER or raw r || s signature of the card over the SHA-256 of the public challenge, for -cert")
+	flag.StringVar(&challenge, "challenge", "", "challenge signed by the card, for -cert")
+	flag.StringVar(&witnessLoc, "witness", "", "also write the witness of -cert in the binary format of gnark to the file")
+	flag.BoolVar(&soft, "soft", false, "use an in-memory software token with PIN "+cards.SoftTokenPIN+" instead of a card, for development")
 	flag.Parse()
-	var tokens []*cards.Token
-	var err error
-	fccs, err := os.Open(ccsLoc)
+	b, err := prover.ParseBackend(backendName)
 	if err != nil {
-		fmt.Println("CCSF", err)
-		return
+		fatal(protocol.WithCode(protocol.BadRequest, err))
 	}
-	defer fccs.Close()
-
-	fpk, err := os.Open(pkLoc)
+	selector, err := cards.ParseSelector(tokenSelector)
 	if err != nil {
-		fmt.Println("PKF", err)
-		return
+		fatal(protocol.WithCode(protocol.BadRequest, err))
 	}
-	defer fpk.Close()
-
-	fvk, err := os.Open(vkLoc)
-	if err != nil {
-		fmt.Println("VKF", err)
-		return
+	// the witness is written even when the artifacts are missing
+	var assignment *circuits.FCircuit
+	if certLoc != "" {
+		if assignment, err = offlineWitness(); err != nil {
+			fatal(err)
+		}
 	}
-	defer fvk.Close()
-
-	ctx := cards.New(libLoc, "")
-
-	for {
-		tokens, err = ctx.EnumerateTokens()
-		_ = err
-		if len(tokens) == 0 {
-			time.Sleep(1 * time.Second)
+	files := prover.DefaultFiles(b, "EIDAS")
+	for _, f := range []struct {
+		loc  *string
+		def  string
+		name string
+	}{
+		{&ccsLoc, files.CCS, "CCSF"},
+		{&pkLoc, files.PK, "PKF"},
+		{&vkLoc, files.VK, "VKF"},
+		{&srsLoc, files.SRS, "SRSF"},
+	} {
+		if *f.loc == "" {
+			*f.loc = f.def
+		}
+		if *f.loc == "" {
 			continue
 		}
-		if len(tokens) > 1 {
-			tokens = ctx.FilterTokens("PIN1", tokens) // TODO: or PIN 1?
+		if _, err := os.Stat(*f.loc); err != nil {
+			fatal(protocol.Errorf(protocol.Artifacts, "%s: %w", f.name, err))
 		}
-		if len(tokens) == 1 {
-			break
+	}
+	if manifestLoc == "" {
+		manifestLoc = files.Manifest
+	}
+	files = prover.Files{CCS: ccsLoc, PK: pkLoc, VK: vkLoc, SRS: srsLoc}
+	if assignment != nil {
+		manifest, err := readManifest(manifestLoc)
+		if err != nil {
+			fatal(keyError(err))
+		}
+		if err := offline(b, files, manifest, assignment); err != nil {
+			fatal(err)
 		}
+		return
 	}
-	fmt.Println("{ \"id\": \"INSERTED\" }")
-	pin := ""
-	_, err = fmt.Scanln(&pin)
+	src, module, err := tokens()
 	if err != nil {
-		fmt.Println(err)
+		fatal(protocol.WithCode(protocol.BadRequest, err))
+	}
+	var contractCode []byte
+	if contractAddr != "" {
+		if b == prover.Plonk {
+			fatal(protocol.WithCode(protocol.BadRequest, fmt.Errorf("-contract: %w", prover.ErrOffChain)))
+		}
+		contractCode, err = getContractCode(rpcURL, contractAddr)
+		if err != nil {
+			fatal(fmt.Errorf("contract: %w", err))
+		}
+	}
+	br := newBridge(b, src)
+	br.module = module
+	br.selector = selector
+	br.subscribe(send)
+	if err := br.watch(context.Background()); err != nil {
+		fatal(err)
+	}
+	br.load(files, manifestLoc, contractCode)
+
+	if listenAddr != "" {
+		if err := http.ListenAndServe(listenAddr, newWSHandler(br, parseOrigins(origins))); err != nil {
+			fatal(err)
+		}
 		return
 	}
-	challenge := ""
-	_, err = fmt.Scanln(&challenge)
-	if err != nil {
-		fmt.Println(err)
+	send(br.hello())
+	if daemon {
+		if err := serveLines(br, os.Stdin, send); err != nil {
+			fatal(err)
+		}
 		return
 	}
-	ctx.SetPIN(pin)
-	_, pub, priv, err := ctx.GetSigner(tokens[0])
+	// single session, the PIN and challenge are read as lines from stdin
+	s := &session{bridge: br, send: send, request: make(chan protocol.Request, 1)}
+	go func() {
+		pin := ""
+		if _, err := fmt.Scanln(&pin); err != nil {
+			fatal(protocol.Errorf(protocol.BadRequest, "read pin: %w", err))
+		}
+		challenge := ""
+		if _, err := fmt.Scanln(&challenge); err != nil {
+			fatal(protocol.Errorf(protocol.BadRequest, "read challenge: %w", err))
+		}
+		s.request <- protocol.Request{ID: protocol.Sign, PIN: pin, Challenge: challenge}
+	}()
+	if err := s.run(context.Background()); err != nil {
+		fatal(err)
+	}
+}
+
+// offlineWitness returns the assignment of -cert, -challenge and -signature
+// and writes its witness to -witness.
+func offlineWitness() (*circuits.FCircuit, error) {
+	assignment, err := readWitness(certLoc, signatureLoc, challenge)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, protocol.WithCode(protocol.BadRequest, err)
+	}
+	if witnessLoc != "" {
+		if err := prover.WriteWitness(witnessLoc, assignment); err != nil {
+			return nil, fmt.Errorf("witness: %w", err)
+		}
+	}
+	return assignment, nil
+}
+
+// offline proves the assignment of a stored signature and prints the proof
+// as GENERATED.
+func offline(b prover.Backend, files prover.Files, manifest *prover.Manifest, assignment *circuits.FCircuit) error {
+	keys, err := prover.Read(b, files, &circuits.FCircuit{}, prover.WithManifest(manifest))
+	if err == nil {
+		err = manifest.CheckKeys(circuits.FCircuitName, circuits.FCircuitVersion, keys)
 	}
-	challengebts := append([]byte(challenge), make([]byte, 32-len(challenge))...)
-	signature, err := priv.Sign(nil, challengebts, nil)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return keyError(err)
 	}
-	fmt.Println("{ \"id\": \"SIGNED\" }")
-	r, s, err := cards.UnmarshalSignature(signature)
+	br := newBridge(b, nil)
+	br.keys = keys
+	close(br.loaded)
+	resp, err := br.generate(assignment, func(string) {})
 	if err != nil {
-		fmt.Println(err)
-		return
+		return err
 	}
-	assignment := circuits.FCircuit{
-		Challenge: [32]uints.U8(uints.NewU8Array(make([]uint8, 32))),
-		ChallengeSignature: ecdsa.Signature[p384.P384Fr]{
-			R: emulated.ValueOf[p384.P384Fr](r),
-			S: emulated.ValueOf[p384.P384Fr](s),
-		},
-		SubjectPubkey: ecdsa.PublicKey[p384.P384Fp, p384.P384Fr]{
-			X: emulated.ValueOf[p384.P384Fp](pub.X),
-			Y: emulated.ValueOf[p384.P384Fp](pub.Y),
-		},
-	}
-	copy(assignment.Challenge[:], uints.NewU8Array(challengebts))
-	ccs := groth16.NewCS(ecc.BN254)
-	_, err = ccs.ReadFrom(fccs)
+	send(protocol.Message{ID: protocol.Generated, Proof: resp})
+	return nil
+}
+
+// readWitness returns the assignment of a PEM certificate file, the
+// challenge and a file with the signature of the card.
+func readWitness(certFile, signatureFile, challenge string) (*circuits.FCircuit, error) {
+	data, err := os.ReadFile(certFile)
 	if err != nil {
-		fmt.Println("CCS", err)
-		return
+		return nil, err
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
 	}
-	pk := groth16.NewProvingKey(ecc.BN254)
-	_, err = pk.ReadFrom(fpk)
+	cert, err := x509.ParseCertificate(data)
 	if err != nil {
-		fmt.Println("PK", err)
-		return
+		return nil, fmt.Errorf("%s: %w", certFile, err)
+	}
+	if signatureFile == "" {
+		return nil, errors.New("-cert requires -signature")
 	}
-	vk := groth16.NewVerifyingKey(ecc.BN254)
-	_, err = vk.ReadFrom(fvk)
+	signature, err := os.ReadFile(signatureFile)
 	if err != nil {
-		fmt.Println("VK", err)
-		return
+		return nil, err
+	}
+	return circuits.NewFWitness(cert, []byte(challenge), signature)
+}
+
+// tokens returns the card backend of the flags and a description of it for
+// HELLO.
+func tokens() (tokenSource, string, error) {
+	if soft {
+		s, err := cards.NewSoftToken(cards.DefaultSubject)
+		return s, "soft token", err
 	}
-	witness, err := frontend.NewWitness(&assignment, ecc.BN254.ScalarField())
+	if cscURL != "" {
+		return cards.NewCSC(cscURL, os.Getenv("EIDAS_CSC_TOKEN")), "CSC " + cscURL, nil
+	}
+	if pivKey != "" {
+		key, err := strconv.ParseUint(pivKey, 16, 8)
+		if err != nil {
+			return nil, "", fmt.Errorf("piv key %q: %w", pivKey, err)
+		}
+		p := cards.NewPIV(cards.PCSCReaders)
+		p.Key = byte(key)
+		p.Tries = pivTries
+		return p, "PIV over PC/SC", nil
+	}
+	path, err := cards.Discover(filepath.SplitList(libLoc)...)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, "", err
 	}
+	ret := cards.New(path, "")
+	if keyPolicy != "" {
+		var err error
+		ret.Key, err = cards.ParseKeyPolicy(keyPolicy)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	info, err := ret.Module()
+	if err != nil {
+		return nil, "", err
+	}
+	return ret, info.String(), nil
+}
 
-	// prove
-	proof, err := groth16.Prove(ccs, pk, witness, backend.WithSolverOptions(solver.OverrideHint(
-		solver.GetHintID(cs.Bsb22CommitmentComputePlaceholder), func(mod *big.Int, input, output []*big.Int) error {
-			toHash := make([]byte, 0, (1+mod.BitLen()/8)*len(input))
-			for _, in := range input {
-				inBytes := in.Bytes()
-				toHash = append(toHash, inBytes[:]...)
+// load reads the manifest and validates the artifacts in the background
+// while waiting for the card, broadcasting LOADING progress and LOADED when
+// done. The keys are decoded without subgroup checks only if the manifest is
+// signed, its file digests are checked instead. An error, such as a missing
+// manifest, is broadcast and returned to the sessions on their first proof.
+func (br *bridge) load(files prover.Files, manifestLoc string, contractCode []byte) {
+	fail := func(err error) {
+		br.loadErr = keyError(err)
+		close(br.loaded)
+		br.broadcast(protocol.NewError("", br.loadErr))
+	}
+	go func() {
+		manifest, err := readManifest(manifestLoc)
+		if err != nil {
+			fail(err)
+			return
+		}
+		opts := []prover.ReadOption{prover.WithManifest(manifest)}
+		if manifest.Authenticated() {
+			opts = append(opts, prover.WithUnsafe())
+		}
+		percent := int64(-1)
+		progress := func(read, total int64) {
+			if p := read * 100 / total; p != percent {
+				percent = p
+				br.broadcast(protocol.Message{ID: protocol.Loading, Read: read, Total: total})
 			}
-			hsh := sha256.New().Sum(toHash)
-			output[0].SetBytes(hsh)
-			output[0].Mod(output[0], mod)
-			return nil
-		})))
-	if err != nil {
-		fmt.Println(err)
-		return
+		}
+		keys, err := prover.Read(br.backend, files, &circuits.FCircuit{}, append(opts, prover.WithProgress(progress))...)
+		if err == nil {
+			err = manifest.CheckKeys(circuits.FCircuitName, circuits.FCircuitVersion, keys)
+		}
+		if err == nil && contractCode != nil {
+			err = manifest.CheckContractCode(contractCode)
+		}
+		if err != nil {
+			fail(err)
+			return
+		}
+		br.keys = keys
+		close(br.loaded)
+		br.broadcast(protocol.Message{ID: protocol.Loaded})
+	}()
+}
+
+// readManifest reads the manifest and checks its signature with the pinned
+// release key. Without one it is only read with -insecure.
+func readManifest(name string) (*prover.Manifest, error) {
+	if releaseKey == "" {
+		if !insecure {
+			return nil, fmt.Errorf("%w, -insecure accepts an unsigned manifest", prover.ErrNoReleaseKey)
+		}
+		return prover.ReadManifest(name)
 	}
-	// ensure gnark (Go) code verifies it
-	publicWitness, err := witness.Public()
+	key, err := prover.ParseReleaseKey(releaseKey)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, err
 	}
-	if err = groth16.Verify(proof, vk, publicWitness); err != nil {
-		fmt.Println(err)
-		return
+	return prover.ReadSignedManifest(name, key)
+}
+
+// keyError classifies an error of loading the artifacts.
+func keyError(err error) error {
+	if errors.Is(err, prover.ErrManifestMismatch) || errors.Is(err, prover.ErrContractMismatch) || errors.Is(err, prover.ErrManifestSignature) {
+		return protocol.WithCode(protocol.KeyMismatch, err)
 	}
-	// get proof bytes
-	const fpSize = 4 * 8
-	var buf bytes.Buffer
-	proof.WriteRawTo(&buf)
-	proofBytes := buf.Bytes()
-	resp := Response{
-		A: [2]*big.Int{
-			new(big.Int).SetBytes(proofBytes[fpSize*0 : fpSize*1]),
-			new(big.Int).SetBytes(proofBytes[fpSize*1 : fpSize*2]),
-		},
-		B: [2][2]*big.Int{
-			[2]*big.Int{
-				new(big.Int).SetBytes(proofBytes[fpSize*2 : fpSize*3]),
-				new(big.Int).SetBytes(proofBytes[fpSize*3 : fpSize*4]),
-			},
-			[2]*big.Int{
-				new(big.Int).SetBytes(proofBytes[fpSize*4 : fpSize*5]),
-				new(big.Int).SetBytes(proofBytes[fpSize*5 : fpSize*6]),
-			},
-		},
-		C: [2]*big.Int{
-			new(big.Int).SetBytes(proofBytes[fpSize*6 : fpSize*7]),
-			new(big.Int).SetBytes(proofBytes[fpSize*7 : fpSize*8]),
-		},
-	}
-	for i := range assignment.Challenge {
-		resp.Input[i] = new(big.Int).SetUint64(uint64(assignment.Challenge[i].Val.(uint8)))
-	}
-	tosend, err := json.Marshal(Message{"GENERATED", resp})
+	return protocol.WithCode(protocol.Artifacts, err)
+}
+
+var sendMu sync.Mutex
+
+// send prints the message as a JSON line, the loader and the sessions send
+// concurrently.
+func send(msg protocol.Message) {
+	bts, err := json.Marshal(msg)
+	sendMu.Lock()
+	defer sendMu.Unlock()
 	if err != nil {
 		fmt.Println(err)
 		return
 	}
-	fmt.Println(string(tosend))
+	fmt.Println(string(bts))
 }
 
-type Response struct {
-	A     [2]*big.Int
-	B     [2][2]*big.Int
-	C     [2]*big.Int
-	Input [32]*big.Int
+// fatal sends the error and exits with status 1, like every failure of the
+// bridge.
+func fatal(err error) {
+	send(protocol.NewError("", err))
+	os.Exit(1)
 }
 
-type Message struct {
-	ID    string   `json:"id"`
-	Proof Response `json:"proof"`
+func getContractCode(rpcURL, addr string) ([]byte, error) {
+	if rpcURL == "" {
+		return nil, fmt.Errorf("-contract requires -rpc")
+	}
+	if !common.IsHexAddress(addr) {
+		return nil, fmt.Errorf("invalid address %q", addr)
+	}
+	client, err := ethclient.Dial(rpcURL)
+	if err != nil {
+		return nil, fmt.Errorf("dial: %w", err)
+	}
+	defer client.Close()
+	code, err := client.CodeAt(context.Background(), common.HexToAddress(addr), nil)
+	if err != nil {
+		return nil, fmt.Errorf("code: %w", err)
+	}
+	if len(code) == 0 {
+		return nil, fmt.Errorf("no contract at %s", addr)
+	}
+	return code, nil
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/test"
+	"github.com/ritave/eIDAS-bridge/snark/cards"
+	"github.com/ritave/eIDAS-bridge/snark/circuits"
+	"github.com/ritave/eIDAS-bridge/snark/protocol"
+	"github.com/ritave/eIDAS-bridge/snark/prover"
+)
+
+func TestReadWitness(t *testing.T) {
+	fake := newSoftToken(t)
+	tokens, err := fake.EnumerateTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.SetPIN(cards.SoftTokenPIN)
+	cert, _, signer, err := fake.GetSigner(tokens[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := "test.eth"
+	digest := circuits.ChallengeDigest(circuits.Challenge([]byte(challenge)))
+	signature, err := signer.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	signatureFile := filepath.Join(dir, "signature.der")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(signatureFile, signature, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := readWitness(certFile, "", challenge); err == nil {
+		t.Fatal("expected an error without -signature")
+	}
+	if _, err := readWitness(certFile, signatureFile, "other.eth"); err == nil {
+		t.Fatal("expected an error for another challenge")
+	}
+	assignment, err := readWitness(certFile, signatureFile, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := test.IsSolved(&circuits.FCircuit{}, assignment, ecc.BN254.ScalarField()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "EIDAS.G16.manifest.json")
+	m := &prover.Manifest{Version: prover.ManifestVersion, Circuit: circuits.FCircuitName, Backend: prover.Groth16}
+	if err := m.Write(name); err != nil {
+		t.Fatal(err)
+	}
+	key, err := prover.NewReleaseKey(filepath.Join(dir, "release.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(key string, v bool) { releaseKey, insecure = key, v }(releaseKey, insecure)
+
+	releaseKey, insecure = "", false
+	if _, err := readManifest(name); !errors.Is(err, prover.ErrNoReleaseKey) {
+		t.Fatalf("expected no release key, got %v", err)
+	}
+	insecure = true
+	if m, err := readManifest(name); err != nil || m.Authenticated() {
+		t.Fatalf("unpinned manifest with -insecure: %v", err)
+	}
+	releaseKey = hex.EncodeToString(key.Public().(ed25519.PublicKey))
+	if _, err := readManifest(name); err == nil {
+		t.Fatal("unsigned manifest accepted with a release key")
+	}
+	if err := prover.SignManifest(name, key); err != nil {
+		t.Fatal(err)
+	}
+	if m, err := readManifest(name); err != nil || !m.Authenticated() {
+		t.Fatalf("signed manifest: %v", err)
+	}
+	other, err := prover.NewReleaseKey(filepath.Join(dir, "other.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	releaseKey = hex.EncodeToString(other.Public().(ed25519.PublicKey))
+	_, err = readManifest(name)
+	if code := protocol.CodeOf(keyError(err)); code != protocol.KeyMismatch {
+		t.Fatalf("expected %s for another release key, got %s: %v", protocol.KeyMismatch, code, err)
+	}
+}
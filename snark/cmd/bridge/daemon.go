@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/ritave/eIDAS-bridge/snark/protocol"
+)
+
+// dispatcher routes the requests of one client to its sessions. LINK starts a
+// session, with the given ID or a random one, SELECT and SIGN deliver the
+// chosen card and the PIN and challenge to it and CANCEL aborts it.
+type dispatcher struct {
+	bridge *bridge
+	send   func(protocol.Message)
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+	mu       sync.Mutex
+	sessions map[string]*sessionHandle
+}
+
+type sessionHandle struct {
+	*session
+	cancel context.CancelFunc
+}
+
+func newDispatcher(b *bridge, send func(protocol.Message)) *dispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &dispatcher{
+		bridge:   b,
+		send:     send,
+		ctx:      ctx,
+		cancel:   cancel,
+		sessions: make(map[string]*sessionHandle),
+	}
+}
+
+func (d *dispatcher) handle(req protocol.Request) {
+	switch req.ID {
+	case protocol.Hello:
+		if req.Version != protocol.Version {
+			d.fail("", protocol.Errorf(protocol.UnsupportedVersion, "unsupported version %d, bridge speaks %d", req.Version, protocol.Version))
+			return
+		}
+		d.send(d.bridge.hello())
+	case protocol.Link:
+		d.link(req.Session)
+	case protocol.Sign, protocol.Select:
+		d.mu.Lock()
+		s, ok := d.sessions[req.Session]
+		d.mu.Unlock()
+		if !ok {
+			d.fail(req.Session, protocol.Errorf(protocol.UnknownSession, "unknown session %q", req.Session))
+			return
+		}
+		select {
+		case s.request <- req:
+		default:
+			d.fail(req.Session, protocol.Errorf(protocol.BadRequest, "session %q busy", req.Session))
+		}
+	case protocol.Cancel:
+		if !d.cancelSession(req.Session) {
+			d.fail(req.Session, protocol.Errorf(protocol.UnknownSession, "unknown session %q", req.Session))
+		}
+	default:
+		d.fail(req.Session, protocol.Errorf(protocol.BadRequest, "unknown message %q", req.ID))
+	}
+}
+
+func (d *dispatcher) newSessionID() string {
+	var buf [8]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// cancelSession aborts the session, it reports whether the session exists.
+func (d *dispatcher) cancelSession(id string) bool {
+	d.mu.Lock()
+	s, ok := d.sessions[id]
+	d.mu.Unlock()
+	if ok {
+		s.cancel()
+	}
+	return ok
+}
+
+func (d *dispatcher) link(id string) {
+	if id == "" {
+		id = d.newSessionID()
+	}
+	ctx, cancel := context.WithCancel(d.ctx)
+	s := &sessionHandle{
+		session: &session{
+			id:      id,
+			bridge:  d.bridge,
+			send:    d.send,
+			request: make(chan protocol.Request, 1),
+		},
+		cancel: cancel,
+	}
+	d.mu.Lock()
+	if _, ok := d.sessions[id]; ok {
+		d.mu.Unlock()
+		cancel()
+		d.fail(id, protocol.Errorf(protocol.BadRequest, "session %q already exists", id))
+		return
+	}
+	d.sessions[id] = s
+	d.mu.Unlock()
+
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		defer cancel()
+		// cancelled sessions end quietly, the client asked for it
+		if err := s.run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+			d.fail(id, err)
+		}
+		d.mu.Lock()
+		delete(d.sessions, id)
+		d.mu.Unlock()
+	}()
+}
+
+func (d *dispatcher) fail(id string, err error) {
+	d.send(protocol.NewError(id, err))
+}
+
+// close cancels the running sessions and waits for them.
+func (d *dispatcher) close() {
+	d.cancel()
+	d.wg.Wait()
+}
+
+// serveLines reads JSON requests, one per line, until r is exhausted.
+func serveLines(b *bridge, r io.Reader, send func(protocol.Message)) error {
+	d := newDispatcher(b, send)
+	defer d.close()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var req protocol.Request
+		if err := json.Unmarshal(scanner.Bytes(), &req); err != nil {
+			d.fail("", protocol.Errorf(protocol.BadRequest, "unmarshal: %w", err))
+			continue
+		}
+		d.handle(req)
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/test"
+	"github.com/ritave/eIDAS-bridge/snark/cards"
+	"github.com/ritave/eIDAS-bridge/snark/cards/cardstest"
+	"github.com/ritave/eIDAS-bridge/snark/circuits"
+	"github.com/ritave/eIDAS-bridge/snark/protocol"
+	"github.com/ritave/eIDAS-bridge/snark/prover"
+)
+
+func newSoftToken(t *testing.T) *cards.SoftToken {
+	s, err := cards.NewSoftToken(cards.DefaultSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// twoCards adds the events sent by the test to those of the soft token.
+type twoCards struct {
+	*cards.SoftToken
+	events chan cards.Event
+}
+
+func (c *twoCards) Watch(ctx context.Context) (<-chan cards.Event, error) {
+	soft, err := c.SoftToken.Watch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan cards.Event)
+	go func() {
+		defer close(ch)
+		for {
+			var e cards.Event
+			select {
+			case e = <-soft:
+			case e = <-c.events:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case ch <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return ch, nil
+}
+
+func newTestBridge(t *testing.T, src tokenSource) *bridge {
+	b := newBridge("groth16", src)
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	if err := b.watch(ctx); err != nil {
+		t.Fatal(err)
+	}
+	b.prove = func(assignment *circuits.FCircuit, stage func(string)) (*protocol.Proof, error) {
+		stage("prove")
+		return &protocol.Proof{}, nil
+	}
+	return b
+}
+
+func TestDaemonSessions(t *testing.T) {
+	in, w := io.Pipe()
+	out := make(chan protocol.Message, 16)
+	done := make(chan error)
+	go func() {
+		done <- serveLines(newTestBridge(t, newSoftToken(t)), in, func(m protocol.Message) { out <- m })
+	}()
+	write := func(req protocol.Request) {
+		bts, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(append(bts, '\n')); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// collects n messages, the messages of concurrent sessions interleave
+	collect := func(n int) map[string][]string {
+		sessions := make(map[string][]string)
+		for i := 0; i < n; i++ {
+			select {
+			case m := <-out:
+				sessions[m.Session] = append(sessions[m.Session], m.ID)
+			case <-time.After(5 * time.Second):
+				t.Fatal("timeout")
+			}
+		}
+		return sessions
+	}
+	expectError := func(session string, code protocol.Code) protocol.Message {
+		m := <-out
+		if m.ID != protocol.Error || m.Session != session || m.Code != code {
+			t.Fatalf("expected %s error for %q, got %+v", code, session, m)
+		}
+		return m
+	}
+
+	write(protocol.Request{ID: protocol.Hello, Version: protocol.Version + 1})
+	expectError("", protocol.UnsupportedVersion)
+	write(protocol.Request{ID: protocol.Hello, Version: protocol.Version})
+	if m := <-out; m.ID != protocol.Hello || m.Version != protocol.Version || m.Backend != "groth16" {
+		t.Fatalf("unexpected hello %+v", m)
+	}
+
+	write(protocol.Request{ID: protocol.Link, Session: "a"})
+	write(protocol.Request{ID: protocol.Link, Session: "b"})
+	s := collect(4)
+	for _, id := range []string{"a", "b"} {
+		if fmt.Sprint(s[id]) != "[INSERTED PIN_REQUIRED]" {
+			t.Fatalf("unexpected messages %v", s)
+		}
+	}
+	write(protocol.Request{ID: protocol.Sign, Session: "a", PIN: "123456", Challenge: "hello"})
+	write(protocol.Request{ID: protocol.Sign, Session: "b", PIN: "123456", Challenge: "world"})
+	s = collect(6)
+	for _, id := range []string{"a", "b"} {
+		if fmt.Sprint(s[id]) != "[SIGNED PROVING GENERATED]" {
+			t.Fatalf("unexpected messages %v", s)
+		}
+	}
+
+	write(protocol.Request{ID: protocol.Sign, Session: "x", PIN: "123456", Challenge: "hello"})
+	expectError("x", protocol.UnknownSession)
+	write(protocol.Request{ID: "FOO"})
+	expectError("", protocol.BadRequest)
+
+	write(protocol.Request{ID: protocol.Link, Session: "c"})
+	if s := collect(2); fmt.Sprint(s["c"]) != "[INSERTED PIN_REQUIRED]" {
+		t.Fatalf("unexpected messages %v", s)
+	}
+	write(protocol.Request{ID: protocol.Sign, Session: "c", PIN: "000000", Challenge: "hello"})
+	if m := expectError("c", protocol.WrongPIN); m.PIN == nil || m.PIN.Attempts != -1 || !m.PIN.CountLow {
+		t.Fatalf("expected a low count, got %+v", m.PIN)
+	}
+
+	// generated session ID
+	write(protocol.Request{ID: protocol.Link})
+	if m := <-out; m.ID != protocol.Inserted || m.Session == "" {
+		t.Fatalf("expected generated session, got %+v", m)
+	}
+	w.Close()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPINPad(t *testing.T) {
+	fake := newSoftToken(t)
+	fake.SetPINPad(true)
+	out := make(chan protocol.Message, 16)
+	d := newDispatcher(newTestBridge(t, fake), func(m protocol.Message) { out <- m })
+	defer d.close()
+
+	d.handle(protocol.Request{ID: protocol.Link, Session: "a"})
+	if m := <-out; m.ID != protocol.Inserted || !m.PINPad {
+		t.Fatalf("expected pinpad insertion, got %+v", m)
+	}
+	d.handle(protocol.Request{ID: protocol.Sign, Session: "a", Challenge: "hello"})
+	var ids []string
+	for m := range out {
+		ids = append(ids, m.ID)
+		if m.ID == protocol.Generated || m.ID == protocol.Error {
+			break
+		}
+	}
+	if fmt.Sprint(ids) != "[PIN_PAD SIGNED PROVING GENERATED]" {
+		t.Fatalf("unexpected messages %v", ids)
+	}
+}
+
+func TestCardRemoved(t *testing.T) {
+	fake := newSoftToken(t)
+	out := make(chan protocol.Message, 16)
+	d := newDispatcher(newTestBridge(t, fake), func(m protocol.Message) { out <- m })
+	defer d.close()
+
+	d.handle(protocol.Request{ID: protocol.Link, Session: "a"})
+	for _, id := range []string{protocol.Inserted, protocol.PINRequired} {
+		if m := <-out; m.ID != id {
+			t.Fatalf("expected %s, got %+v", id, m)
+		}
+	}
+	fake.Remove()
+	if m := <-out; m.ID != protocol.Error || m.Session != "a" || m.Code != protocol.CardRemoved {
+		t.Fatalf("expected card removed, got %+v", m)
+	}
+
+	// a session waits for the card to be inserted again
+	d.handle(protocol.Request{ID: protocol.Link, Session: "b"})
+	select {
+	case m := <-out:
+		t.Fatalf("unexpected message %+v", m)
+	case <-time.After(10 * time.Millisecond):
+	}
+	fake.Insert()
+	if m := <-out; m.ID != protocol.Inserted || m.Session != "b" {
+		t.Fatalf("expected insertion, got %+v", m)
+	}
+}
+
+func TestChoose(t *testing.T) {
+	fake := &twoCards{SoftToken: newSoftToken(t), events: make(chan cards.Event)}
+	out := make(chan protocol.Message, 16)
+	b := newTestBridge(t, fake)
+	d := newDispatcher(b, func(m protocol.Message) { out <- m })
+	defer d.close()
+
+	other := &cards.Token{Slot: 3, Label: "other", Serial: "2"}
+	fake.events <- cards.Event{Type: cards.TokenInserted, Token: other}
+	for tokens, changed := b.present(); len(tokens) != 2; tokens, changed = b.present() {
+		<-changed
+	}
+	d.handle(protocol.Request{ID: protocol.Link, Session: "a"})
+	m := <-out
+	if m.ID != protocol.Choose || fmt.Sprint(m.Tokens) != "[{0 SoftToken "+m.Tokens[0].Serial+" eIDAS-bridge} {3 other 2 }]" {
+		t.Fatalf("expected choice, got %+v", m)
+	}
+	slot := uint(3)
+	d.handle(protocol.Request{ID: protocol.Select, Session: "a", Slot: &slot})
+	if m := <-out; m.ID != protocol.Inserted {
+		t.Fatalf("expected insertion, got %+v", m)
+	}
+	if m := <-out; m.ID != protocol.PINRequired {
+		t.Fatalf("expected PIN request, got %+v", m)
+	}
+
+	// the selector leaves a single card
+	b.selector, _ = cards.ParseSelector("label=^SoftToken$")
+	d.handle(protocol.Request{ID: protocol.Link, Session: "b"})
+	if m := <-out; m.ID != protocol.Inserted || m.Session != "b" {
+		t.Fatalf("expected insertion, got %+v", m)
+	}
+}
+
+func TestSoftHSMSession(t *testing.T) {
+	hsm := cardstest.SoftHSM(t)
+	sel, err := cards.ParseSelector("label=^" + cardstest.Label + "$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := make(chan protocol.Message, 16)
+	b := newTestBridge(t, cards.New(hsm.Path, ""))
+	b.selector = sel
+	d := newDispatcher(b, func(m protocol.Message) { out <- m })
+	defer d.close()
+
+	d.handle(protocol.Request{ID: protocol.Link, Session: "a"})
+	d.handle(protocol.Request{ID: protocol.Sign, Session: "a", PIN: cardstest.PIN, Challenge: "hello"})
+	var ids []string
+	for len(ids) < 5 {
+		select {
+		case m := <-out:
+			ids = append(ids, m.ID)
+			if m.ID == protocol.Error {
+				t.Fatalf("unexpected error %+v", m)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("timeout after %v", ids)
+		}
+	}
+	if fmt.Sprint(ids) != "[INSERTED PIN_REQUIRED SIGNED PROVING GENERATED]" {
+		t.Fatalf("unexpected messages %v", ids)
+	}
+}
+
+func TestSignLongChallenge(t *testing.T) {
+	fake := newSoftToken(t)
+	b := newTestBridge(t, fake)
+	tokens, err := fake.EnumerateTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := strings.Repeat("0123456789abcdef", 4)
+	assignment, err := b.sign(tokens[0], cards.SoftTokenPIN, challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := circuits.Challenge([]byte(challenge))
+	for i := range public {
+		if assignment.Challenge[i].Val.(uint8) != public[i] {
+			t.Fatalf("expected the SHA-256 of the challenge as public input")
+		}
+	}
+	if err := test.IsSolved(&circuits.FCircuit{}, assignment, ecc.BN254.ScalarField()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCSCSession(t *testing.T) {
+	cred := cardstest.NewCredential(t, "qes-1", "1234")
+	srv := cardstest.NewCSC(t, cred)
+	out := make(chan protocol.Message, 16)
+	d := newDispatcher(newTestBridge(t, cards.NewCSC(srv.URL, srv.Token)), func(m protocol.Message) { out <- m })
+	defer d.close()
+
+	d.handle(protocol.Request{ID: protocol.Link, Session: "a"})
+	d.handle(protocol.Request{ID: protocol.Sign, Session: "a", PIN: "1234", Challenge: "hello"})
+	var ids []string
+	for len(ids) < 5 {
+		m := <-out
+		ids = append(ids, m.ID)
+		if m.ID == protocol.Error {
+			t.Fatalf("unexpected error %+v", m)
+		}
+	}
+	if fmt.Sprint(ids) != "[INSERTED PIN_REQUIRED SIGNED PROVING GENERATED]" || srv.Signed() != 1 {
+		t.Fatalf("unexpected messages %v", ids)
+	}
+}
+
+func TestLoadError(t *testing.T) {
+	defer func(v bool) { insecure = v }(insecure)
+	insecure = true
+	dir := t.TempDir()
+	manifest := filepath.Join(dir, "EIDAS.G16.manifest.json")
+	m := &prover.Manifest{Version: prover.ManifestVersion, Circuit: circuits.FCircuitName, Backend: prover.Groth16}
+	if err := m.Write(manifest); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name     string
+		manifest string
+		files    prover.Files
+	}{
+		// the desktop app ships without a manifest, the bridge still starts
+		{"missing manifest", filepath.Join(dir, "missing.manifest.json"), prover.Files{}},
+		{"missing ccs", manifest, prover.Files{CCS: filepath.Join(dir, "missing.ccs")}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBridge("groth16", nil)
+			out := make(chan protocol.Message, 1)
+			b.subscribe(func(m protocol.Message) { out <- m })
+			b.load(tt.files, tt.manifest, nil)
+			_, err := b.generate(nil, func(string) {})
+			if code := protocol.CodeOf(err); code != protocol.Artifacts {
+				t.Fatalf("expected %s, got %s: %v", protocol.Artifacts, code, err)
+			}
+			if m := <-out; m.ID != protocol.Error || m.Code != protocol.Artifacts {
+				t.Fatalf("expected a broadcast %s error, got %+v", protocol.Artifacts, m)
+			}
+		})
+	}
+}
+
+// padCards is a second token in a PIN pad reader, its signer waits until the
+// test releases the PIN pad.
+type padCards struct {
+	*twoCards
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (c *padCards) Signer(token *cards.Token, cert *x509.Certificate) (crypto.Signer, error) {
+	if token.ProtectedAuthPath {
+		c.entered <- struct{}{}
+		<-c.release
+		// the soft token behind it checks the PIN
+		c.SoftToken.SetPIN(cards.SoftTokenPIN)
+	}
+	return c.twoCards.Signer(token, cert)
+}
+
+func TestSignConcurrently(t *testing.T) {
+	fake := &padCards{
+		twoCards: &twoCards{SoftToken: newSoftToken(t), events: make(chan cards.Event)},
+		entered:  make(chan struct{}),
+		release:  make(chan struct{}),
+	}
+	b := newTestBridge(t, fake)
+	pad := &cards.Token{Slot: 3, Label: "pad", Serial: "2", ProtectedAuthPath: true}
+	tokens, err := fake.EnumerateTokens()
+	if err != nil {
+		t.Fatal(err)
+	}
+	soft := tokens[0]
+
+	done := make(chan error, 2)
+	for _, challenge := range []string{"first", "second"} {
+		go func(challenge string) {
+			_, err := b.sign(pad, "", challenge)
+			done <- err
+		}(challenge)
+	}
+	<-fake.entered
+	// another card signs while the user enters the PIN on the pad
+	if _, err := b.sign(soft, cards.SoftTokenPIN, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	b.withPIN(soft)
+	// the second session waits for the first one on the pad
+	select {
+	case <-fake.entered:
+		t.Fatal("two sessions sign with the same token")
+	case <-time.After(10 * time.Millisecond):
+	}
+	fake.release <- struct{}{}
+	<-fake.entered
+	fake.release <- struct{}{}
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCardRemovedWhileSigning(t *testing.T) {
+	fake := &padCards{
+		twoCards: &twoCards{SoftToken: newSoftToken(t), events: make(chan cards.Event)},
+		entered:  make(chan struct{}),
+		release:  make(chan struct{}),
+	}
+	fake.SetPINPad(true)
+	out := make(chan protocol.Message, 16)
+	d := newDispatcher(newTestBridge(t, fake), func(m protocol.Message) { out <- m })
+	defer d.close()
+
+	d.handle(protocol.Request{ID: protocol.Link, Session: "a"})
+	if m := <-out; m.ID != protocol.Inserted || !m.PINPad {
+		t.Fatalf("expected pinpad insertion, got %+v", m)
+	}
+	d.handle(protocol.Request{ID: protocol.Sign, Session: "a", Challenge: "hello"})
+	if m := <-out; m.ID != protocol.PINPad {
+		t.Fatalf("expected PIN pad, got %+v", m)
+	}
+	<-fake.entered
+	// removed while the reader waits for the PIN
+	fake.Remove()
+	if m := <-out; m.ID != protocol.Error || m.Session != "a" || m.Code != protocol.CardRemoved {
+		t.Fatalf("expected card removed, got %+v", m)
+	}
+	fake.release <- struct{}{}
+}
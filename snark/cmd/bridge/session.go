@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/miekg/pkcs11"
+	"github.com/ritave/eIDAS-bridge/snark/cards"
+	"github.com/ritave/eIDAS-bridge/snark/circuits"
+	"github.com/ritave/eIDAS-bridge/snark/protocol"
+	"github.com/ritave/eIDAS-bridge/snark/prover"
+)
+
+// tokenSource is the part of cards.Config used by the bridge.
+type tokenSource interface {
+	Watch(ctx context.Context) (<-chan cards.Event, error)
+	PINStatus(token *cards.Token) (cards.PINStatus, error)
+	Select(sel *cards.Selector, in []*cards.Token) ([]*cards.Token, error)
+	SetPIN(pin string)
+	cards.TokenSigner
+}
+
+// bridge holds the state shared by the sessions. The keys are loaded once
+// and the card is used by one session at a time.
+type bridge struct {
+	backend  prover.Backend
+	module   string // the loaded PKCS#11 module, reported by HELLO
+	cards    tokenSource
+	cardsMu  sync.Mutex // held while calling cards, not while a PIN pad waits
+	selector *cards.Selector
+	signing  map[uint]*sync.Mutex // by slot, a token signs for one session at a time
+	signers  map[uint]int         // signing sessions by slot, the last one closes the token
+
+	// tokens present, from the watch, changed is closed on every change
+	tokensMu sync.Mutex
+	tokens   []*cards.Token
+	changed  chan struct{}
+
+	// closed once the keys are read, or loadErr is set
+	loaded  chan struct{}
+	keys    *prover.Keys
+	loadErr error
+
+	listenersMu sync.Mutex
+	listeners   map[int]func(protocol.Message)
+	nextID      int
+
+	// prove creates the proof reporting the prover stages, replaced in tests
+	prove func(assignment *circuits.FCircuit, stage func(string)) (*protocol.Proof, error)
+}
+
+func newBridge(b prover.Backend, src tokenSource) *bridge {
+	ret := &bridge{
+		backend: b,
+		cards:   src,
+		changed: make(chan struct{}),
+		loaded:  make(chan struct{}),
+		signing: make(map[uint]*sync.Mutex),
+		signers: make(map[uint]int),
+
+		listeners: make(map[int]func(protocol.Message)),
+	}
+	ret.prove = ret.generate
+	return ret
+}
+
+// subscribe registers fn for the messages not tied to a session, such as the
+// load progress.
+func (b *bridge) subscribe(fn func(protocol.Message)) (unsubscribe func()) {
+	b.listenersMu.Lock()
+	defer b.listenersMu.Unlock()
+	id := b.nextID
+	b.nextID++
+	b.listeners[id] = fn
+	return func() {
+		b.listenersMu.Lock()
+		defer b.listenersMu.Unlock()
+		delete(b.listeners, id)
+	}
+}
+
+func (b *bridge) broadcast(msg protocol.Message) {
+	b.listenersMu.Lock()
+	defer b.listenersMu.Unlock()
+	for _, fn := range b.listeners {
+		fn(msg)
+	}
+}
+
+func (b *bridge) hello() protocol.Message {
+	return protocol.Message{ID: protocol.Hello, Version: protocol.Version, Backend: string(b.backend), Module: b.module}
+}
+
+// watch keeps the present tokens up to date until ctx is cancelled.
+func (b *bridge) watch(ctx context.Context) error {
+	events, err := b.cards.Watch(ctx)
+	if err != nil {
+		return fmt.Errorf("watch: %w", err)
+	}
+	go func() {
+		for e := range events {
+			b.tokensMu.Lock()
+			switch e.Type {
+			case cards.TokenInserted:
+				// ordered by slot for CHOOSE
+				i := sort.Search(len(b.tokens), func(i int) bool { return b.tokens[i].Slot > e.Token.Slot })
+				b.tokens = append(b.tokens[:i:i], append([]*cards.Token{e.Token}, b.tokens[i:]...)...)
+			case cards.TokenRemoved:
+				for i, t := range b.tokens {
+					if t.Slot == e.Token.Slot {
+						b.tokens = append(b.tokens[:i:i], b.tokens[i+1:]...)
+						break
+					}
+				}
+			}
+			close(b.changed)
+			b.changed = make(chan struct{})
+			b.tokensMu.Unlock()
+		}
+	}()
+	return nil
+}
+
+// present returns the present tokens and a channel closed when they change.
+func (b *bridge) present() ([]*cards.Token, <-chan struct{}) {
+	b.tokensMu.Lock()
+	defer b.tokensMu.Unlock()
+	return b.tokens, b.changed
+}
+
+// inserted reports whether token is still present.
+func (b *bridge) inserted(token *cards.Token) (bool, <-chan struct{}) {
+	tokens, changed := b.present()
+	for _, t := range tokens {
+		if t.Slot == token.Slot && t.Serial == token.Serial {
+			return true, changed
+		}
+	}
+	return false, changed
+}
+
+// selected returns the present tokens matching the selector.
+func (b *bridge) selected() ([]*cards.Token, <-chan struct{}, error) {
+	tokens, changed := b.present()
+	b.cardsMu.Lock()
+	defer b.cardsMu.Unlock()
+	tokens, err := b.cards.Select(b.selector, tokens)
+	return tokens, changed, err
+}
+
+// withPIN returns a copy of token with its current PIN state, the state of
+// the watch is the one at insertion.
+func (b *bridge) withPIN(token *cards.Token) *cards.Token {
+	ret := *token
+	b.cardsMu.Lock()
+	defer b.cardsMu.Unlock()
+	if status, err := b.cards.PINStatus(&ret); err == nil {
+		ret.PIN = status
+	}
+	return &ret
+}
+
+// sign signs the SHA-256 of the public challenge with the key on the token
+// and returns the circuit assignment. Sessions sign with the same token one
+// after another, cardsMu is only held to set the PIN and log in with it, so
+// a PIN pad waiting for the user does not block the other sessions.
+func (b *bridge) sign(token *cards.Token, pin, challenge string) (*circuits.FCircuit, error) {
+	unlock := b.lockToken(token)
+	defer unlock()
+	src := cards.Identities(b.cards, token)
+	b.cardsMu.Lock()
+	b.signers[token.Slot]++
+	b.cardsMu.Unlock()
+	// also resumes the watch if the signer failed after login
+	defer b.closeSigner(token, src)
+	ctx := context.Background()
+	certs, err := src.Certificates(ctx)
+	if err != nil {
+		return nil, cardError(err)
+	}
+	if len(certs) != 1 {
+		return nil, fmt.Errorf("%d certificates match the key policy, select one with -key", len(certs))
+	}
+	var priv crypto.Signer
+	if token.ProtectedAuthPath {
+		priv, err = src.Signer(ctx, certs[0])
+	} else {
+		// the PIN is state of the backend until the login read it
+		b.cardsMu.Lock()
+		b.cards.SetPIN(pin)
+		priv, err = src.Signer(ctx, certs[0])
+		b.cardsMu.Unlock()
+	}
+	if err != nil {
+		return nil, cardError(err)
+	}
+	public := circuits.Challenge([]byte(challenge))
+	signature, err := priv.Sign(nil, circuits.ChallengeDigest(public), crypto.SHA256)
+	if err != nil {
+		return nil, cardError(err)
+	}
+	return circuits.NewFWitness(certs[0], []byte(challenge), signature)
+}
+
+// lockToken waits until no other session signs with the token.
+func (b *bridge) lockToken(token *cards.Token) (unlock func()) {
+	b.cardsMu.Lock()
+	mu, ok := b.signing[token.Slot]
+	if !ok {
+		mu = new(sync.Mutex)
+		b.signing[token.Slot] = mu
+	}
+	b.cardsMu.Unlock()
+	mu.Lock()
+	return mu.Unlock
+}
+
+// closeSigner closes the signers of the token once no session signs with it
+// anymore, which logs out of the token only.
+func (b *bridge) closeSigner(token *cards.Token, src cards.IdentitySource) {
+	b.cardsMu.Lock()
+	defer b.cardsMu.Unlock()
+	b.signers[token.Slot]--
+	if b.signers[token.Slot] == 0 {
+		delete(b.signers, token.Slot)
+		src.Close()
+	}
+}
+
+func pinStatus(s cards.PINStatus) *protocol.PINStatus {
+	return &protocol.PINStatus{Attempts: s.Remaining(), CountLow: s.CountLow}
+}
+
+// cardError classifies the card errors the client can act on.
+func cardError(err error) error {
+	var pinErr *cards.PINError
+	if errors.As(err, &pinErr) {
+		code := protocol.WrongPIN
+		if errors.Is(err, cards.ErrPINLocked) {
+			code = protocol.PINLocked
+		}
+		return &protocol.Err{Code: code, Err: err, PIN: pinStatus(pinErr.Status)}
+	}
+	var perr pkcs11.Error
+	if errors.As(err, &perr) && (perr == pkcs11.CKR_TOKEN_NOT_PRESENT || perr == pkcs11.CKR_DEVICE_REMOVED) {
+		return protocol.WithCode(protocol.CardRemoved, err)
+	}
+	return err
+}
+
+// generate waits for the keys and proves the assignment.
+func (b *bridge) generate(assignment *circuits.FCircuit, stage func(string)) (*protocol.Proof, error) {
+	<-b.loaded
+	if b.loadErr != nil {
+		return nil, b.loadErr
+	}
+	// prove, ensures gnark (Go) code verifies it
+	proof, err := b.keys.Prove(assignment, prover.WithStage(stage))
+	if err != nil {
+		return nil, err
+	}
+	var resp protocol.Proof
+	switch b.backend {
+	case prover.Groth16:
+		a, bb, c, err := proof.Groth16Calldata()
+		if err != nil {
+			return nil, err
+		}
+		resp.A, resp.B, resp.C = &a, &bb, &c
+	case prover.Plonk:
+		resp.Plonk, err = proof.PlonkBytes()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for i := range assignment.Challenge {
+		resp.Input[i] = new(big.Int).SetUint64(uint64(assignment.Challenge[i].Val.(uint8)))
+	}
+	return &resp, nil
+}
+
+// session is a single card interaction: wait for the card, receive the PIN
+// and challenge, sign and prove.
+type session struct {
+	id      string
+	bridge  *bridge
+	send    func(protocol.Message)
+	request chan protocol.Request
+}
+
+// waitToken waits until a single token is selected. When several tokens
+// match the selector, the client chooses one with SELECT.
+func (s *session) waitToken(ctx context.Context) (*cards.Token, error) {
+	var chosen *uint
+	offered := ""
+	for {
+		tokens, changed, err := s.bridge.selected()
+		if err != nil {
+			return nil, err
+		}
+		var choice []protocol.Token
+		for _, t := range tokens {
+			if chosen != nil && t.Slot == *chosen {
+				return s.bridge.withPIN(t), nil
+			}
+			choice = append(choice, protocol.Token{Slot: t.Slot, Label: t.Label, Serial: t.Serial, Manufacturer: t.Manufacturer})
+		}
+		var request <-chan protocol.Request
+		switch {
+		case len(tokens) == 1 && chosen == nil:
+			return s.bridge.withPIN(tokens[0]), nil
+		case len(tokens) > 1:
+			if key := fmt.Sprint(choice); key != offered {
+				s.send(protocol.Message{ID: protocol.Choose, Session: s.id, Tokens: choice})
+				offered = key
+			}
+			request = s.request
+		}
+		select {
+		case req := <-request:
+			if req.ID != protocol.Select || req.Slot == nil {
+				return nil, protocol.Errorf(protocol.BadRequest, "several cards present, choose one with SELECT")
+			}
+			if !offers(choice, *req.Slot) {
+				return nil, protocol.Errorf(protocol.BadRequest, "no card offered in slot %d", *req.Slot)
+			}
+			chosen = req.Slot
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func offers(choice []protocol.Token, slot uint) bool {
+	for _, t := range choice {
+		if t.Slot == slot {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *session) run(ctx context.Context) error {
+	token, err := s.waitToken(ctx)
+	if err != nil {
+		return err
+	}
+	s.send(protocol.Message{ID: protocol.Inserted, Session: s.id, PINPad: token.ProtectedAuthPath})
+	if token.PIN.Locked {
+		return &protocol.Err{Code: protocol.PINLocked, Err: cards.ErrPINLocked, PIN: pinStatus(token.PIN)}
+	}
+	if !token.ProtectedAuthPath {
+		s.send(protocol.Message{ID: protocol.PINRequired, Session: s.id, PIN: pinStatus(token.PIN)})
+	}
+	var req protocol.Request
+	for received := false; !received; {
+		present, changed := s.bridge.inserted(token)
+		if !present {
+			return protocol.Errorf(protocol.CardRemoved, "card removed")
+		}
+		select {
+		case req = <-s.request:
+			if req.ID != protocol.Sign {
+				return protocol.Errorf(protocol.BadRequest, "expected SIGN, got %s", req.ID)
+			}
+			received = true
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if token.ProtectedAuthPath {
+		// cards ignores the PIN and waits for the reader
+		s.send(protocol.Message{ID: protocol.PINPad, Session: s.id, PIN: pinStatus(token.PIN)})
+	}
+	assignment, err := s.sign(ctx, token, req)
+	if err != nil {
+		return err
+	}
+	s.send(protocol.Message{ID: protocol.Signed, Session: s.id})
+	resp, err := s.bridge.prove(assignment, func(stage string) {
+		s.send(protocol.Message{ID: protocol.Proving, Session: s.id, Stage: stage})
+	})
+	if err != nil {
+		return err
+	}
+	s.send(protocol.Message{ID: protocol.Generated, Session: s.id, Proof: resp})
+	return nil
+}
+
+// sign signs while watching the token. A card removed meanwhile is reported
+// as CARD_REMOVED right away, without waiting for the card operation, and
+// also when the backend failed with another error.
+func (s *session) sign(ctx context.Context, token *cards.Token, req protocol.Request) (*circuits.FCircuit, error) {
+	type result struct {
+		assignment *circuits.FCircuit
+		err        error
+	}
+	done := make(chan result, 1)
+	go func() {
+		assignment, err := s.bridge.sign(token, req.PIN, req.Challenge)
+		done <- result{assignment, err}
+	}()
+	for {
+		present, changed := s.bridge.inserted(token)
+		if !present {
+			return nil, protocol.Errorf(protocol.CardRemoved, "card removed while signing")
+		}
+		select {
+		case r := <-done:
+			if r.err != nil {
+				if present, _ := s.bridge.inserted(token); !present {
+					return nil, protocol.WithCode(protocol.CardRemoved, r.err)
+				}
+			}
+			return r.assignment, r.err
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
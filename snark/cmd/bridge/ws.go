@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"github.com/ritave/eIDAS-bridge/snark/protocol"
+)
+
+// parseOrigins splits the comma separated allow-list.
+func parseOrigins(s string) []string {
+	var ret []string
+	for _, o := range strings.Split(s, ",") {
+		if o = strings.TrimSpace(o); o != "" {
+			ret = append(ret, strings.TrimSuffix(o, "/"))
+		}
+	}
+	return ret
+}
+
+// checkOrigin accepts requests from the allowed origins, "*" allows any.
+// Requests without Origin are rejected unless any origin is allowed, other
+// local programs have no business with the card either.
+func checkOrigin(origins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		for _, o := range origins {
+			if o == "*" || (origin != "" && strings.EqualFold(o, origin)) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// wsHandler serves the JSON protocol of the web app over WebSocket. Every
+// connection dispatches its own sessions. The web app does not send session
+// IDs, so LINK without one replaces the current session of the connection and
+// SIGN and CANCEL without one go to it.
+type wsHandler struct {
+	bridge   *bridge
+	upgrader websocket.Upgrader
+}
+
+func newWSHandler(b *bridge, origins []string) *wsHandler {
+	return &wsHandler{
+		bridge:   b,
+		upgrader: websocket.Upgrader{CheckOrigin: checkOrigin(origins)},
+	}
+}
+
+func (h *wsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied with an error
+		return
+	}
+	defer conn.Close()
+
+	var writeMu sync.Mutex
+	write := func(msg protocol.Message) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		// a failed write closes the connection, the read loop then ends
+		if err := conn.WriteJSON(msg); err != nil {
+			conn.Close()
+		}
+	}
+	write(h.bridge.hello())
+	d := newDispatcher(h.bridge, write)
+	defer d.close()
+	defer h.bridge.subscribe(write)()
+
+	current := ""
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		var req protocol.Request
+		if err := json.Unmarshal(data, &req); err != nil {
+			d.fail("", protocol.Errorf(protocol.BadRequest, "unmarshal: %w", err))
+			continue
+		}
+		if req.Session == "" {
+			switch req.ID {
+			case protocol.Link:
+				d.cancelSession(current)
+				current = d.newSessionID()
+				req.Session = current
+			default:
+				req.Session = current
+			}
+		}
+		d.handle(req)
+	}
+}
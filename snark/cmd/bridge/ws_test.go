@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ritave/eIDAS-bridge/snark/protocol"
+)
+
+func TestWebSocket(t *testing.T) {
+	srv := httptest.NewServer(newWSHandler(newTestBridge(t, newSoftToken(t)), parseOrigins("http://localhost:3000/, https://example.org")))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://evil.example"}})
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected forbidden origin, got %v", err)
+	}
+
+	_, resp, err = websocket.DefaultDialer.Dial(url, nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected a missing origin to be forbidden, got %v", err)
+	}
+	if !checkOrigin([]string{"*"})(httptest.NewRequest(http.MethodGet, "/", nil)) {
+		t.Fatal("'*' rejects a missing origin")
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://localhost:3000"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	expect := func(id string) protocol.Message {
+		var m protocol.Message
+		if err := conn.ReadJSON(&m); err != nil {
+			t.Fatal(err)
+		}
+		if m.ID != id {
+			t.Fatalf("expected %s, got %+v", id, m)
+		}
+		return m
+	}
+
+	if m := expect(protocol.Hello); m.Version != protocol.Version {
+		t.Fatalf("unexpected version %d", m.Version)
+	}
+	// the web app does not send session IDs
+	if err := conn.WriteJSON(protocol.Request{ID: protocol.Link}); err != nil {
+		t.Fatal(err)
+	}
+	session := expect(protocol.Inserted).Session
+	expect(protocol.PINRequired)
+	if err := conn.WriteJSON(protocol.Request{ID: protocol.Sign, PIN: "123456", Challenge: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if m := expect(protocol.Signed); m.Session != session {
+		t.Fatalf("unexpected session %q, expected %q", m.Session, session)
+	}
+	expect(protocol.Proving)
+	if m := expect(protocol.Generated); m.Proof == nil {
+		t.Fatal("missing proof")
+	}
+
+	if err := conn.WriteMessage(websocket.TextMessage, []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	if m := expect(protocol.Error); m.Code != protocol.BadRequest {
+		t.Fatalf("unexpected code %s", m.Code)
+	}
+}
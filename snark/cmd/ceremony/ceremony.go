@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/groth16/bn254/mpcsetup"
+	"github.com/consensys/gnark/constraint"
+	"github.com/ritave/eIDAS-bridge/snark/ceremony"
+	"github.com/ritave/eIDAS-bridge/snark/circuits"
+	"github.com/ritave/eIDAS-bridge/snark/prover"
+)
+
+const (
+	NAME = "contract/EIDAS"
+)
+
+var (
+	files     = prover.DefaultFiles(prover.Groth16, NAME)
+	EVALSNAME = NAME + ".G16.evals"
+)
+
+var curve = ecc.BN254
+
+const usage = `subcommands:
+  ptau-new -power N -out FILE        initial powers of tau (phase 1)
+  ptau-contribute -in FILE -out FILE contribute to powers of tau
+  ptau-verify FILE...                verify powers of tau transcript
+  init -ptau FILES -out FILE         compile circuit and create initial phase 2
+  contribute -in FILE -out FILE      contribute to phase 2
+  verify -ptau FILES FILE...         verify phase 2 transcript
+  finalise -ptau FILES FILE...       verify phase 2 transcript and write keys
+
+-ptau is the comma separated powers of tau transcript, verified before use,
+or only its last contribution with its published -ptau-hash.`
+
+func main() {
+	flag.Usage = func() { fmt.Println(usage) }
+	flag.Parse()
+	args := flag.Args()
+	if len(args) < 1 {
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	var err error
+	switch args[0] {
+	case "ptau-new":
+		err = ptauNew(args[1:])
+	case "ptau-contribute":
+		err = ptauContribute(args[1:])
+	case "ptau-verify":
+		err = ptauVerify(args[1:])
+	case "init":
+		err = initPhase2(args[1:])
+	case "contribute":
+		err = contribute(args[1:])
+	case "verify":
+		err = verify(args[1:])
+	case "finalise":
+		err = finalise(args[1:])
+	default:
+		fmt.Println(usage)
+		os.Exit(1)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("OK!")
+}
+
+func ptauNew(args []string) error {
+	fs := flag.NewFlagSet("ptau-new", flag.ExitOnError)
+	power := fs.Int("power", 0, "log2 of the number of constraints")
+	out := fs.String("out", "", "output file")
+	fs.Parse(args)
+	if *power <= 0 || *out == "" {
+		return fmt.Errorf("-power and -out are required")
+	}
+	ptau := mpcsetup.InitPhase1(*power)
+	return ceremony.WriteFile(*out, &ptau)
+}
+
+func ptauContribute(args []string) error {
+	fs := flag.NewFlagSet("ptau-contribute", flag.ExitOnError)
+	in := fs.String("in", "", "previous contribution")
+	out := fs.String("out", "", "output file")
+	fs.Parse(args)
+	if *in == "" || *out == "" {
+		return fmt.Errorf("-in and -out are required")
+	}
+	ptau, err := ceremony.ReadPhase1(*in)
+	if err != nil {
+		return fmt.Errorf("read ptau: %w", err)
+	}
+	ptau.Contribute()
+	fmt.Printf("contribution hash %x\n", ptau.Hash)
+	return ceremony.WriteFile(*out, ptau)
+}
+
+func ptauVerify(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("need at least two contributions")
+	}
+	var transcript []*mpcsetup.Phase1
+	for _, name := range args {
+		ptau, err := ceremony.ReadPhase1(name)
+		if err != nil {
+			return fmt.Errorf("read ptau: %w", err)
+		}
+		transcript = append(transcript, ptau)
+	}
+	return mpcsetup.VerifyPhase1(transcript[0], transcript[1], transcript[2:]...)
+}
+
+func initPhase2(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	ptauFlags := addPtauFlags(fs)
+	out := fs.String("out", NAME+".G16.ph2.0", "initial phase 2 contribution")
+	fs.Parse(args)
+	ptau, err := ptauFlags.read()
+	if err != nil {
+		return err
+	}
+	var circuit circuits.FCircuit
+	ccs, err := ceremony.Compile(&circuit)
+	if err != nil {
+		return fmt.Errorf("compile: %w", err)
+	}
+	phase2, evals, err := ceremony.Init(ccs, ptau)
+	if err != nil {
+		return fmt.Errorf("init: %w", err)
+	}
+	if err := ceremony.WriteFile(files.CCS, ccs); err != nil {
+		return err
+	}
+	if err := ceremony.WriteFile(EVALSNAME, evals); err != nil {
+		return err
+	}
+	fmt.Printf("contribution hash %x\n", phase2.Hash)
+	return ceremony.WriteFile(*out, phase2)
+}
+
+func contribute(args []string) error {
+	fs := flag.NewFlagSet("contribute", flag.ExitOnError)
+	in := fs.String("in", "", "previous contribution")
+	out := fs.String("out", "", "output file")
+	fs.Parse(args)
+	if *in == "" || *out == "" {
+		return fmt.Errorf("-in and -out are required")
+	}
+	prev, err := ceremony.ReadPhase2(*in)
+	if err != nil {
+		return fmt.Errorf("read phase 2: %w", err)
+	}
+	next, err := ceremony.Contribute(prev)
+	if err != nil {
+		return fmt.Errorf("contribute: %w", err)
+	}
+	fmt.Printf("contribution hash %x\n", next.Hash)
+	return ceremony.WriteFile(*out, next)
+}
+
+func readTranscript(names []string) ([]*mpcsetup.Phase2, error) {
+	var transcript []*mpcsetup.Phase2
+	for _, name := range names {
+		c, err := ceremony.ReadPhase2(name)
+		if err != nil {
+			return nil, fmt.Errorf("read phase 2: %w", err)
+		}
+		transcript = append(transcript, c)
+	}
+	return transcript, nil
+}
+
+// ptauFlags are the powers of tau of the subcommands.
+type ptauFlags struct {
+	files *string
+	hash  *string
+}
+
+func addPtauFlags(fs *flag.FlagSet) ptauFlags {
+	return ptauFlags{
+		files: fs.String("ptau", "", "comma separated powers of tau transcript, the last one is used"),
+		hash:  fs.String("ptau-hash", "", "published hash of the powers of tau, when -ptau is only the last contribution"),
+	}
+}
+
+// read returns the last powers of tau after verifying the transcript or
+// its hash.
+func (f ptauFlags) read() (*mpcsetup.Phase1, error) {
+	if *f.files == "" {
+		return nil, fmt.Errorf("-ptau is required")
+	}
+	hash, err := hex.DecodeString(*f.hash)
+	if err != nil {
+		return nil, fmt.Errorf("-ptau-hash: %w", err)
+	}
+	var transcript []*mpcsetup.Phase1
+	for _, name := range strings.Split(*f.files, ",") {
+		ptau, err := ceremony.ReadPhase1(name)
+		if err != nil {
+			return nil, fmt.Errorf("read ptau: %w", err)
+		}
+		transcript = append(transcript, ptau)
+	}
+	ptau, err := ceremony.VerifyPhase1(transcript, hash)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("powers of tau hash %x\n", ptau.Hash)
+	return ptau, nil
+}
+
+// readSetup returns the verified powers of tau, the circuit and the
+// evaluations written by init, and the phase 2 transcript. The circuit is
+// compiled again, so a constraint system swapped by whoever supplied the
+// files is rejected.
+func readSetup(name string, args []string) (*mpcsetup.Phase1, constraint.ConstraintSystem, *mpcsetup.Phase2Evaluations, []*mpcsetup.Phase2, error) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	ptauFlags := addPtauFlags(fs)
+	fs.Parse(args)
+	ptau, err := ptauFlags.read()
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	transcript, err := readTranscript(fs.Args())
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+	evals, err := ceremony.ReadEvaluations(EVALSNAME)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("read evaluations: %w", err)
+	}
+	fccs, err := os.Open(files.CCS)
+	if err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("open ccs: %w", err)
+	}
+	defer fccs.Close()
+	ccs := groth16.NewCS(curve)
+	if _, err := ccs.ReadFrom(fccs); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("read ccs: %w", err)
+	}
+	var circuit circuits.FCircuit
+	if err := ceremony.CheckCircuit(ccs, &circuit); err != nil {
+		return nil, nil, nil, nil, fmt.Errorf("%s: %w", files.CCS, err)
+	}
+	return ptau, ccs, evals, transcript, nil
+}
+
+func verify(args []string) error {
+	ptau, ccs, evals, transcript, err := readSetup("verify", args)
+	if err != nil {
+		return err
+	}
+	return ceremony.Verify(ccs, ptau, evals, transcript)
+}
+
+func finalise(args []string) error {
+	ptau, ccs, evals, transcript, err := readSetup("finalise", args)
+	if err != nil {
+		return err
+	}
+	pk, vk, err := ceremony.Finalise(ccs, ptau, evals, transcript)
+	if err != nil {
+		return fmt.Errorf("finalise: %w", err)
+	}
+
+	keys := &prover.Keys{
+		Backend:   prover.Groth16,
+		CCS:       ccs,
+		Groth16PK: pk,
+		Groth16VK: vk,
+	}
+	if err := keys.Write(files); err != nil {
+		return err
+	}
+	if err := keys.ExportSolidity(files.Solidity); err != nil {
+		return err
+	}
+	m, err := prover.NewManifest(circuits.FCircuitName, circuits.FCircuitVersion, keys, files)
+	if err != nil {
+		return err
+	}
+	return m.Write(files.Manifest)
+}
@@ -1,24 +1,18 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	stdcrypto "crypto"
 	stdecdsa "crypto/ecdsa"
-	"crypto/sha256"
 	"crypto/x509"
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"math/big"
 	"os"
+	"strings"
 
-	"github.com/consensys/gnark-crypto/ecc"
-	"github.com/consensys/gnark/backend"
-	"github.com/consensys/gnark/backend/groth16"
-	"github.com/consensys/gnark/constraint"
-	"github.com/consensys/gnark/constraint/solver"
-	"github.com/consensys/gnark/frontend"
-	"github.com/consensys/gnark/frontend/cs"
-	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark-crypto/kzg"
 	"github.com/consensys/gnark/std/math/emulated"
 	"github.com/consensys/gnark/std/math/uints"
 	"github.com/consensys/gnark/std/signature/ecdsa"
@@ -28,39 +22,69 @@ import (
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ritave/eIDAS-bridge/snark/cards"
+	"github.com/ritave/eIDAS-bridge/snark/cards/sig"
 	"github.com/ritave/eIDAS-bridge/snark/circuits"
 	"github.com/ritave/eIDAS-bridge/snark/p384"
+	"github.com/ritave/eIDAS-bridge/snark/prover"
 	"github.com/ritave/eIDAS-bridge/snark/verifier"
 	"golang.org/x/exp/slog"
 )
 
 const (
-	NAME = "contract/EIDAS.G16"
+	NAME = "contract/EIDAS"
 )
 
 var (
-	VKNAME  = NAME + ".vk"
-	PKNAME  = NAME + ".pk"
-	SOLNAME = NAME + ".sol"
-	CCSNAME = NAME + ".ccs"
+	backendName string
+	srsLoc      string
+	releaseKey  string
+	runtimeLoc  string
 )
 
-var curve = ecc.BN254
-
 func main() {
+	flag.StringVar(&backendName, "backend", string(prover.Groth16), "proving backend, 'groth16' or 'plonk'")
+	flag.StringVar(&srsLoc, "srs", "", "location of KZG SRS for plonk")
+	flag.StringVar(&releaseKey, "release-key", "", "file with the Ed25519 release key signing the manifest")
+	flag.StringVar(&runtimeLoc, "runtime", "contract/build/Verifier.bin-runtime", "hex runtime bytecode of the verifier from solc --bin-runtime, for 'code'")
 	flag.Parse()
 	args := flag.Args()
 	if len(args) != 1 {
-		fmt.Println("subcommand 'generate' or 'test'")
+		fmt.Println("subcommand 'generate', 'code', 'srs', 'key', 'sign' or 'test'")
+		os.Exit(1)
+	}
+	b, err := prover.ParseBackend(backendName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
 	switch args[0] {
 	case "generate":
-		if err := generateGroth16(); err != nil {
+		if err := generate(b); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "code":
+		if err := verifierCode(prover.DefaultFiles(b, NAME).Manifest); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "srs":
+		if err := generateSRS(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "key":
+		if err := newReleaseKey(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case "sign":
+		if err := signManifest(prover.DefaultFiles(b, NAME).Manifest); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 	case "test":
-		ev, err := setup()
+		ev, err := setup(b)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -70,81 +94,144 @@ func main() {
 			os.Exit(1)
 		}
 	default:
-		fmt.Println("unknown subcommand. valid commands 'generate' and 'test'")
+		fmt.Println("unknown subcommand. valid commands 'generate', 'code', 'srs', 'key', 'sign' and 'test'")
 	}
 	fmt.Println("OK!")
 }
 
-func generateGroth16() error {
+func generate(b prover.Backend) error {
 	var circuit circuits.FCircuit
 
-	ccs, err := frontend.Compile(curve.ScalarField(), r1cs.NewBuilder, &circuit)
+	ccs, err := b.Compile(&circuit)
 	if err != nil {
 		return err
 	}
-	pk, vk, err := groth16.Setup(ccs)
+	var srs kzg.SRS
+	if b == prover.Plonk {
+		if srsLoc == "" {
+			return fmt.Errorf("plonk requires -srs")
+		}
+		if srs, err = prover.ReadSRS(srsLoc); err != nil {
+			return err
+		}
+	}
+	keys, err := prover.Setup(b, ccs, srs)
 	if err != nil {
 		return err
 	}
-
-	fccs, err := os.Create(CCSNAME)
-	if err != nil {
+	files := prover.DefaultFiles(b, NAME)
+	if err := keys.Write(files); err != nil {
 		return err
 	}
-	defer fccs.Close()
-	_, err = ccs.WriteTo(fccs)
+	// PLONK proofs are only verified off-chain
+	if b == prover.Groth16 {
+		if err := keys.ExportSolidity(files.Solidity); err != nil {
+			return err
+		}
+	}
+	m, err := prover.NewManifest(circuits.FCircuitName, circuits.FCircuitVersion, keys, files)
 	if err != nil {
 		return err
 	}
+	if err := m.Write(files.Manifest); err != nil {
+		return err
+	}
+	if releaseKey == "" {
+		return nil
+	}
+	return signManifest(files.Manifest)
+}
 
-	fvk, err := os.Create(VKNAME)
+// verifierCode records the -runtime bytecode compiled from the exported
+// Solidity in the manifest, signing it again with -release-key.
+func verifierCode(manifest string) error {
+	data, err := os.ReadFile(runtimeLoc)
 	if err != nil {
 		return err
 	}
-	defer fvk.Close()
-	_, err = vk.WriteRawTo(fvk)
+	code, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(string(data)), "0x"))
+	if err != nil {
+		return fmt.Errorf("%s: %w", runtimeLoc, err)
+	}
+	m, err := prover.ReadManifest(manifest)
 	if err != nil {
 		return err
 	}
+	if err := m.SetVerifierCode(code); err != nil {
+		return err
+	}
+	if err := m.Write(manifest); err != nil {
+		return err
+	}
+	if releaseKey == "" {
+		return nil
+	}
+	return signManifest(manifest)
+}
 
-	fpk, err := os.Create(PKNAME)
+// newReleaseKey creates the -release-key file and prints the public key to
+// pin in the bridge.
+func newReleaseKey() error {
+	if releaseKey == "" {
+		return fmt.Errorf("missing -release-key output location")
+	}
+	key, err := prover.NewReleaseKey(releaseKey)
 	if err != nil {
 		return err
 	}
-	defer fpk.Close()
-	_, err = pk.WriteRawTo(fpk)
+	fmt.Printf("release key %x\n", key.Public())
+	return nil
+}
+
+// signManifest signs the manifest with the -release-key.
+func signManifest(manifest string) error {
+	if releaseKey == "" {
+		return fmt.Errorf("missing -release-key")
+	}
+	key, err := prover.ReadReleaseKey(releaseKey)
 	if err != nil {
 		return err
 	}
+	return prover.SignManifest(manifest, key)
+}
 
-	fsol, err := os.Create(SOLNAME)
+// generateSRS creates an insecure KZG SRS sized for the PLONK circuit. The
+// randomness is known to whoever runs it, use a SRS from a public ceremony
+// for deployment.
+func generateSRS() error {
+	if srsLoc == "" {
+		return fmt.Errorf("missing -srs output location")
+	}
+	var circuit circuits.FCircuit
+	ccs, err := prover.Plonk.Compile(&circuit)
 	if err != nil {
 		return err
 	}
-	defer fsol.Close()
-	err = vk.ExportSolidity(fsol)
+	srs, err := prover.NewDevSRS(prover.SRSSize(ccs))
 	if err != nil {
 		return err
 	}
-
-	return nil
+	fsrs, err := os.Create(srsLoc)
+	if err != nil {
+		return err
+	}
+	defer fsrs.Close()
+	_, err = srs.WriteTo(fsrs)
+	return err
 }
 
 type ethVerifier struct {
 	// backend
 	backend *backends.SimulatedBackend
 
-	// verifier contract
+	// verifier contract, only for groth16
 	verifierContract *verifier.Verifier
 
-	// groth16 gnark objects
-	vk      groth16.VerifyingKey
-	pk      groth16.ProvingKey
-	circuit circuits.FCircuit
-	r1cs    constraint.ConstraintSystem
+	// gnark objects
+	keys *prover.Keys
 }
 
-func setup() (*ethVerifier, error) {
+func setup(b prover.Backend) (*ethVerifier, error) {
 	const gasLimit uint64 = 4712388
 
 	// setup simulated backend
@@ -163,51 +250,47 @@ func setup() (*ethVerifier, error) {
 
 	newbackend := backends.NewSimulatedBackend(genesis, gasLimit)
 
-	// deploy verifier contract
-	caddr, _, v, err := verifier.DeployVerifier(auth, newbackend)
+	files := prover.DefaultFiles(b, NAME)
+	m, err := prover.ReadManifest(files.Manifest)
 	if err != nil {
-		return nil, fmt.Errorf("new verifier: %w", err)
+		return nil, err
 	}
-	newbackend.Commit()
-	fmt.Printf("deployed contract at %s\n", caddr)
-
-	fccs, err := os.Open(CCSNAME)
-	if err != nil {
-		return nil, fmt.Errorf("open ccs: %w", err)
+	if err := m.CheckFiles(files); err != nil {
+		return nil, err
 	}
-	defer fccs.Close()
-	ccs := groth16.NewCS(curve)
-	_, err = ccs.ReadFrom(fccs)
+	keys, err := prover.Read(b, files, &circuits.FCircuit{})
 	if err != nil {
-		return nil, fmt.Errorf("read ccs: %w", err)
+		return nil, fmt.Errorf("read keys: %w", err)
 	}
-	fpk, err := os.Open(PKNAME)
-	if err != nil {
-		return nil, fmt.Errorf("open pk: %w", err)
+	if err := m.CheckKeys(circuits.FCircuitName, circuits.FCircuitVersion, keys); err != nil {
+		return nil, err
 	}
-	defer fpk.Close()
-	pk := groth16.NewProvingKey(curve)
-	_, err = pk.ReadFrom(fpk)
-	if err != nil {
-		return nil, fmt.Errorf("read pk: %w", err)
+
+	if b == prover.Plonk {
+		// PLONK proofs are only verified off-chain
+		return &ethVerifier{backend: newbackend, keys: keys}, nil
 	}
-	fvk, err := os.Open(VKNAME)
+
+	// deploy verifier contract
+	caddr, _, v, err := verifier.DeployVerifier(auth, newbackend)
 	if err != nil {
-		return nil, fmt.Errorf("open vk: %w", err)
+		return nil, fmt.Errorf("new verifier: %w", err)
 	}
-	defer fvk.Close()
-	vk := groth16.NewVerifyingKey(curve)
-	_, err = vk.ReadFrom(fvk)
+	newbackend.Commit()
+	fmt.Printf("deployed contract at %s\n", caddr)
+
+	code, err := newbackend.CodeAt(context.Background(), caddr, nil)
 	if err != nil {
-		return nil, fmt.Errorf("read vk: %w", err)
+		return nil, fmt.Errorf("contract code: %w", err)
+	}
+	// the groth16 binding has to be regenerated after every setup
+	if err := m.CheckContractCode(code); err != nil {
+		return nil, err
 	}
 	return &ethVerifier{
 		backend:          newbackend,
 		verifierContract: v,
-		vk:               vk,
-		pk:               pk,
-		circuit:          circuits.FCircuit{},
-		r1cs:             ccs,
+		keys:             keys,
 	}, nil
 }
 
@@ -223,7 +306,7 @@ func run(ev *ethVerifier) error {
 	}
 	// circuit := &FCircuit{}
 	assignment := circuits.FCircuit{
-		Challenge: [32]uints.U8(uints.NewU8Array(make([]uint8, 32))),
+		Challenge: [circuits.ChallengeSize]uints.U8(uints.NewU8Array(circuits.Challenge(challenge))),
 		ChallengeSignature: ecdsa.Signature[p384.P384Fr]{
 			R: emulated.ValueOf[p384.P384Fr](r),
 			S: emulated.ValueOf[p384.P384Fr](s),
@@ -233,63 +316,24 @@ func run(ev *ethVerifier) error {
 			Y: emulated.ValueOf[p384.P384Fp](pub.Y),
 		},
 	}
-	copy(assignment.Challenge[:], uints.NewU8Array(challenge))
 
-	// witness creation
-	witness, err := frontend.NewWitness(&assignment, curve.ScalarField())
-	if err != nil {
-		return fmt.Errorf("new witness: %w", err)
-	}
-
-	// prove
-	proof, err := groth16.Prove(ev.r1cs, ev.pk, witness, backend.WithSolverOptions(solver.OverrideHint(
-		solver.GetHintID(cs.Bsb22CommitmentComputePlaceholder), func(mod *big.Int, input, output []*big.Int) error {
-			toHash := make([]byte, 0, (1+mod.BitLen()/8)*len(input))
-			for _, in := range input {
-				inBytes := in.Bytes()
-				toHash = append(toHash, inBytes[:]...)
-			}
-			hsh := sha256.New().Sum(toHash)
-			output[0].SetBytes(hsh)
-			output[0].Mod(output[0], mod)
-			return nil
-		})))
+	// prove, ensures gnark (Go) code verifies it
+	proof, err := ev.keys.Prove(&assignment)
 	if err != nil {
 		return fmt.Errorf("prove: %w", err)
 	}
 
-	// ensure gnark (Go) code verifies it
-	publicWitness, err := witness.Public()
-	if err != nil {
-		return fmt.Errorf("new public witness: %w", err)
+	if ev.verifierContract == nil {
+		fmt.Printf("%s proofs are only verified off-chain\n", ev.keys.Backend)
+		return nil
 	}
-	if err = groth16.Verify(proof, ev.vk, publicWitness); err != nil {
-		return fmt.Errorf("verify: %w", err)
-	}
-
-	// get proof bytes
-	const fpSize = 4 * 8
-	var buf bytes.Buffer
-	proof.WriteRawTo(&buf)
-	proofBytes := buf.Bytes()
 
 	// solidity contract inputs
-	var (
-		a     [2]*big.Int
-		b     [2][2]*big.Int
-		c     [2]*big.Int
-		input [32]*big.Int
-	)
-
-	// proof.Ar, proof.Bs, proof.Krs
-	a[0] = new(big.Int).SetBytes(proofBytes[fpSize*0 : fpSize*1])
-	a[1] = new(big.Int).SetBytes(proofBytes[fpSize*1 : fpSize*2])
-	b[0][0] = new(big.Int).SetBytes(proofBytes[fpSize*2 : fpSize*3])
-	b[0][1] = new(big.Int).SetBytes(proofBytes[fpSize*3 : fpSize*4])
-	b[1][0] = new(big.Int).SetBytes(proofBytes[fpSize*4 : fpSize*5])
-	b[1][1] = new(big.Int).SetBytes(proofBytes[fpSize*5 : fpSize*6])
-	c[0] = new(big.Int).SetBytes(proofBytes[fpSize*6 : fpSize*7])
-	c[1] = new(big.Int).SetBytes(proofBytes[fpSize*7 : fpSize*8])
+	var input [32]*big.Int
+	a, b, c, err := proof.Groth16Calldata()
+	if err != nil {
+		return fmt.Errorf("calldata: %w", err)
+	}
 
 	// public witness
 	for i := range assignment.Challenge {
@@ -320,7 +364,10 @@ func run(ev *ethVerifier) error {
 }
 
 func getSigner() (*x509.Certificate, *stdecdsa.PublicKey, stdcrypto.Signer, error) {
-	ctx := cards.New("/opt/homebrew/lib/opensc-pkcs11.so", "123456")
+	ctx, err := cards.FromEnv()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("cards: %w", err)
+	}
 	slog.Info("enumerating smart cards")
 	tokens, err := ctx.EnumerateTokens()
 	if err != nil {
@@ -334,7 +381,20 @@ func getSigner() (*x509.Certificate, *stdecdsa.PublicKey, stdcrypto.Signer, erro
 		return nil, nil, nil, fmt.Errorf("not one token")
 	}
 	slog.Info("chosen token:", tokens[0].Label)
-	cert, pub, priv, err := ctx.GetSigner(tokens[0])
+	src := cards.Identities(ctx, tokens[0])
+	certs, err := src.Certificates(context.Background())
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("certificates: %w", err)
+	}
+	if len(certs) != 1 {
+		return nil, nil, nil, fmt.Errorf("%d certificates match the key policy", len(certs))
+	}
+	cert := certs[0]
+	pub, ok := cert.PublicKey.(*stdecdsa.PublicKey)
+	if !ok {
+		return nil, nil, nil, fmt.Errorf("certificate key %T is not ECDSA", cert.PublicKey)
+	}
+	priv, err := src.Signer(context.Background(), cert)
 	if err != nil {
 		return nil, nil, nil, fmt.Errorf("get signer: %w", err)
 	}
@@ -345,16 +405,20 @@ func getSigner() (*x509.Certificate, *stdecdsa.PublicKey, stdcrypto.Signer, erro
 
 func sign(signer stdcrypto.Signer, challenge []byte) (r, s *big.Int, err error) {
 	slog.Info("creating signature for challenge: %s", challenge)
-	challenge = append(challenge, make([]byte, 32-len(challenge))...)
-	signature, err := signer.Sign(nil, challenge, nil)
+	signature, err := signer.Sign(nil, circuits.ChallengeDigest(circuits.Challenge(challenge)), stdcrypto.SHA256)
 	if err != nil {
 		return nil, nil, fmt.Errorf("sign %w", err)
 	}
 	slog.Info("signature %x\n", signature)
-	r, s, err = cards.UnmarshalSignature(signature)
+	pub, ok := signer.Public().(*stdecdsa.PublicKey)
+	if !ok {
+		return nil, nil, fmt.Errorf("signer key %T is not ECDSA", signer.Public())
+	}
+	r, s, err = sig.Unmarshal(signature, pub.Curve)
 	if err != nil {
 		return nil, nil, fmt.Errorf("unmarshal %w", err)
 	}
+	s = sig.NormalizeS(pub.Curve, s)
 	slog.Info("unmarshalled signature r=%s s=%s\n", r, s)
 	return r, s, nil
 }
@@ -1,14 +1,38 @@
 package main
 
 import (
+	"os"
 	"testing"
+
+	"github.com/ritave/eIDAS-bridge/snark/prover"
 )
 
-func TestRun(t *testing.T) {
-	ev, err := setup()
+// testSetup deploys the verifier of the artifacts of 'generate', PLONK
+// proofs are verified off-chain only. The setup of the full circuit takes too
+// long for a test, so the test is skipped without them.
+func testSetup(t *testing.T, b prover.Backend) *ethVerifier {
+	if testing.Short() {
+		t.Skip("proves the full circuit")
+	}
+	if _, err := os.Stat(prover.DefaultFiles(b, NAME).Manifest); os.IsNotExist(err) {
+		t.Skipf("no %s artifacts, run 'go run . -backend %s generate' in cmd/contract first", b, b)
+	}
+	ev, err := setup(b)
 	if err != nil {
 		t.Fatal(err)
 	}
+	return ev
+}
+
+func TestRun(t *testing.T) {
+	ev := testSetup(t, prover.Groth16)
+	if err := run(ev); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunPlonk(t *testing.T) {
+	ev := testSetup(t, prover.Plonk)
 	if err := run(ev); err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,236 @@
+// Command inspect prints the certificates of the cards, or of certificate
+// files, with the byte layout Circuit depends on, and whether the compiled
+// circuits can prove them. It is used when onboarding the eID cards of a new
+// country.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/ritave/eIDAS-bridge/snark/cards"
+	"github.com/ritave/eIDAS-bridge/snark/cert"
+	"github.com/ritave/eIDAS-bridge/snark/circuits"
+)
+
+var libLoc string
+var pivKey string
+var cscURL string
+var soft bool
+
+func main() {
+	flag.StringVar(&libLoc, "module", "", "location of the PKCS#11 module, or a list separated like $PATH to try in order (default discovered, see cards.Candidates)")
+	flag.StringVar(&pivKey, "piv", "", "read PIV cards over PC/SC instead of a PKCS#11 module, the certificate of the key reference, e.g. 9a or 9c (requires the pcsc build tag)")
+	flag.StringVar(&cscURL, "csc", "", "read the credentials of a Cloud Signature Consortium API v2 service at the base URL, with the access token in $EIDAS_CSC_TOKEN")
+	flag.BoolVar(&soft, "soft", false, "read an in-memory software token")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [flags] [certificate.pem|.der ...]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	var err error
+	if flag.NArg() > 0 {
+		err = inspectFiles(os.Stdout, flag.Args())
+	} else {
+		err = inspectTokens(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// backend returns the card backend of the flags.
+func backend() (cards.Backend, error) {
+	if soft {
+		return cards.NewSoftToken(cards.DefaultSubject)
+	}
+	if cscURL != "" {
+		return cards.NewCSC(cscURL, os.Getenv("EIDAS_CSC_TOKEN")), nil
+	}
+	if pivKey != "" {
+		key, err := strconv.ParseUint(pivKey, 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("piv key %q: %w", pivKey, err)
+		}
+		p := cards.NewPIV(cards.PCSCReaders)
+		p.Key = byte(key)
+		return p, nil
+	}
+	path, err := cards.Discover(filepath.SplitList(libLoc)...)
+	if err != nil {
+		return nil, err
+	}
+	return cards.New(path, ""), nil
+}
+
+func inspectTokens(w io.Writer) error {
+	b, err := backend()
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+	if ctx, ok := b.(*cards.Config); ok {
+		info, err := ctx.Module()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "module %s\n", info)
+	}
+	tokens, err := b.EnumerateTokens()
+	if err != nil {
+		return fmt.Errorf("enumerate: %w", err)
+	}
+	if len(tokens) == 0 {
+		return errors.New("no tokens")
+	}
+	for _, t := range tokens {
+		fmt.Fprintf(w, "\ntoken %d %q serial %s manufacturer %q\n", t.Slot, t.Label, t.Serial, t.Manufacturer)
+		// every certificate of a PKCS#11 token, not only the ones of the key
+		// policy, the bridge only signs with those with a key
+		if ctx, ok := b.(*cards.Config); ok {
+			keys, skipped, err := ctx.CertificateObjects(t)
+			if err != nil {
+				return fmt.Errorf("token %q: %w", t.Label, err)
+			}
+			for _, err := range skipped {
+				fmt.Fprintf(w, "\nskipped %v\n", err)
+			}
+			for _, k := range keys {
+				if k.Paired {
+					fmt.Fprintf(w, "\nkey %x %q\n", k.ID, k.Label)
+				} else {
+					fmt.Fprintf(w, "\ncertificate %x %q without a key listed before the login\n", k.ID, k.Label)
+				}
+				if err := report(w, k.Certificate); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		certs, err := b.Certificates(t)
+		if err != nil {
+			return fmt.Errorf("token %q: %w", t.Label, err)
+		}
+		for _, c := range certs {
+			fmt.Fprintln(w)
+			if err := report(w, c); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// inspectFiles reports the certificates in PEM or DER files.
+func inspectFiles(w io.Writer, files []string) error {
+	for _, name := range files {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		ders := [][]byte{data}
+		if block, rest := pem.Decode(data); block != nil {
+			ders = nil
+			for ; block != nil; block, rest = pem.Decode(rest) {
+				if block.Type == "CERTIFICATE" {
+					ders = append(ders, block.Bytes)
+				}
+			}
+		}
+		for _, der := range ders {
+			c, err := x509.ParseCertificate(der)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			fmt.Fprintf(w, "%s\n", name)
+			if err := report(w, c); err != nil {
+				return err
+			}
+			fmt.Fprintln(w)
+		}
+	}
+	return nil
+}
+
+// report prints the certificate, its layout against the one of Circuit and
+// whether the circuits prove it.
+func report(w io.Writer, c *x509.Certificate) error {
+	crt, err := cert.Unmarshal(c.Raw)
+	if err != nil {
+		return fmt.Errorf("certificate %q: %w", c.Subject.CommonName, err)
+	}
+	tbs := crt.TBSCertificate
+	fmt.Fprintf(w, "  subject:        %s\n", c.Subject)
+	fmt.Fprintf(w, "  issuer:         %s\n", c.Issuer)
+	fmt.Fprintf(w, "  serial:         %s\n", hex.EncodeToString(tbs.SerialNumber.Bytes()))
+	fmt.Fprintf(w, "  validity:       %s to %s\n", tbs.Validity.NotBefore.Format("2006-01-02"), tbs.Validity.NotAfter.Format("2006-01-02"))
+	fmt.Fprintf(w, "  fingerprint:    %x\n", cards.Fingerprint(c))
+	fmt.Fprintf(w, "  key:            %s (%s)\n", keyName(c), tbs.PublicKey.Algorithm.Algorithm)
+	fmt.Fprintf(w, "  signature:      %s (%s)\n", c.SignatureAlgorithm, crt.SignatureAlgorithm.Algorithm)
+	fmt.Fprintf(w, "  key usage:      %s\n", keyUsage(c.KeyUsage))
+
+	l, err := circuits.LayoutOf(c.Raw)
+	if err != nil {
+		fmt.Fprintf(w, "  layout:         %v\n", err)
+	} else {
+		want := circuits.CircuitLayout
+		fmt.Fprintf(w, "  size:           %d bytes, TBS %d (circuit %d, %d)\n", l.CertificateSize, l.TBSSize, want.CertificateSize, want.TBSSize)
+		fmt.Fprintf(w, "  subject CN:     TBS offset %d, %d bytes (circuit %d, %d)\n", l.SubjectOffset, l.SubjectSize, want.SubjectOffset, want.SubjectSize)
+		fmt.Fprintf(w, "  public key:     TBS offset %d, %d bytes (circuit %d, %d)\n", l.PubkeyOffset, l.PubkeySize, want.PubkeyOffset, want.PubkeySize)
+		fmt.Fprintf(w, "  signature r, s: offset %d, %d bytes (circuit %d, %d)\n", l.SignatureOffset, l.SignatureSize, want.SignatureOffset, want.SignatureSize)
+	}
+	fmt.Fprintf(w, "  FCircuit:       %s\n", provable(circuits.CheckKey(c.PublicKey)))
+	fmt.Fprintf(w, "  Circuit:        %s\n", provable(circuits.CheckCertificate(c)))
+	return nil
+}
+
+func keyName(c *x509.Certificate) string {
+	if pub, ok := c.PublicKey.(*ecdsa.PublicKey); ok {
+		return "ECDSA " + pub.Curve.Params().Name
+	}
+	return c.PublicKeyAlgorithm.String()
+}
+
+var keyUsages = []struct {
+	usage x509.KeyUsage
+	name  string
+}{
+	{x509.KeyUsageDigitalSignature, "digitalSignature"},
+	{x509.KeyUsageContentCommitment, "nonRepudiation"},
+	{x509.KeyUsageKeyEncipherment, "keyEncipherment"},
+	{x509.KeyUsageDataEncipherment, "dataEncipherment"},
+	{x509.KeyUsageKeyAgreement, "keyAgreement"},
+	{x509.KeyUsageCertSign, "keyCertSign"},
+	{x509.KeyUsageCRLSign, "cRLSign"},
+}
+
+func keyUsage(u x509.KeyUsage) string {
+	var names []string
+	for _, k := range keyUsages {
+		if u&k.usage != 0 {
+			names = append(names, k.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+func provable(problems []string) string {
+	if len(problems) == 0 {
+		return "provable"
+	}
+	return "not provable: " + strings.Join(problems, "; ")
+}
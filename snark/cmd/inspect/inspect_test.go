@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ritave/eIDAS-bridge/snark/cards"
+)
+
+func TestInspectFiles(t *testing.T) {
+	s, err := cards.NewSoftToken(cards.DefaultSubject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "P-256 card"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	other, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	pemFile := filepath.Join(dir, "certs.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: other})...)
+	if err := os.WriteFile(pemFile, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	derFile := filepath.Join(dir, "cert.der")
+	if err := os.WriteFile(derFile, other, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := inspectFiles(&out, []string{pemFile, derFile}); err != nil {
+		t.Fatal(err)
+	}
+	reports := strings.Split(strings.TrimSpace(out.String()), "\n\n")
+	if len(reports) != 3 {
+		t.Fatalf("expected 3 reports, got %d:\n%s", len(reports), out.String())
+	}
+	for _, want := range []string{"key:            ECDSA P-384", "subject CN:     TBS offset 132, 11 bytes", "FCircuit:       provable", "Circuit:        provable"} {
+		if !strings.Contains(reports[0], want) {
+			t.Errorf("%q missing from\n%s", want, reports[0])
+		}
+	}
+	for _, r := range reports[1:] {
+		for _, want := range []string{"key:            ECDSA P-256", "FCircuit:       not provable: curve P-256 is not P-384", "Circuit:        not provable"} {
+			if !strings.Contains(r, want) {
+				t.Errorf("%q missing from\n%s", want, r)
+			}
+		}
+	}
+}
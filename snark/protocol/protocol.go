@@ -0,0 +1,183 @@
+// Package protocol defines the JSON messages exchanged between the bridge and
+// its clients, over WebSocket or as lines on stdin and stdout.
+//
+// Every message is an object whose "id" names its type. A client sends
+// HELLO, LINK, SIGN and CANCEL requests. The bridge greets with HELLO,
+// reports the artifact load with LOADING and LOADED, and then runs the
+// sessions:
+//
+//	LINK       -> INSERTED, PIN_REQUIRED with the PIN retry state
+//	SIGN       -> SIGNED, PROVING..., GENERATED
+//
+// When several cards are present the bridge sends CHOOSE with the cards
+// before INSERTED, and the client picks one with SELECT.
+//
+// For a card in a pinpad reader INSERTED has pinPad set and PIN_REQUIRED is
+// skipped. The client sends SIGN with the challenge only, and the bridge asks
+// for the PIN on the reader with PIN_PAD before SIGNED.
+//
+// Any step may instead end the session with ERROR, whose code tells the
+// client what went wrong. Messages of a session carry its ID.
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+)
+
+// Version is the protocol version, incremented on incompatible changes.
+const Version = 1
+
+// Requests sent by the client. HELLO is also sent by the bridge when a
+// client connects and in reply to HELLO, with its version and backend.
+const (
+	Hello  = "HELLO"  // version, the bridge replies ERROR if it does not speak it
+	Link   = "LINK"   // session, optional, starts a session
+	Sign   = "SIGN"   // session, pin, challenge
+	Select = "SELECT" // session, slot of a card of CHOOSE
+	Cancel = "CANCEL" // session
+)
+
+// Messages sent by the bridge.
+const (
+	// LOADING reports read of total artifact bytes.
+	Loading = "LOADING"
+	// LOADED is sent once the keys are loaded and checked.
+	Loaded = "LOADED"
+	// CHOOSE lists the cards when several are present.
+	Choose = "CHOOSE"
+	// INSERTED is sent when the card of the session is present.
+	Inserted = "INSERTED"
+	// PIN_REQUIRED asks for the PIN and challenge of the session.
+	PINRequired = "PIN_REQUIRED"
+	// PIN_PAD asks the user to enter the PIN on the reader.
+	PINPad = "PIN_PAD"
+	// SIGNED is sent when the card signed the challenge.
+	Signed = "SIGNED"
+	// PROVING reports the stage of the proof generation.
+	Proving = "PROVING"
+	// GENERATED carries the proof and ends the session.
+	Generated = "GENERATED"
+	// ERROR carries code and error and ends the session, if any.
+	Error = "ERROR"
+)
+
+// Code classifies an ERROR.
+type Code string
+
+const (
+	WrongPIN           Code = "WRONG_PIN"
+	PINLocked          Code = "PIN_LOCKED"
+	CardRemoved        Code = "CARD_REMOVED"
+	KeyMismatch        Code = "KEY_MISMATCH" // artifacts do not match the manifest or contract
+	Artifacts          Code = "ARTIFACTS"    // artifacts missing or unreadable
+	BadRequest         Code = "BAD_REQUEST"
+	UnknownSession     Code = "UNKNOWN_SESSION"
+	UnsupportedVersion Code = "UNSUPPORTED_VERSION"
+	Internal           Code = "INTERNAL"
+)
+
+// Request is a message sent by the client.
+type Request struct {
+	ID        string `json:"id"`
+	Session   string `json:"session,omitempty"`
+	Version   int    `json:"version,omitempty"`
+	PIN       string `json:"pin,omitempty"`
+	Challenge string `json:"challenge,omitempty"`
+	Slot      *uint  `json:"slot,omitempty"`
+}
+
+// Message is a message sent by the bridge. Only the fields of its ID are set.
+type Message struct {
+	ID      string `json:"id"`
+	Session string `json:"session,omitempty"`
+
+	Version int        `json:"version,omitempty"` // HELLO
+	PINPad  bool       `json:"pinPad,omitempty"`  // INSERTED
+	Backend string     `json:"backend,omitempty"` // HELLO
+	Module  string     `json:"module,omitempty"`  // HELLO
+	Read    int64      `json:"read,omitempty"`    // LOADING
+	Total   int64      `json:"total,omitempty"`   // LOADING
+	Stage   string     `json:"stage,omitempty"`   // PROVING
+	Proof   *Proof     `json:"proof,omitempty"`   // GENERATED
+	Code    Code       `json:"code,omitempty"`    // ERROR
+	Error   string     `json:"error,omitempty"`   // ERROR
+	PIN     *PINStatus `json:"pin,omitempty"`     // PIN_REQUIRED, ERROR WRONG_PIN and PIN_LOCKED
+	Tokens  []Token    `json:"tokens,omitempty"`  // CHOOSE
+}
+
+// Token is a card offered by CHOOSE.
+type Token struct {
+	Slot         uint   `json:"slot"`
+	Label        string `json:"label"`
+	Serial       string `json:"serial"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+}
+
+// PINStatus is the retry state of the card PIN, so that the client can warn
+// before the card locks.
+type PINStatus struct {
+	Attempts int  `json:"attempts"`           // left, -1 if the card only tells there is more than one
+	CountLow bool `json:"countLow,omitempty"` // an incorrect PIN was entered since the last login
+}
+
+// Proof is the proof with its public input. A, B and C are set for Groth16 in
+// the form expected by the Solidity verifier, Plonk is the raw PLONK proof.
+type Proof struct {
+	A     *[2]*big.Int    `json:",omitempty"`
+	B     *[2][2]*big.Int `json:",omitempty"`
+	C     *[2]*big.Int    `json:",omitempty"`
+	Plonk hexutil.Bytes   `json:",omitempty"`
+	Input [32]*big.Int
+}
+
+// Err is an error with a protocol code.
+type Err struct {
+	Code Code
+	Err  error
+	PIN  *PINStatus // set for WRONG_PIN and PIN_LOCKED
+}
+
+func (e *Err) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Err) Unwrap() error {
+	return e.Err
+}
+
+// Errorf formats an error with the code.
+func Errorf(code Code, format string, a ...any) error {
+	return &Err{Code: code, Err: fmt.Errorf(format, a...)}
+}
+
+// WithCode attaches the code to err, nil stays nil.
+func WithCode(code Code, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Err{Code: code, Err: err}
+}
+
+// CodeOf returns the code of the first Err in the chain, INTERNAL if there is
+// none.
+func CodeOf(err error) Code {
+	var e *Err
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	return Internal
+}
+
+// NewError returns the ERROR message of err.
+func NewError(session string, err error) Message {
+	ret := Message{ID: Error, Session: session, Code: Internal, Error: err.Error()}
+	var e *Err
+	if errors.As(err, &e) {
+		ret.Code, ret.PIN = e.Code, e.PIN
+	}
+	return ret
+}
@@ -0,0 +1,46 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestCodeOf(t *testing.T) {
+	err := fmt.Errorf("sign: %w", Errorf(WrongPIN, "login: %w", errors.New("CKR_PIN_INCORRECT")))
+	if c := CodeOf(err); c != WrongPIN {
+		t.Fatalf("unexpected code %s", c)
+	}
+	if c := CodeOf(errors.New("boom")); c != Internal {
+		t.Fatalf("unexpected code %s", c)
+	}
+	if WithCode(PINLocked, nil) != nil {
+		t.Fatal("nil error got a code")
+	}
+}
+
+func TestMessageJSON(t *testing.T) {
+	bts, err := json.Marshal(NewError("s1", Errorf(CardRemoved, "card removed")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = `{"id":"ERROR","session":"s1","code":"CARD_REMOVED","error":"card removed"}`
+	if string(bts) != want {
+		t.Fatalf("got %s, expected %s", bts, want)
+	}
+	var req Request
+	if err := json.Unmarshal([]byte(`{"id":"SIGN","pin":"123456","challenge":"hello"}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.ID != Sign || req.PIN != "123456" || req.Challenge != "hello" {
+		t.Fatalf("unexpected request %+v", req)
+	}
+	req = Request{}
+	if err := json.Unmarshal([]byte(`{"id":"SELECT","slot":0}`), &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Slot == nil || *req.Slot != 0 {
+		t.Fatalf("slot 0 lost in %+v", req)
+	}
+}
@@ -0,0 +1,217 @@
+package prover
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const ManifestVersion = 1
+
+var (
+	ErrManifestMismatch = errors.New("artifacts do not match manifest")
+	ErrContractMismatch = errors.New("contract does not match verifying key")
+)
+
+// Manifest ties together the artifacts of a single setup. It is written by
+// the setup and checked before proving so that keys from different setups are
+// never mixed.
+type Manifest struct {
+	Version        int               `json:"version"`
+	Circuit        string            `json:"circuit"`
+	CircuitVersion int               `json:"circuitVersion"`
+	Backend        Backend           `json:"backend"`
+	Constraints    int               `json:"constraints"`
+	Public         int               `json:"public"`
+	Files          map[string]string `json:"files"` // artifact kind to hex SHA-256 of the file
+	VKHash         string            `json:"vkHash"`
+	// VerifierCode is the hex SHA-256 of the runtime bytecode of the Groth16
+	// verifier compiled from the exported Solidity, see SetVerifierCode.
+	VerifierCode string `json:"verifierCode,omitempty"`
+
+	authenticated bool
+}
+
+// NewManifest computes the manifest of the written artifacts. Files with an
+// empty location are skipped.
+func NewManifest(circuit string, circuitVersion int, keys *Keys, files Files) (*Manifest, error) {
+	vkHash, err := keys.VKHash()
+	if err != nil {
+		return nil, fmt.Errorf("vk hash: %w", err)
+	}
+	digests, err := fileDigests(files)
+	if err != nil {
+		return nil, err
+	}
+	return &Manifest{
+		Version:        ManifestVersion,
+		Circuit:        circuit,
+		CircuitVersion: circuitVersion,
+		Backend:        keys.Backend,
+		Constraints:    keys.CCS.GetNbConstraints(),
+		Public:         keys.CCS.GetNbPublicVariables(),
+		Files:          digests,
+		VKHash:         vkHash,
+	}, nil
+}
+
+func fileDigests(files Files) (map[string]string, error) {
+	ret := make(map[string]string)
+	for kind, name := range map[string]string{
+		"ccs": files.CCS,
+		"pk":  files.PK,
+		"vk":  files.VK,
+		"sol": files.Solidity,
+		"srs": files.SRS,
+	} {
+		if name == "" {
+			continue
+		}
+		dgst, err := fileDigest(name)
+		if err != nil {
+			return nil, fmt.Errorf("digest %s: %w", kind, err)
+		}
+		ret[kind] = dgst
+	}
+	return ret, nil
+}
+
+func fileDigest(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ReadManifest reads the manifest without checking its signature, see
+// ReadSignedManifest.
+func ReadManifest(name string) (*Manifest, error) {
+	bts, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	return parseManifest(bts)
+}
+
+func parseManifest(bts []byte) (*Manifest, error) {
+	var ret Manifest
+	if err := json.Unmarshal(bts, &ret); err != nil {
+		return nil, fmt.Errorf("unmarshal manifest: %w", err)
+	}
+	if ret.Version != ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", ret.Version)
+	}
+	return &ret, nil
+}
+
+func (m *Manifest) Write(name string) error {
+	bts, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(bts, '\n'), 0o644)
+}
+
+// CheckFiles ensures that the artifacts the manifest records a digest for
+// match the files. Call before loading the keys.
+func (m *Manifest) CheckFiles(files Files) error {
+	for kind, name := range map[string]string{
+		"ccs": files.CCS,
+		"pk":  files.PK,
+		"vk":  files.VK,
+		"srs": files.SRS,
+	} {
+		if name == "" {
+			continue
+		}
+		want, ok := m.Files[kind]
+		if !ok {
+			return fmt.Errorf("%w: no digest for %s", ErrManifestMismatch, kind)
+		}
+		got, err := fileDigest(name)
+		if err != nil {
+			return fmt.Errorf("digest %s: %w", kind, err)
+		}
+		if got != want {
+			return fmt.Errorf("%w: %s digest %s, expected %s", ErrManifestMismatch, kind, got, want)
+		}
+	}
+	return nil
+}
+
+// CheckKeys ensures that the loaded keys are the ones of the manifest.
+func (m *Manifest) CheckKeys(circuit string, circuitVersion int, keys *Keys) error {
+	if m.Circuit != circuit || m.CircuitVersion != circuitVersion {
+		return fmt.Errorf("%w: circuit %s v%d, expected %s v%d", ErrManifestMismatch, m.Circuit, m.CircuitVersion, circuit, circuitVersion)
+	}
+	if m.Backend != keys.Backend {
+		return fmt.Errorf("%w: backend %s, expected %s", ErrManifestMismatch, keys.Backend, m.Backend)
+	}
+	if n := keys.CCS.GetNbConstraints(); n != m.Constraints {
+		return fmt.Errorf("%w: %d constraints, expected %d", ErrManifestMismatch, n, m.Constraints)
+	}
+	vkHash, err := keys.VKHash()
+	if err != nil {
+		return fmt.Errorf("vk hash: %w", err)
+	}
+	if vkHash != m.VKHash {
+		return fmt.Errorf("%w: vk hash %s, expected %s", ErrManifestMismatch, vkHash, m.VKHash)
+	}
+	return nil
+}
+
+// VKHash returns the hex SHA-256 of the serialized verifying key.
+func (k *Keys) VKHash() (string, error) {
+	h := sha256.New()
+	var err error
+	switch k.Backend {
+	case Groth16:
+		_, err = k.Groth16VK.WriteRawTo(h)
+	case Plonk:
+		_, err = k.PlonkVK.WriteTo(h)
+	default:
+		err = fmt.Errorf("unknown backend %q", k.Backend)
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// SetVerifierCode records the runtime bytecode of the verifier contract, the
+// output of solc --bin-runtime for the exported Solidity verifier.
+func (m *Manifest) SetVerifierCode(code []byte) error {
+	if m.Backend != Groth16 {
+		return ErrOffChain
+	}
+	dgst := sha256.Sum256(code)
+	m.VerifierCode = hex.EncodeToString(dgst[:])
+	return nil
+}
+
+// CheckContractCode ensures that the deployed verifier bytecode is the one
+// recorded by SetVerifierCode, byte for byte. PLONK proofs are only verified
+// off-chain.
+func (m *Manifest) CheckContractCode(code []byte) error {
+	if m.Backend != Groth16 {
+		return ErrOffChain
+	}
+	if m.VerifierCode == "" {
+		return fmt.Errorf("%w: the manifest records no verifier code", ErrContractMismatch)
+	}
+	dgst := sha256.Sum256(code)
+	if got := hex.EncodeToString(dgst[:]); got != m.VerifierCode {
+		return fmt.Errorf("%w: code digest %s, expected %s", ErrContractMismatch, got, m.VerifierCode)
+	}
+	return nil
+}
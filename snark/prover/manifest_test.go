@@ -0,0 +1,102 @@
+package prover
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func setupFiles(t *testing.T, b Backend, circuit *squareCircuit) (*Keys, Files) {
+	ccs, err := b.Compile(circuit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srs, err := NewDevSRS(SRSSize(ccs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := Setup(b, ccs, srs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := DefaultFiles(b, filepath.Join(t.TempDir(), "TEST"))
+	if err := keys.Write(files); err != nil {
+		t.Fatal(err)
+	}
+	return keys, files
+}
+
+func TestManifest(t *testing.T) {
+	keys, files := setupFiles(t, Groth16, &squareCircuit{})
+	files.Solidity = ""
+	m, err := NewManifest("square", 1, keys, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Write(files.Manifest); err != nil {
+		t.Fatal(err)
+	}
+	m, err = ReadManifest(files.Manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CheckFiles(files); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Read(Groth16, files, &squareCircuit{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CheckKeys("square", 1, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CheckKeys("square", 2, loaded); !errors.Is(err, ErrManifestMismatch) {
+		t.Fatalf("expected circuit version mismatch, got %v", err)
+	}
+
+	// keys of another setup of the same circuit
+	other, otherFiles := setupFiles(t, Groth16, &squareCircuit{})
+	if err := m.CheckKeys("square", 1, other); !errors.Is(err, ErrManifestMismatch) {
+		t.Fatalf("expected vk mismatch, got %v", err)
+	}
+	files.PK = otherFiles.PK
+	if err := m.CheckFiles(files); !errors.Is(err, ErrManifestMismatch) {
+		t.Fatalf("expected pk mismatch, got %v", err)
+	}
+	if err := os.WriteFile(files.VK, []byte("garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files.PK = ""
+	if err := m.CheckFiles(files); !errors.Is(err, ErrManifestMismatch) {
+		t.Fatalf("expected vk mismatch, got %v", err)
+	}
+}
+
+func TestCheckContractCode(t *testing.T) {
+	m := &Manifest{Backend: Groth16}
+	code := []byte{0x60, 0x80, 0x60, 0x40, 0x52, 0x34, 0x80, 0x15}
+	if err := m.CheckContractCode(code); !errors.Is(err, ErrContractMismatch) {
+		t.Fatalf("expected no verifier code, got %v", err)
+	}
+	if err := m.SetVerifierCode(code); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.CheckContractCode(code); err != nil {
+		t.Fatal(err)
+	}
+	// a contract pushing the same constants among other code
+	for _, other := range [][]byte{append(append([]byte{}, code...), 0x00), code[1:]} {
+		if err := m.CheckContractCode(other); !errors.Is(err, ErrContractMismatch) {
+			t.Fatalf("expected contract mismatch, got %v", err)
+		}
+	}
+
+	plonk := &Manifest{Backend: Plonk}
+	if err := plonk.SetVerifierCode(code); !errors.Is(err, ErrOffChain) {
+		t.Fatalf("expected off-chain only, got %v", err)
+	}
+	if err := plonk.CheckContractCode(code); !errors.Is(err, ErrOffChain) {
+		t.Fatalf("expected off-chain only, got %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !unix
+
+package prover
+
+import "os"
+
+func mapFile(name string) ([]byte, func() error, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, func() error { return nil }, nil
+}
@@ -0,0 +1,443 @@
+// Package prover wraps the gnark proving backends so that the commands can
+// compile, set up, load and prove the circuits with either Groth16 or PLONK.
+package prover
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/consensys/gnark-crypto/ecc"
+	kzg_bn254 "github.com/consensys/gnark-crypto/ecc/bn254/fr/kzg"
+	"github.com/consensys/gnark-crypto/kzg"
+	"github.com/consensys/gnark/backend"
+	"github.com/consensys/gnark/backend/groth16"
+	"github.com/consensys/gnark/backend/plonk"
+	plonk_bn254 "github.com/consensys/gnark/backend/plonk/bn254"
+	"github.com/consensys/gnark/backend/witness"
+	"github.com/consensys/gnark/constraint"
+	"github.com/consensys/gnark/constraint/solver"
+	"github.com/consensys/gnark/frontend"
+	"github.com/consensys/gnark/frontend/cs"
+	"github.com/consensys/gnark/frontend/cs/r1cs"
+	"github.com/consensys/gnark/frontend/cs/scs"
+)
+
+var curve = ecc.BN254
+
+type Backend string
+
+const (
+	Groth16 Backend = "groth16"
+	Plonk   Backend = "plonk"
+)
+
+func ParseBackend(s string) (Backend, error) {
+	switch b := Backend(s); b {
+	case Groth16, Plonk:
+		return b, nil
+	default:
+		return "", fmt.Errorf("unknown backend %q, valid backends 'groth16' and 'plonk'", s)
+	}
+}
+
+// Files are the locations of the setup artifacts.
+type Files struct {
+	CCS      string
+	PK       string
+	VK       string
+	Solidity string // only for Groth16, PLONK proofs are verified off-chain
+	SRS      string // only for PLONK, the proving key does not contain it
+	Manifest string
+}
+
+// DefaultFiles returns the artifact locations for the backend with the given
+// prefix, e.g. EIDAS.G16.pk for Groth16 and EIDAS.PLONK.pk for PLONK.
+func DefaultFiles(b Backend, prefix string) Files {
+	name := prefix + ".G16"
+	if b == Plonk {
+		name = prefix + ".PLONK"
+	}
+	ret := Files{
+		CCS:      name + ".ccs",
+		PK:       name + ".pk",
+		VK:       name + ".vk",
+		Manifest: name + ".manifest.json",
+	}
+	if b == Plonk {
+		ret.SRS = name + ".srs"
+	} else {
+		ret.Solidity = name + ".sol"
+	}
+	return ret
+}
+
+// Compile compiles the circuit with the constraint system builder of the
+// backend, R1CS for Groth16 and SCS for PLONK.
+func (b Backend) Compile(circuit frontend.Circuit) (constraint.ConstraintSystem, error) {
+	switch b {
+	case Groth16:
+		return frontend.Compile(curve.ScalarField(), r1cs.NewBuilder, circuit)
+	case Plonk:
+		return frontend.Compile(curve.ScalarField(), scs.NewBuilder, circuit)
+	default:
+		return nil, fmt.Errorf("unknown backend %q", b)
+	}
+}
+
+// Keys holds the constraint system and the proving and verifying keys of one
+// of the backends. Only the keys of Backend are set.
+type Keys struct {
+	Backend Backend
+	CCS     constraint.ConstraintSystem
+
+	Groth16PK groth16.ProvingKey
+	Groth16VK groth16.VerifyingKey
+	PlonkPK   plonk.ProvingKey
+	PlonkVK   plonk.VerifyingKey
+	SRS       kzg.SRS
+}
+
+// Setup runs the setup for the backend. Groth16 runs the circuit specific
+// setup and ignores srs, PLONK requires an universal KZG SRS.
+func Setup(b Backend, ccs constraint.ConstraintSystem, srs kzg.SRS) (*Keys, error) {
+	ret := &Keys{Backend: b, CCS: ccs}
+	var err error
+	switch b {
+	case Groth16:
+		ret.Groth16PK, ret.Groth16VK, err = groth16.Setup(ccs)
+	case Plonk:
+		if srs == nil {
+			return nil, fmt.Errorf("plonk setup requires SRS")
+		}
+		ret.SRS = srs
+		ret.PlonkPK, ret.PlonkVK, err = plonk.Setup(ccs, srs)
+	default:
+		return nil, fmt.Errorf("unknown backend %q", b)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("setup: %w", err)
+	}
+	return ret, nil
+}
+
+// SRSSize returns the minimal size of the KZG SRS for the PLONK constraint
+// system.
+func SRSSize(ccs constraint.ConstraintSystem) uint64 {
+	return ecc.NextPowerOfTwo(uint64(ccs.GetNbConstraints()+ccs.GetNbPublicVariables())) + 3
+}
+
+// NewDevSRS creates a KZG SRS from local randomness. Whoever runs it knows
+// the toxic waste, it is only suitable for development.
+func NewDevSRS(size uint64) (kzg.SRS, error) {
+	alpha, err := rand.Int(rand.Reader, curve.ScalarField())
+	if err != nil {
+		return nil, fmt.Errorf("sample: %w", err)
+	}
+	return kzg_bn254.NewSRS(size, alpha)
+}
+
+func ReadSRS(name string) (kzg.SRS, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("open srs: %w", err)
+	}
+	defer f.Close()
+	srs := kzg.NewSRS(curve)
+	if _, err := srs.ReadFrom(f); err != nil {
+		return nil, fmt.Errorf("read srs: %w", err)
+	}
+	return srs, nil
+}
+
+// Write stores the constraint system and keys into files.
+func (k *Keys) Write(files Files) error {
+	fccs, err := os.Create(files.CCS)
+	if err != nil {
+		return err
+	}
+	defer fccs.Close()
+	if _, err = k.CCS.WriteTo(fccs); err != nil {
+		return err
+	}
+
+	fvk, err := os.Create(files.VK)
+	if err != nil {
+		return err
+	}
+	defer fvk.Close()
+	fpk, err := os.Create(files.PK)
+	if err != nil {
+		return err
+	}
+	defer fpk.Close()
+
+	switch k.Backend {
+	case Groth16:
+		if _, err = k.Groth16VK.WriteRawTo(fvk); err != nil {
+			return err
+		}
+		_, err = k.Groth16PK.WriteRawTo(fpk)
+		return err
+	case Plonk:
+		if _, err = k.PlonkVK.WriteTo(fvk); err != nil {
+			return err
+		}
+		if _, err = k.PlonkPK.WriteTo(fpk); err != nil {
+			return err
+		}
+		fsrs, err := os.Create(files.SRS)
+		if err != nil {
+			return err
+		}
+		defer fsrs.Close()
+		_, err = k.SRS.WriteTo(fsrs)
+		return err
+	default:
+		return fmt.Errorf("unknown backend %q", k.Backend)
+	}
+}
+
+// ErrOffChain is returned for the on-chain verification of PLONK proofs. The
+// PLONK Solidity template of the pinned gnark is out of date, so PLONK proofs
+// are only verified off-chain.
+var ErrOffChain = errors.New("plonk proofs are only verified off-chain")
+
+// ExportSolidity writes the Solidity verifier contract for the Groth16
+// verifying key, it fails with ErrOffChain for PLONK.
+func (k *Keys) ExportSolidity(name string) error {
+	if k.Backend != Groth16 {
+		return ErrOffChain
+	}
+	fsol, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	defer fsol.Close()
+	return k.Groth16VK.ExportSolidity(fsol)
+}
+
+// Read loads the constraint system and keys written by Write. PLONK
+// additionally needs the SRS used during the setup.
+//
+// The pinned gnark does not register the boolean SCS blueprint for CBOR
+// decoding, so a serialized SCS cannot be read back. For PLONK the constraint
+// system is instead compiled again from circuit, which is deterministic.
+func Read(b Backend, files Files, circuit frontend.Circuit, opts ...ReadOption) (*Keys, error) {
+	if b == Plonk {
+		// compiled below, so not a part of the progress
+		files.CCS = ""
+	}
+	r, err := newReader(files, opts)
+	if err != nil {
+		return nil, err
+	}
+	ret := &Keys{Backend: b}
+	switch b {
+	case Groth16:
+		ret.CCS = groth16.NewCS(curve)
+		if err := r.readFile("ccs", files.CCS, ret.CCS); err != nil {
+			return nil, fmt.Errorf("ccs: %w", err)
+		}
+		ret.Groth16PK = groth16.NewProvingKey(curve)
+		ret.Groth16VK = groth16.NewVerifyingKey(curve)
+		if err := r.readFile("pk", files.PK, ret.Groth16PK); err != nil {
+			return nil, fmt.Errorf("pk: %w", err)
+		}
+		if err := r.readFile("vk", files.VK, ret.Groth16VK); err != nil {
+			return nil, fmt.Errorf("vk: %w", err)
+		}
+	case Plonk:
+		ccs, err := b.Compile(circuit)
+		if err != nil {
+			return nil, fmt.Errorf("compile: %w", err)
+		}
+		ret.CCS = ccs
+		ret.PlonkPK = plonk.NewProvingKey(curve)
+		ret.PlonkVK = plonk.NewVerifyingKey(curve)
+		if err := r.readFile("pk", files.PK, ret.PlonkPK); err != nil {
+			return nil, fmt.Errorf("pk: %w", err)
+		}
+		if err := r.readFile("vk", files.VK, ret.PlonkVK); err != nil {
+			return nil, fmt.Errorf("vk: %w", err)
+		}
+		ret.SRS = kzg.NewSRS(curve)
+		if err := r.readFile("srs", files.SRS, ret.SRS); err != nil {
+			return nil, fmt.Errorf("srs: %w", err)
+		}
+		// the KZG proving key is not serialized as a part of the proving key
+		ret.PlonkPK.(*plonk_bn254.ProvingKey).Kzg = ret.SRS.(*kzg_bn254.SRS).Pk
+	default:
+		return nil, fmt.Errorf("unknown backend %q", b)
+	}
+	return ret, nil
+}
+
+// Proof is a proof created by one of the backends.
+type Proof struct {
+	Backend Backend
+	Groth16 groth16.Proof
+	Plonk   plonk.Proof
+}
+
+// Proving stages reported to WithStage.
+const (
+	StageWitness = "witness"
+	StageProve   = "prove"
+	StageVerify  = "verify"
+)
+
+// ProveOption configures Prove.
+type ProveOption func(*proveConfig)
+
+type proveConfig struct {
+	stage func(stage string)
+}
+
+// WithStage reports the stage when Prove enters it.
+func WithStage(fn func(stage string)) ProveOption {
+	return func(c *proveConfig) {
+		c.stage = fn
+	}
+}
+
+// Prove creates a proof for the assignment and ensures that the gnark
+// verifier accepts it.
+func (k *Keys) Prove(assignment frontend.Circuit, opts ...ProveOption) (*Proof, error) {
+	cfg := proveConfig{stage: func(string) {}}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	cfg.stage(StageWitness)
+	witness, err := frontend.NewWitness(assignment, curve.ScalarField())
+	if err != nil {
+		return nil, fmt.Errorf("new witness: %w", err)
+	}
+	publicWitness, err := witness.Public()
+	if err != nil {
+		return nil, fmt.Errorf("new public witness: %w", err)
+	}
+	ret := &Proof{Backend: k.Backend}
+	switch k.Backend {
+	case Groth16:
+		cfg.stage(StageProve)
+		if ret.Groth16, err = groth16.Prove(k.CCS, k.Groth16PK, witness, proverOptions()); err != nil {
+			return nil, fmt.Errorf("prove: %w", err)
+		}
+		cfg.stage(StageVerify)
+		if err = groth16.Verify(ret.Groth16, k.Groth16VK, publicWitness); err != nil {
+			return nil, fmt.Errorf("verify: %w", err)
+		}
+	case Plonk:
+		cfg.stage(StageProve)
+		if ret.Plonk, err = plonk.Prove(k.CCS, k.PlonkPK, witness, proverOptions()); err != nil {
+			return nil, fmt.Errorf("prove: %w", err)
+		}
+		cfg.stage(StageVerify)
+		if err = plonk.Verify(ret.Plonk, k.PlonkVK, publicWitness); err != nil {
+			return nil, fmt.Errorf("verify: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown backend %q", k.Backend)
+	}
+	return ret, nil
+}
+
+// Verify verifies the proof against the public witness.
+func (k *Keys) Verify(proof *Proof, publicWitness witness.Witness) error {
+	switch k.Backend {
+	case Groth16:
+		return groth16.Verify(proof.Groth16, k.Groth16VK, publicWitness)
+	case Plonk:
+		return plonk.Verify(proof.Plonk, k.PlonkVK, publicWitness)
+	default:
+		return fmt.Errorf("unknown backend %q", k.Backend)
+	}
+}
+
+func proverOptions() backend.ProverOption {
+	return backend.WithSolverOptions(solver.OverrideHint(
+		solver.GetHintID(cs.Bsb22CommitmentComputePlaceholder), func(mod *big.Int, input, output []*big.Int) error {
+			toHash := make([]byte, 0, (1+mod.BitLen()/8)*len(input))
+			for _, in := range input {
+				inBytes := in.Bytes()
+				toHash = append(toHash, inBytes[:]...)
+			}
+			hsh := sha256.New().Sum(toHash)
+			output[0].SetBytes(hsh)
+			output[0].Mod(output[0], mod)
+			return nil
+		}))
+}
+
+// Groth16Calldata returns the proof points in the form expected by the
+// Solidity verifier.
+func (p *Proof) Groth16Calldata() (a [2]*big.Int, b [2][2]*big.Int, c [2]*big.Int, err error) {
+	if p.Backend != Groth16 {
+		return a, b, c, fmt.Errorf("not a groth16 proof")
+	}
+	// get proof bytes
+	const fpSize = 4 * 8
+	var buf bytes.Buffer
+	if _, err = p.Groth16.WriteRawTo(&buf); err != nil {
+		return a, b, c, err
+	}
+	proofBytes := buf.Bytes()
+
+	// proof.Ar, proof.Bs, proof.Krs
+	a[0] = new(big.Int).SetBytes(proofBytes[fpSize*0 : fpSize*1])
+	a[1] = new(big.Int).SetBytes(proofBytes[fpSize*1 : fpSize*2])
+	b[0][0] = new(big.Int).SetBytes(proofBytes[fpSize*2 : fpSize*3])
+	b[0][1] = new(big.Int).SetBytes(proofBytes[fpSize*3 : fpSize*4])
+	b[1][0] = new(big.Int).SetBytes(proofBytes[fpSize*4 : fpSize*5])
+	b[1][1] = new(big.Int).SetBytes(proofBytes[fpSize*5 : fpSize*6])
+	c[0] = new(big.Int).SetBytes(proofBytes[fpSize*6 : fpSize*7])
+	c[1] = new(big.Int).SetBytes(proofBytes[fpSize*7 : fpSize*8])
+	return a, b, c, nil
+}
+
+// PlonkBytes returns the raw serialized PLONK proof.
+func (p *Proof) PlonkBytes() ([]byte, error) {
+	if p.Backend != Plonk {
+		return nil, fmt.Errorf("not a plonk proof")
+	}
+	var buf bytes.Buffer
+	if _, err := p.Plonk.WriteRawTo(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// WriteWitness writes the full witness of the assignment in the binary
+// format of gnark, for replaying a proof without the card.
+func WriteWitness(name string, assignment frontend.Circuit) error {
+	w, err := frontend.NewWitness(assignment, curve.ScalarField())
+	if err != nil {
+		return fmt.Errorf("new witness: %w", err)
+	}
+	data, err := w.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, data, 0o600)
+}
+
+// ReadWitness reads a witness written by WriteWitness.
+func ReadWitness(name string) (witness.Witness, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	w, err := witness.New(curve.ScalarField())
+	if err != nil {
+		return nil, err
+	}
+	if err := w.UnmarshalBinary(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return w, nil
+}
@@ -0,0 +1,103 @@
+package prover
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/consensys/gnark/frontend"
+)
+
+type squareCircuit struct {
+	X frontend.Variable
+	Y frontend.Variable `gnark:",public"`
+}
+
+func (c *squareCircuit) Define(api frontend.API) error {
+	api.AssertIsEqual(api.Mul(c.X, c.X), c.Y)
+	return nil
+}
+
+func TestBackends(t *testing.T) {
+	for _, b := range []Backend{Groth16, Plonk} {
+		t.Run(string(b), func(t *testing.T) {
+			ccs, err := b.Compile(&squareCircuit{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			srs, err := NewDevSRS(SRSSize(ccs))
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys, err := Setup(b, ccs, srs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files := DefaultFiles(b, filepath.Join(t.TempDir(), "TEST"))
+			if err := keys.Write(files); err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := Read(b, files, &squareCircuit{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			var stages []string
+			proof, err := loaded.Prove(&squareCircuit{X: 3, Y: 9}, WithStage(func(stage string) {
+				stages = append(stages, stage)
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fmt.Sprint(stages) != "[witness prove verify]" {
+				t.Fatalf("unexpected stages %v", stages)
+			}
+			if _, err := loaded.Prove(&squareCircuit{X: 3, Y: 10}); err == nil {
+				t.Fatal("invalid assignment proved")
+			}
+			switch b {
+			case Groth16:
+				if _, _, _, err := proof.Groth16Calldata(); err != nil {
+					t.Fatal(err)
+				}
+				if err := keys.ExportSolidity(files.Solidity); err != nil {
+					t.Fatal(err)
+				}
+			case Plonk:
+				if _, err := proof.PlonkBytes(); err != nil {
+					t.Fatal(err)
+				}
+				if err := keys.ExportSolidity(files.Solidity); !errors.Is(err, ErrOffChain) {
+					t.Fatalf("expected off-chain only, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestWitness(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "witness")
+	if err := WriteWitness(name, &squareCircuit{X: 3, Y: 9}); err != nil {
+		t.Fatal(err)
+	}
+	w, err := ReadWitness(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := w.Public()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(w.Vector(), public.Vector()); got != "[9,3] [9]" {
+		t.Fatalf("unexpected witness %s", got)
+	}
+}
+
+func TestParseBackend(t *testing.T) {
+	if b, err := ParseBackend("plonk"); err != nil || b != Plonk {
+		t.Fatal("plonk not parsed")
+	}
+	if _, err := ParseBackend("marlin"); err == nil {
+		t.Fatal("unknown backend parsed")
+	}
+}
@@ -0,0 +1,119 @@
+package prover
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ReadOption configures Read.
+type ReadOption func(*readConfig)
+
+type readConfig struct {
+	manifest *Manifest
+	unsafe   bool
+	progress func(read, total int64)
+}
+
+// WithManifest checks the digest of every artifact against the manifest
+// before decoding it. The files are read only once.
+func WithManifest(m *Manifest) ReadOption {
+	return func(c *readConfig) {
+		c.manifest = m
+	}
+}
+
+// WithUnsafe skips the curve and subgroup checks when decoding the raw
+// Groth16 keys, which dominate the load time. Only use it together with
+// WithManifest of an authenticated manifest, the digests of an unsigned one
+// vouch for nothing.
+func WithUnsafe() ReadOption {
+	return func(c *readConfig) {
+		c.unsafe = true
+	}
+}
+
+// WithProgress reports the number of bytes decoded over all artifact files.
+func WithProgress(fn func(read, total int64)) ReadOption {
+	return func(c *readConfig) {
+		c.progress = fn
+	}
+}
+
+type unsafeReaderFrom interface {
+	UnsafeReadFrom(r io.Reader) (int64, error)
+}
+
+type reader struct {
+	readConfig
+	read  int64
+	total int64
+}
+
+func newReader(files Files, opts []ReadOption) (*reader, error) {
+	ret := &reader{}
+	for _, opt := range opts {
+		opt(&ret.readConfig)
+	}
+	if ret.progress == nil {
+		return ret, nil
+	}
+	for _, name := range []string{files.CCS, files.PK, files.VK, files.SRS} {
+		if name == "" {
+			continue
+		}
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		ret.total += fi.Size()
+	}
+	return ret, nil
+}
+
+// readFile maps the file into memory, checks its digest if a manifest is
+// given and decodes it into obj.
+func (r *reader) readFile(kind, name string, obj io.ReaderFrom) error {
+	data, unmap, err := mapFile(name)
+	if err != nil {
+		return err
+	}
+	defer unmap()
+	if r.manifest != nil {
+		want, ok := r.manifest.Files[kind]
+		if !ok {
+			return fmt.Errorf("%w: no digest for %s", ErrManifestMismatch, kind)
+		}
+		dgst := sha256.Sum256(data)
+		if got := hex.EncodeToString(dgst[:]); got != want {
+			return fmt.Errorf("%w: %s digest %s, expected %s", ErrManifestMismatch, kind, got, want)
+		}
+	}
+	var in io.Reader = bytes.NewReader(data)
+	if r.progress != nil {
+		in = &progressReader{r: in, reader: r}
+	}
+	if u, ok := obj.(unsafeReaderFrom); ok && r.unsafe {
+		_, err = u.UnsafeReadFrom(in)
+	} else {
+		_, err = obj.ReadFrom(in)
+	}
+	return err
+}
+
+type progressReader struct {
+	r      io.Reader
+	reader *reader
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.reader.read += int64(n)
+		p.reader.progress(p.reader.read, p.reader.total)
+	}
+	return n, err
+}
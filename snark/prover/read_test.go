@@ -0,0 +1,42 @@
+package prover
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestReadOptions(t *testing.T) {
+	for _, b := range []Backend{Groth16, Plonk} {
+		t.Run(string(b), func(t *testing.T) {
+			keys, files := setupFiles(t, b, &squareCircuit{})
+			files.Solidity = ""
+			m, err := NewManifest("square", 1, keys, files)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var read, total int64
+			loaded, err := Read(b, files, &squareCircuit{}, WithManifest(m), WithUnsafe(), WithProgress(func(r, t int64) {
+				read, total = r, t
+			}))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total == 0 || read != total {
+				t.Fatalf("unexpected progress %d/%d", read, total)
+			}
+			if err := m.CheckKeys("square", 1, loaded); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loaded.Prove(&squareCircuit{X: 3, Y: 9}); err != nil {
+				t.Fatal(err)
+			}
+
+			// artifacts of another setup of the same circuit
+			_, otherFiles := setupFiles(t, b, &squareCircuit{})
+			files.PK = otherFiles.PK
+			if _, err := Read(b, files, &squareCircuit{}, WithManifest(m), WithUnsafe()); !errors.Is(err, ErrManifestMismatch) {
+				t.Fatalf("expected pk mismatch, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package prover
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var (
+	ErrManifestSignature = errors.New("manifest signature does not verify")
+	ErrNoReleaseKey      = errors.New("no release key pinned to check the manifest signature")
+)
+
+// ReleaseKey is the hex Ed25519 public key that signs the manifests of
+// released artifacts. Release builds pin it with
+//
+//	-ldflags "-X github.com/ritave/eIDAS-bridge/snark/prover.ReleaseKey=<hex>"
+var ReleaseKey string
+
+// SignatureFile returns the location of the detached signature of the
+// manifest.
+func SignatureFile(manifest string) string {
+	return manifest + ".sig"
+}
+
+// ParseReleaseKey parses a hex Ed25519 public key.
+func ParseReleaseKey(s string) (ed25519.PublicKey, error) {
+	key, err := hex.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("release key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("release key: %d bytes, expected %d", len(key), ed25519.PublicKeySize)
+	}
+	return key, nil
+}
+
+// NewReleaseKey creates a signing key and writes its hex seed to the file,
+// which must not exist.
+func NewReleaseKey(name string) (ed25519.PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintln(f, hex.EncodeToString(key.Seed())); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return key, f.Close()
+}
+
+// ReadReleaseKey reads a signing key written by NewReleaseKey.
+func ReadReleaseKey(name string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: %d bytes, expected %d", name, len(seed), ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// SignManifest signs the manifest file with the release key and writes the
+// hex signature to SignatureFile.
+func SignManifest(name string, key ed25519.PrivateKey) error {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return fmt.Errorf("read manifest: %w", err)
+	}
+	sig := ed25519.Sign(key, data)
+	return os.WriteFile(SignatureFile(name), []byte(hex.EncodeToString(sig)+"\n"), 0o644)
+}
+
+// ReadSignedManifest reads the manifest and ensures that its signature
+// verifies with the release key. The files and keys it records can then be
+// trusted as those of the release.
+func ReadSignedManifest(name string, key ed25519.PublicKey) (*Manifest, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, fmt.Errorf("read manifest: %w", err)
+	}
+	sigHex, err := os.ReadFile(SignatureFile(name))
+	if err != nil {
+		return nil, fmt.Errorf("read manifest signature: %w", err)
+	}
+	sig, err := hex.DecodeString(strings.TrimSpace(string(sigHex)))
+	if err != nil || !ed25519.Verify(key, data, sig) {
+		return nil, fmt.Errorf("%w: %s", ErrManifestSignature, name)
+	}
+	ret, err := parseManifest(data)
+	if err != nil {
+		return nil, err
+	}
+	ret.authenticated = true
+	return ret, nil
+}
+
+// Authenticated reports whether the signature of the manifest was verified
+// by ReadSignedManifest.
+func (m *Manifest) Authenticated() bool {
+	return m.authenticated
+}
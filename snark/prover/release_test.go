@@ -0,0 +1,68 @@
+package prover
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignedManifest(t *testing.T) {
+	keys, files := setupFiles(t, Groth16, &squareCircuit{})
+	files.Solidity = ""
+	m, err := NewManifest("square", 1, keys, files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Write(files.Manifest); err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "release.key")
+	priv, err := NewReleaseKey(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewReleaseKey(keyFile); err == nil {
+		t.Fatal("release key overwritten")
+	}
+	if priv, err = ReadReleaseKey(keyFile); err != nil {
+		t.Fatal(err)
+	}
+	pub, err := ParseReleaseKey(hex.EncodeToString(priv.Public().(ed25519.PublicKey)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSignedManifest(files.Manifest, pub); err == nil {
+		t.Fatal("manifest without signature accepted")
+	}
+	if err := SignManifest(files.Manifest, priv); err != nil {
+		t.Fatal(err)
+	}
+	signed, err := ReadSignedManifest(files.Manifest, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !signed.Authenticated() || signed.VKHash != m.VKHash {
+		t.Fatal("signed manifest not authenticated")
+	}
+	if m, err = ReadManifest(files.Manifest); err != nil || m.Authenticated() {
+		t.Fatalf("unsigned read authenticated: %v", err)
+	}
+
+	// a manifest of other keys under the signature of the release
+	m.VKHash = "00"
+	if err := m.Write(files.Manifest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSignedManifest(files.Manifest, pub); !errors.Is(err, ErrManifestSignature) {
+		t.Fatalf("expected signature error, got %v", err)
+	}
+	if err := os.WriteFile(SignatureFile(files.Manifest), []byte("zz\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadSignedManifest(files.Manifest, pub); !errors.Is(err, ErrManifestSignature) {
+		t.Fatalf("expected signature error, got %v", err)
+	}
+}
@@ -0,0 +1,233 @@
+//go:build ignore
+
+// gen writes the certificate corpus, from ./snark:
+//
+//	go run testdata/certs/gen.go
+//
+// The corpus is synthetic, every key, certificate and CA is created here and
+// only models the card named by the comments. The keys are thrown away,
+// regenerating changes every file.
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ritave/eIDAS-bridge/snark/cards"
+	"github.com/ritave/eIDAS-bridge/snark/cards/sig"
+	"github.com/ritave/eIDAS-bridge/snark/circuits"
+)
+
+const dir = "testdata/certs"
+
+// The challenges signed for Circuit and FCircuit.
+const (
+	circuitChallenge  = "0123456789abcdef"
+	fcircuitChallenge = "test.eth"
+)
+
+var (
+	oidGivenName    = asn1.ObjectIdentifier{2, 5, 4, 42}
+	oidSurname      = asn1.ObjectIdentifier{2, 5, 4, 4}
+	oidSerialNumber = asn1.ObjectIdentifier{2, 5, 4, 5}
+	// id-pkinit-KPClientAuth, smart card logon
+	oidPKINITClientAuth = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 2, 3, 4}
+
+	notBefore = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	notAfter  = time.Date(2034, 1, 1, 0, 0, 0, 0, time.UTC)
+)
+
+func person(cn, given, surname, serial string, country string) pkix.Name {
+	n := pkix.Name{CommonName: cn}
+	if country != "" {
+		n.Country = []string{country}
+	}
+	n.ExtraNames = []pkix.AttributeTypeAndValue{
+		{Type: oidGivenName, Value: given},
+		{Type: oidSurname, Value: surname},
+	}
+	if serial != "" {
+		n.ExtraNames = append(n.ExtraNames, pkix.AttributeTypeAndValue{Type: oidSerialNumber, Value: serial})
+	}
+	return n
+}
+
+// template is the authentication certificate of the card, that of
+// cards.SoftToken for the same subject.
+func template(subject pkix.Name, pub crypto.PublicKey, alg x509.SignatureAlgorithm) *x509.Certificate {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ski := sha1.Sum(der)
+	serial := make([]byte, 9)
+	if _, err := rand.Read(serial); err != nil {
+		log.Fatal(err)
+	}
+	serial[0] = serial[0]&0x7f | 0x01
+	return &x509.Certificate{
+		SerialNumber:          new(big.Int).SetBytes(serial),
+		Subject:               subject,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		SignatureAlgorithm:    alg,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		UnknownExtKeyUsage:    []asn1.ObjectIdentifier{oidPKINITClientAuth},
+		BasicConstraintsValid: true,
+		SubjectKeyId:          ski[:],
+	}
+}
+
+type issuer struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+func newCA(cn, country string) *issuer {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t := template(pkix.Name{CommonName: cn, Organization: []string{"Test Certification Authority"}, Country: []string{country}}, &key.PublicKey, x509.ECDSAWithSHA384)
+	t.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	t.UnknownExtKeyUsage = nil
+	t.IsCA = true
+	der, err := x509.CreateCertificate(rand.Reader, t, t, &key.PublicKey, key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return &issuer{cert, key}
+}
+
+// issue creates the certificate, self-signed without ca. fixed draws the
+// signature again until r and s both take 49 bytes in DER, as cards.SoftToken.
+func issue(t *x509.Certificate, key crypto.Signer, ca *issuer, fixed bool) []*x509.Certificate {
+	parent, signer := t, key
+	if ca != nil {
+		parent, signer = ca.cert, ca.key
+	}
+	for {
+		der, err := x509.CreateCertificate(rand.Reader, t, parent, key.Public(), signer)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if fixed && len(cert.Signature) != 2+2*(2+49) {
+			continue
+		}
+		if ca != nil {
+			return []*x509.Certificate{cert, ca.cert}
+		}
+		return []*x509.Certificate{cert}
+	}
+}
+
+// sign returns the signature of the digest, with high S when asked.
+func sign(key crypto.Signer, digest []byte, raw, highS bool) []byte {
+	ec, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		ret, err := key.Sign(rand.Reader, digest, crypto.SHA256)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return ret
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, ec, digest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s = sig.NormalizeS(ec.Curve, s)
+	if highS {
+		s = new(big.Int).Sub(ec.Curve.Params().N, s)
+	}
+	if raw {
+		return sig.MarshalRaw(r, s, ec.Curve)
+	}
+	ret, err := sig.Marshal(r, s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ret
+}
+
+func write(name string, chain []*x509.Certificate, key crypto.Signer, raw, highS bool) {
+	var data []byte
+	for _, c := range chain {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	files := map[string][]byte{
+		name + ".pem": data,
+		name + ".sig": sign(key, circuits.ChallengeDigest(circuits.Challenge([]byte(fcircuitChallenge))), raw, highS),
+	}
+	digest := sha256.Sum256([]byte(circuitChallenge))
+	files[name+".circuit.sig"] = sign(key, digest[:], raw, highS)
+	for f, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, f), data, 0o644); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func p384() *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+func main() {
+	// models the cards.SoftToken certificate, self-signed with the layout of
+	// circuits.Circuit
+	key := p384()
+	write("pl-p384", issue(template(cards.DefaultSubject, &key.PublicKey, x509.ECDSAWithSHA256), key, nil, true), key, false, false)
+
+	// models the Estonian ID card, issued, with a long UTF-8 subject,
+	// signatures in raw r || s and high S
+	key = p384()
+	ee := person("TAMM,MARI-LIIS,49001011234", "MARI-LIIS", "TÕNISSON-TAMM", "PNOEE-49001011234", "EE")
+	write("ee-p384", issue(template(ee, &key.PublicKey, x509.ECDSAWithSHA256), key, newCA("TEST ESTEID2024", "EE"), false), key, true, true)
+
+	// models the Belgian eID, issued with ECDSA over SHA-384
+	key = p384()
+	be := person("Lucas Peeters (Authentication)", "Lucas", "Peeters", "90010112345", "BE")
+	write("be-p384", issue(template(be, &key.PublicKey, x509.ECDSAWithSHA384), key, newCA("Test Citizen CA", "BE"), false), key, false, true)
+
+	// models a German P-256 key, self-signed
+	p256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	de := person("Erika Mustermann", "Erika", "Mustermann", "", "DE")
+	write("de-p256", issue(template(de, &p256.PublicKey, x509.ECDSAWithSHA256), p256, nil, false), p256, false, false)
+
+	// models the Spanish DNIe, issued RSA 2048, signed with the default
+	// algorithm of the CA
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		log.Fatal(err)
+	}
+	es := person("GARCIA LOPEZ, JUAN (AUTENTICACIÓN)", "JUAN", "GARCIA LOPEZ", "IDCES-00000000T", "ES")
+	write("es-rsa2048", issue(template(es, &rsaKey.PublicKey, x509.UnknownSignatureAlgorithm), rsaKey, newCA("TEST AC DNIE", "ES"), false), rsaKey, false, false)
+}